@@ -0,0 +1,173 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+
+package main
+// Git-backup | Repositories with alternates
+//
+// A repository can borrow objects from other repositories - pools - listed
+// in its objects/info/alternates, e.g. GitLab object pools, or after
+// `git clone --shared`. Fetching from such repository brings in objects it
+// borrows as well, so every repository is restorable by itself. Pools, that
+// are pulled too, are pulled only once as any other repository, and objects
+// common with them are not stored twice thanks to Git deduplication.
+//
+// The relationship is recorded at <repo>/objects/info/alternates in backup
+// tree, one pool per line:
+//
+//   <prefix>/pool.git/objects      for pools that were pulled with the repository
+//   /path/to/pool.git/objects      for pools that were not pulled
+//
+// On restore the alternates file is either
+//
+//   - rewritten to point to restored pools, and objects, that repository
+//     borrows from them, are removed from its pack (default), or
+//   - dropped, and repository is left self-contained.
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"lab.nexedi.com/kirr/go123/xerr"
+	"lab.nexedi.com/kirr/go123/xstrings"
+)
+
+// lsalternates returns absolute paths of object directories of pools
+// repository at gitdir borrows objects from.
+func lsalternates(gitdir string) (objdirv []string, err error) {
+	defer xerr.Contextf(&err, "%s: alternates", gitdir)
+
+	data, err := ioutil.ReadFile(gitdir + "/objects/info/alternates")
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return nil, err
+	}
+
+	objects, err := filepath.Abs(gitdir + "/objects")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range xstrings.SplitLines(string(data), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, `"`) {
+			line, err = strconv.Unquote(line)
+			if err != nil {
+				return nil, fmt.Errorf("invalid entry %q", line)
+			}
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(objects, line) // relative to objects directory
+		}
+		objdirv = append(objdirv, filepath.Clean(line))
+	}
+	return objdirv, nil
+}
+
+// alternates_entries converts object directories of pools to alternates
+// entries in backup tree.
+//
+// pooltab maps absolute path of objects directory of pulled repository to
+// path of that repository in backup.
+func alternates_entries(objdirv []string, pooltab map[string]string) []string {
+	entryv := []string{}
+	for _, objdir := range objdirv {
+		if pool, ok := pooltab[objdir]; ok {
+			entryv = append(entryv, pool+"/objects")
+		} else {
+			entryv = append(entryv, objdir)
+		}
+	}
+	return entryv
+}
+
+// alternates_repo returns repository path in backup tree is alternates file
+// of, if path is <repo>/objects/info/alternates.
+func alternates_repo(path string) (repo string, ok bool) {
+	const alternates = "/objects/info/alternates"
+	if !strings.HasSuffix(path, alternates) {
+		return "", false
+	}
+	return strings.TrimSuffix(path, alternates), true
+}
+
+// RestoredAlternates is alternates entry of restored repository.
+type RestoredAlternates struct {
+	repopath string   // restored repository
+	entryv   []string // as recorded in backup
+}
+
+// alternates_restore points restored repository to restored pools.
+//
+// restoredtab maps path of repositories in backup to where they were restored.
+// Pools, that were not restored, are dropped. Objects repository borrows
+// from pools are then removed from its own packs.
+func alternates_restore(ctx context.Context, a RestoredAlternates, restoredtab map[string]string) (err error) {
+	defer xerr.Contextf(&err, "%s: restore alternates", a.repopath)
+
+	objects, err := filepath.Abs(a.repopath + "/objects")
+	if err != nil {
+		return err
+	}
+	linev := []string{}
+	for _, entry := range a.entryv {
+		pool, ok := restoredtab[strings.TrimSuffix(entry, "/objects")]
+		if !ok {
+			infof("# alternates %s: %s was not restored - dropped", a.repopath, entry)
+			continue
+		}
+		// relative to objects directory, so that restored tree can be moved as a whole
+		poolobjects, err := filepath.Abs(pool + "/objects")
+		if err != nil {
+			return err
+		}
+		line, err := filepath.Rel(objects, poolobjects)
+		if err != nil {
+			return err
+		}
+		linev = append(linev, line)
+	}
+	if len(linev) == 0 {
+		return nil // stays self-contained
+	}
+
+	err = os.MkdirAll(objects+"/info", 0777)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(objects+"/info/alternates", []byte(strings.Join(linev, "\n")+"\n"), 0666)
+	if err != nil {
+		return err
+	}
+
+	// -l: leave out objects borrowed from alternates
+	gerr, _, _ := ggit(ctx, "--git-dir="+a.repopath, "repack", "-a", "-d", "-l", "-q")
+	if gerr != nil {
+		return gerr
+	}
+	return nil
+}
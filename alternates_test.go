@@ -0,0 +1,106 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// verify pull/restore of repositories with alternates.
+func TestPullRestoreAlternates(t *testing.T) {
+	ctx := context.Background()
+
+	workdir := xworkdir(t)
+
+	// src/pool.git <- src/m.git;  ext/pool.git (not pulled) <- src/e.git
+	src := workdir + "/src"
+	ext := workdir + "/ext/pool.git"
+	xgit(ctx, "init", "-q", "--bare", src+"/pool.git")
+	xgit(ctx, "init", "-q", "--bare", ext)
+	c1 := xcommit(ctx, src+"/pool.git", "pool data")
+	xcommit(ctx, ext, "ext data")
+	xgit(ctx, "clone", "-q", "--bare", "--shared", src+"/pool.git", src+"/m.git")
+	xgit(ctx, "clone", "-q", "--bare", "--shared", ext, src+"/e.git")
+	c2 := xcommit(ctx, src+"/m.git", "m data", c1)
+
+	gb := xbackupInit(ctx, t, "backup.git")
+
+	cmd_pull(ctx, gb, []string{src + ":b"})
+
+	for r, want := range map[string]string{
+		"m.git": "b/pool.git/objects\n",
+		"e.git": ext + "/objects\n",
+	} {
+		alternates := xgit(ctx, "cat-file", "blob", "HEAD:b/"+r+"/objects/info/alternates", RunWith{raw: true})
+		if alternates != want {
+			t.Errorf("pull: %s: alternates = %q  ; want %q", r, alternates, want)
+		}
+	}
+
+	// haslocal returns whether repository r has object in its own packs.
+	haslocal := func(r, obj string) bool {
+		idxv, err := filepath.Glob(r + "/objects/pack/*.idx")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, idx := range idxv {
+			data, err := ioutil.ReadFile(idx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(xgit(ctx, "show-index", RunWith{stdin: string(data)}), obj) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// rewrite: m.git borrows from restored pool.git; e.git is self-contained
+	dst := workdir + "/dst"
+	cmd_restore(ctx, gb, []string{"HEAD", "b:" + dst})
+	alternates, err := ioutil.ReadFile(dst + "/m.git/objects/info/alternates")
+	if err != nil || string(alternates) != "../../pool.git/objects\n" {
+		t.Errorf("restore: m.git: alternates: %q, %v", alternates, err)
+	}
+	if haslocal(dst+"/m.git", c1) || !haslocal(dst+"/m.git", c2) {
+		t.Errorf("restore: m.git: objects borrowed from pool are not left out")
+	}
+	if _, err := os.Stat(dst + "/e.git/objects/info/alternates"); !os.IsNotExist(err) {
+		t.Errorf("restore: e.git: alternates to not restored pool kept: %v", err)
+	}
+	xgit(ctx, "--git-dir="+dst+"/m.git", "fsck", "--connectivity-only")
+	xgit(ctx, "--git-dir="+dst+"/e.git", "fsck", "--connectivity-only")
+
+	// drop: all repositories are self-contained
+	dst = workdir + "/dst2"
+	cmd_restore(ctx, gb, []string{"--alternates=drop", "HEAD", "b:" + dst})
+	if _, err := os.Stat(dst + "/m.git/objects/info/alternates"); !os.IsNotExist(err) {
+		t.Errorf("restore --alternates=drop: m.git: alternates kept: %v", err)
+	}
+	if !haslocal(dst+"/m.git", c1) {
+		t.Errorf("restore --alternates=drop: m.git: not self-contained")
+	}
+}
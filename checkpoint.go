@@ -0,0 +1,302 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+package main
+// Git-backup | Checkpointed pulls
+//
+// Pull commits only after it has pulled everything. For big sites this can
+// take hours, and with `pull --checkpoint=<N|T>` pull also commits progress
+// every N pulled repositories, or every T, e.g. 30m. Tree of such checkpoint
+// commit is previous backup state updated with files and repositories pulled
+// so far: its backup.refs has refs of already pulled repositories, and refs
+// from previous backup.refs for the rest. Checkpoint tree also has
+//
+//   backup.checkpoint
+//
+// blob with the list of already pulled repositories:
+//
+//   # git-backup checkpoint 1
+//   run <run>
+//   repo <repopath>
+//   ...
+//
+// with repopaths %-escaped. Final commit of a pull does not have it, which
+// marks backup state as complete.
+//
+// If pull with checkpoints is interrupted, `pull --resume` with the same
+// pullspecs continues after the last checkpoint: repositories it lists are
+// not fetched again, and their refs are taken from the checkpoint as they are.
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"lab.nexedi.com/kirr/go123/exc"
+	"lab.nexedi.com/kirr/go123/my"
+	"lab.nexedi.com/kirr/go123/xerr"
+	"lab.nexedi.com/kirr/go123/xstrings"
+)
+
+const (
+	checkpointFile  = "backup.checkpoint"
+	checkpointIndex = "backup.checkpoint.index" // index checkpoints are prepared in
+	checkpointMagic = "# git-backup checkpoint 1"
+)
+
+// parse_checkpoint parses --checkpoint value: number of repositories, or
+// time interval in between checkpoints.
+func parse_checkpoint(s string) (n int, t time.Duration, err error) {
+	n, err = strconv.Atoi(s)
+	if err == nil && n > 0 {
+		return n, 0, nil
+	}
+	t, err = time.ParseDuration(s)
+	if err == nil && t > 0 {
+		return 0, t, nil
+	}
+	return 0, 0, fmt.Errorf("invalid checkpoint %q: must be number of repositories, or time interval, e.g. 30m", s)
+}
+
+// Checkpoint represents backup.checkpoint of intermediate backup commit.
+type Checkpoint struct {
+	run   string
+	repov []string // repositories pulled so far
+}
+
+func (c *Checkpoint) content() string {
+	s := strings.Builder{}
+	fmt.Fprintf(&s, "%s\nrun %s\n", checkpointMagic, c.run)
+	for _, repopath := range c.repov {
+		fmt.Fprintf(&s, "repo %s\n", path_metaescape(repopath))
+	}
+	return s.String()
+}
+
+// parseCheckpoint parses backup.checkpoint content.
+func parseCheckpoint(data string) (c Checkpoint, err error) {
+	defer xerr.Context(&err, "invalid checkpoint")
+
+	for _, line := range xstrings.SplitLines(data, "\n") {
+		if line == checkpointMagic {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			return c, fmt.Errorf("unsupported format %q", line)
+		}
+		key, value := line, ""
+		if sp := strings.Index(line, " "); sp != -1 {
+			key, value = line[:sp], line[sp+1:]
+		}
+		switch key {
+		case "run":
+			c.run = value
+		case "repo":
+			repopath, err := path_refunescape(value)
+			if err != nil {
+				return c, err
+			}
+			c.repov = append(c.repov, repopath)
+		default:
+			return c, fmt.Errorf("unknown entry %q", line)
+		}
+	}
+	return c, nil
+}
+
+// loadCheckpoint loads backup.checkpoint from backup state HEAD.
+//
+// nil is returned if HEAD is complete backup state.
+func loadCheckpoint(ctx context.Context, HEAD Sha1) (c *Checkpoint, err error) {
+	defer xerr.Contextf(&err, "%s: load checkpoint", HEAD)
+
+	gerr, data, _ := ggit(ctx, "cat-file", "blob", fmt.Sprintf("%s:%s", HEAD, checkpointFile), RunWith{raw: true})
+	if gerr != nil {
+		// not there
+		if ggerr, _, _ := ggit(ctx, "cat-file", "-e", fmt.Sprintf("%s:%s", HEAD, checkpointFile)); ggerr != nil {
+			return nil, nil
+		}
+		return nil, gerr
+	}
+	c = &Checkpoint{}
+	*c, err = parseCheckpoint(data)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadResumed loads which repositories were pulled before the last
+// checkpoint of pull to resume.
+func (p *Pull) loadResumed(ctx context.Context) {
+	p.resumed = StrSet{}
+	if !p.opts.resume || p.opts.dryRun || p.HEAD.IsNull() {
+		return
+	}
+	c, err := loadCheckpoint(ctx, p.HEAD)
+	exc.Raiseif(err)
+	if c == nil {
+		infof("# nothing to resume: backup state is complete")
+		return
+	}
+	infof("# resuming pull %s after %d repositories", c.run, len(c.repov))
+	for _, repopath := range c.repov {
+		p.resumed.Add(repopath)
+	}
+}
+
+// checkpoint commits what was pulled so far.
+//
+// The commit tree is previous backup state updated with what was pulled so
+// far. It is prepared in separate index, as main index is being prepared for
+// final commit. The index is kept in between checkpoints, so that every
+// checkpoint adds to it, and to p.refs, only what was pulled since previous one.
+func (p *Pull) checkpoint(ctx context.Context) {
+	// gb is shared with main worker
+	p.gbMu.Lock()
+	defer p.gbMu.Unlock()
+
+	p.pulledMu.Lock()
+	repov := p.pulledv[:len(p.pulledv):len(p.pulledv)]
+	newv := repov[p.checkpoint_repos:]
+	pulled := make(map[string][]Ref, len(newv))
+	nblobs := len(p.blobbedv)
+	entryv := append([]string{}, p.blobbedv[p.checkpoint_blobs:]...)
+	for _, repopath := range newv {
+		pulled[repopath] = p.pulledtab[repopath]
+		entryv = append(entryv, p.remotetab[repopath]...)
+	}
+	p.pulledMu.Unlock()
+	if len(newv) == 0 {
+		return // nothing new
+	}
+
+	p.refs.Add(ctx, pulled)
+	backup_refs, parentv := p.refs.Make(p.repotab_prev, func(repopath string) bool {
+		return !p.refs.Has(repopath)
+	})
+	backup_refs_sha1 := xgitSha1(ctx, "hash-object", "-w", "--stdin", RunWith{stdin: backup_refs})
+	c := Checkpoint{run: p.run, repov: append([]string{}, repov...)}
+	sort.Strings(c.repov)
+	checkpoint_sha1 := xgitSha1(ctx, "hash-object", "-w", "--stdin", RunWith{stdin: c.content()})
+	entryv = append(entryv,
+		fmt.Sprintf("%o %s\t%s", 0100644, backup_refs_sha1, "backup.refs"),
+		fmt.Sprintf("%o %s\t%s", 0100644, checkpoint_sha1, checkpointFile))
+
+	parent := p.HEAD
+	env := gitenv(map[string]string{"GIT_INDEX_FILE": p.gitdir + "/" + checkpointIndex})
+	if !p.checkpointed.IsNull() {
+		parent = p.checkpointed
+	} else {
+		xgit(ctx, "read-tree", parent, RunWith{env: env})
+	}
+	xgit(ctx, "update-index", "--add", "--replace", "--index-info", RunWith{stdin: strings.Join(entryv, "\n"), env: env})
+	tree := xgitSha1(ctx, "write-tree", RunWith{env: env})
+
+	commit := xcommit_tree(p.gb, tree, append([]Sha1{parent}, parentv...),
+		fmt.Sprintf("Git-backup %s (checkpoint: %d repositories)", p.backup_time, len(repov)))
+	xgit(ctx, "update-ref", "-m", "git-backup pull checkpoint", "HEAD", commit, parent)
+	infof("# checkpoint %s: %d repositories", commit, len(repov))
+
+	p.checkpointed = commit
+	p.checkpoint_time = time.Now()
+	p.checkpoint_repos = len(repov)
+	p.checkpoint_blobs = nblobs
+}
+
+// checkpointer makes checkpoints while pull is in progress.
+//
+// It is woken up by fetch workers every time they pull a repository, and by
+// timer for --checkpoint=T. It returns once all fetch workers are done and
+// close pulledq - final commit follows then.
+func (p *Pull) checkpointer(ctx context.Context) (err error) {
+	// raised err -> return
+	here := my.FuncName()
+	defer exc.Catch(func(e *exc.Error) {
+		err = exc.Addcallingcontext(here, e)
+	})
+
+	// next checkpoint by time is due T after the previous one
+	T := p.opts.checkpointT
+	var timer *time.Timer
+	var timeout <-chan time.Time
+	if T != 0 {
+		timer = time.NewTimer(T)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case _, ok := <-p.pulledq:
+			if !ok {
+				return nil
+			}
+
+		case <-timeout:
+		}
+
+		p.checkpointMaybe(ctx)
+
+		if timer != nil {
+			next := time.Until(p.checkpoint_time.Add(T))
+			if next <= 0 {
+				next = T // nothing new was pulled by now
+			}
+			timer.Stop()
+			select {
+			case <-timer.C:
+			default:
+			}
+			timer.Reset(next)
+		}
+	}
+}
+
+// checkpointMaybe makes checkpoint if --checkpoint tells it is time to.
+func (p *Pull) checkpointMaybe(ctx context.Context) {
+	p.pulledMu.Lock()
+	npulled := len(p.pulledtab)
+	p.pulledMu.Unlock()
+	if (p.opts.checkpointN != 0 && npulled-p.checkpoint_repos >= p.opts.checkpointN) ||
+	   (p.opts.checkpointT != 0 && time.Since(p.checkpoint_time) >= p.opts.checkpointT) {
+		p.checkpoint(ctx)
+	}
+}
+
+// gitenv returns environment for git subprocess with variables of envtab set.
+func gitenv(envtab map[string]string) map[string]string {
+	env := map[string]string{}
+	for _, kv := range os.Environ() {
+		if eq := strings.Index(kv, "="); eq != -1 {
+			env[kv[:eq]] = kv[eq+1:]
+		}
+	}
+	for k, v := range envtab {
+		env[k] = v
+	}
+	return env
+}
@@ -0,0 +1,225 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCheckpoint(t *testing.T) {
+	var tests = []struct {
+		in string
+		n  int
+		t  time.Duration
+		ok bool
+	}{
+		{"100", 100, 0, true},
+		{"30m", 0, 30 * time.Minute, true},
+		{"1h30m", 0, 90 * time.Minute, true},
+		{"0", 0, 0, false},
+		{"-1", 0, 0, false},
+		{"abc", 0, 0, false},
+	}
+	for _, tt := range tests {
+		n, T, err := parse_checkpoint(tt.in)
+		if ok := err == nil; ok != tt.ok || n != tt.n || T != tt.t {
+			t.Errorf("parse_checkpoint(%q) -> %d %s %v  ; want %d %s ok=%v", tt.in, n, T, err, tt.n, tt.t, tt.ok)
+		}
+	}
+}
+
+// verify pulls with checkpoints, and resuming them.
+func TestPullCheckpoint(t *testing.T) {
+	ctx := context.Background()
+
+	workdir := xworkdir(t)
+
+	// 1 fetch worker, so that checkpoints are made in between fetches
+	defer func(njobs0 int) { njobs = njobs0 }(njobs)
+	njobs = 1
+
+	// src/r<i>.git; commit makes new commit on master of every repository
+	src := workdir + "/src"
+	const nrepo = 8
+	masterv := make([]string, nrepo)
+	commit := func(data string) {
+		for i := range masterv {
+			masterv[i] = xcommit(ctx, fmt.Sprintf("%s/r%d.git", src, i), data, masterv[i])
+		}
+	}
+	for i := 0; i < nrepo; i++ {
+		xgit(ctx, "init", "-q", "--bare", fmt.Sprintf("%s/r%d.git", src, i))
+	}
+	commit("data1")
+
+	gb := xbackupInit(ctx, t, "backup.git")
+
+	// masters returns repo -> master sha1 from backup.refs of backup state.
+	masters := func(state string) map[string]string {
+		repotab, err := loadBackupRefs(ctx, xgitSha1(ctx, "rev-parse", state))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mastertab := map[string]string{}
+		for repopath, repo := range repotab {
+			mastertab[repopath] = repo.refs["heads/master"].sha1.String()
+		}
+		return mastertab
+	}
+
+	// pull with checkpoints
+	cmd_pull(ctx, gb, []string{"--checkpoint=2", src + ":b"})
+	c, err := loadCheckpoint(ctx, xgitSha1(ctx, "rev-parse", "HEAD"))
+	if err != nil || c != nil {
+		t.Fatalf("final state is checkpoint: %v, %v", c, err)
+	}
+	checkpointv := []string{}
+	for _, line := range strings.Split(xgit(ctx, "log", "--first-parent", "--format=%H %s", "HEAD^"), "\n") {
+		if strings.HasSuffix(line, "repositories)") {
+			checkpointv = append(checkpointv, line[:40])
+		}
+	}
+	if len(checkpointv) == 0 {
+		t.Fatal("no checkpoints")
+	}
+	state1 := xgit(ctx, "rev-parse", "HEAD")
+
+	// checkpoint is previous state + pulled so far; verify it with 2nd pull
+	commit("data2")
+	cmd_pull(ctx, gb, []string{"--checkpoint=2", src + ":b"})
+	// (the first checkpoint: the last one can have all repositories)
+	log := strings.Split(xgit(ctx, "log", "--first-parent", "--format=%H %s", state1+"..HEAD^"), "\n")
+	if !strings.HasSuffix(log[len(log)-1], "repositories)") {
+		t.Fatalf("2nd pull: no checkpoints:\n%s", strings.Join(log, "\n"))
+	}
+	checkpoint := log[len(log)-1][:40]
+	c, err = loadCheckpoint(ctx, xgitSha1(ctx, "rev-parse", checkpoint))
+	if err != nil || c == nil {
+		t.Fatalf("checkpoint %s: %v, %v", checkpoint, c, err)
+	}
+	if len(c.repov) == 0 || len(c.repov) == nrepo {
+		t.Fatalf("checkpoint %s: %d repositories", checkpoint, len(c.repov))
+	}
+	pulled := StrSet{}
+	for _, repopath := range c.repov {
+		pulled.Add(repopath)
+	}
+	mastertab := masters(checkpoint)
+	prevtab := masters(state1)
+	for i := range masterv {
+		repopath := fmt.Sprintf("b/r%d.git", i)
+		want := prevtab[repopath]
+		if pulled.Contains(repopath) {
+			want = masterv[i]
+		}
+		if mastertab[repopath] != want {
+			t.Errorf("checkpoint %s: %s: master = %s  ; want %s", checkpoint, repopath, mastertab[repopath], want)
+		}
+	}
+
+	// restore from checkpoint
+	cmd_restore(ctx, gb, []string{checkpoint, "b:" + workdir + "/dst-checkpoint"})
+	for repopath, master := range mastertab {
+		dst := workdir + "/dst-checkpoint/" + strings.TrimPrefix(repopath, "b/")
+		if head := xgit(ctx, "--git-dir="+dst, "rev-parse", "HEAD"); head != master {
+			t.Errorf("restore %s: %s: HEAD = %s  ; want %s", checkpoint, repopath, head, master)
+		}
+	}
+
+	// pull interrupted after checkpoint -> resume
+	xgit(ctx, "update-ref", "HEAD", checkpoint)
+	xgit(ctx, "read-tree", "HEAD")
+	masterv2 := append([]string{}, masterv...)
+	commit("data3")
+	cmd_pull(ctx, gb, []string{"--resume", src + ":b"})
+	c, err = loadCheckpoint(ctx, xgitSha1(ctx, "rev-parse", "HEAD"))
+	if err != nil || c != nil {
+		t.Fatalf("resumed: final state is checkpoint: %v, %v", c, err)
+	}
+	mastertab = masters("HEAD")
+	for i := range masterv {
+		repopath := fmt.Sprintf("b/r%d.git", i)
+		want := masterv[i]
+		if pulled.Contains(repopath) {
+			want = masterv2[i] // not fetched again
+		}
+		if mastertab[repopath] != want {
+			t.Errorf("resumed: %s: master = %s  ; want %s", repopath, mastertab[repopath], want)
+		}
+	}
+	cmd_restore(ctx, gb, []string{"HEAD", "b:" + workdir + "/dst"})
+	for repopath, master := range mastertab {
+		dst := workdir + "/dst/" + strings.TrimPrefix(repopath, "b/")
+		if head := xgit(ctx, "--git-dir="+dst, "rev-parse", "HEAD"); head != master {
+			t.Errorf("restore resumed: %s: HEAD = %s  ; want %s", repopath, head, master)
+		}
+	}
+}
+
+// verify that checkpoints are made when the walk is over, but fetches are not.
+func TestPullCheckpointAfterWalk(t *testing.T) {
+	ctx := context.Background()
+
+	workdir := xworkdir(t)
+
+	// 1 fetch worker, and fetchq has room for the rest: the walk is over
+	// right after it starts, while fetches take time.
+	defer func(njobs0 int) { njobs = njobs0 }(njobs)
+	njobs = 1
+	const nrepo = 3
+	defer func() { tfetchPostHook = nil }()
+	tfetchPostHook = func(repo string) {
+		time.Sleep(300 * time.Millisecond)
+	}
+
+	src := workdir + "/src"
+	for i := 0; i < nrepo; i++ {
+		r := fmt.Sprintf("%s/r%d.git", src, i)
+		xgit(ctx, "init", "-q", "--bare", r)
+		xcommit(ctx, r, "data")
+	}
+
+	gb := xbackupInit(ctx, t, "backup.git")
+
+	for _, checkpoint := range []string{"--checkpoint=1", "--checkpoint=100ms"} {
+		_, head, _ := ggit(ctx, "rev-parse", "--verify", "-q", "HEAD")
+		cmd_pull(ctx, gb, []string{checkpoint, src + ":b"})
+
+		argv := []interface{}{"log", "--first-parent", "--format=%s", "HEAD^"}
+		if head != "" {
+			argv = append(argv, "^"+head) // only this pull
+		}
+		partial := 0 // checkpoints with not all repositories
+		for _, line := range strings.Split(xgit(ctx, argv...), "\n") {
+			if strings.HasSuffix(line, "repositories)") &&
+			   !strings.HasSuffix(line, fmt.Sprintf("(checkpoint: %d repositories)", nrepo)) {
+				partial++
+			}
+		}
+		if partial == 0 {
+			t.Errorf("pull %s: no checkpoints in between fetches", checkpoint)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+package main
+// Git-backup | Content-defined chunking of big files
+//
+// Git deduplicates only whole blobs. For a big file, in which only small parts
+// change in between pulls, a whole new blob has to be stored on every pull.
+// Files selected with --chunk are instead split into chunks with boundaries
+// determined by content (with gear rolling hash, as in FastCDC), so that a
+// change in one place of the file affects only one or two chunks, and chunks of
+// unchanged parts are deduplicated by git.
+//
+// Chunked file is stored in backup as tree at the file path:
+//
+//   <path>/.gitbackup-chunked    manifest; mode of the entry is mode of the file
+//   <path>/00000000              chunks in order
+//   <path>/00000001
+//   ...
+//
+// Manifest is
+//
+//   git-backup chunked 1
+//   size <file size>
+//
+// On restore such trees are transparently reassembled back into files.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+
+	"lab.nexedi.com/kirr/go123/exc"
+	"lab.nexedi.com/kirr/go123/mem"
+	"lab.nexedi.com/kirr/go123/xerr"
+	"lab.nexedi.com/kirr/go123/xstrings"
+
+	"lab.nexedi.com/kirr/git-backup/internal/git"
+)
+
+const (
+	chunkManifestName  = ".gitbackup-chunked"
+	chunkManifestMagic = "git-backup chunked 1"
+)
+
+// chunking parameters.
+//
+// NOTE changing them does not break restore of existing backups, but breaks
+// deduplication with chunks pulled before the change.
+var (
+	chunkMin     = 256 << 10 // no chunk boundary before this
+	chunkMax     = 4 << 20   // always chunk boundary at this
+	chunkAvgBits = uint(20)  // ~ average chunk size is 1<<chunkAvgBits
+)
+
+// gear is table of random values for gear rolling hash.
+//
+// It is generated deterministically so that chunk boundaries stay the same in
+// between git-backup runs and versions.
+var gear [256]uint64
+
+func init() {
+	// splitmix64
+	x := uint64(0x6769742d6261636b) // "git-back"
+	for i := range gear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// Chunker splits data stream into content-defined chunks.
+type Chunker struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func NewChunker(r io.Reader) *Chunker {
+	return &Chunker{r: bufio.NewReaderSize(r, 1<<16), buf: make([]byte, 0, chunkMax)}
+}
+
+// Next returns next chunk.
+//
+// The chunk is valid only until next call to Next. io.EOF is returned after
+// the last chunk.
+func (c *Chunker) Next() ([]byte, error) {
+	c.buf = c.buf[:0]
+	h := uint64(0)
+	for len(c.buf) < chunkMax {
+		b, err := c.r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.buf = append(c.buf, b)
+
+		h = (h << 1) + gear[b]
+		if len(c.buf) >= chunkMin && h>>(64-chunkAvgBits) == 0 {
+			break
+		}
+	}
+
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+	return c.buf, nil
+}
+
+// file -> tree of chunks
+//
+// Stat cache is consulted and updated as in file_to_blob.
+//
+// If g is nil, id of the tree in object format objfmt is only computed, and
+// nothing is written.
+func file_to_chunks(g *git.Repository, objfmt ObjectFormat, path string, sc *StatCache) Sha1 {
+	write := func(content []byte, objtype git.ObjectType) (Sha1, error) {
+		if g == nil {
+			return HashObject(objfmt, bytes.NewReader(content), int64(len(content)), objtype)
+		}
+		return WriteObject(g, content, objtype)
+	}
+
+	var st syscall.Stat_t
+	err := syscall.Lstat(path, &st)
+	if err != nil {
+		exc.Raise(&os.PathError{Op: "lstat", Path: path, Err: err})
+	}
+
+	if sc != nil {
+		tree_sha1, ok := sc.Lookup(path, &st, true)
+		if ok {
+			return tree_sha1
+		}
+	}
+
+	f, err := os.Open(path)
+	exc.Raiseif(err)
+	defer f.Close()
+
+	// chunk blob mode is always regular file; the file mode goes to manifest entry
+	filemode := uint32(0100644)
+	if st.Mode&0111 != 0 {
+		filemode = 0100755
+	}
+	manifest := fmt.Sprintf("%s\nsize %d\n", chunkManifestMagic, st.Size)
+	manifest_sha1, err := write(mem.Bytes(manifest), git.ObjectBlob)
+	exc.Raiseif(err)
+
+	// tree entries are sorted by name; manifest name sorts before chunk names
+	tree := []byte{}
+	tree = append(tree, fmt.Sprintf("%o %s\x00", filemode, chunkManifestName)...)
+	tree = append(tree, manifest_sha1.Raw()...)
+
+	size := int64(0)
+	chunker := NewChunker(f)
+	for i := 0; ; i++ {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		exc.Raiseif(err)
+		size += int64(len(chunk))
+
+		chunk_sha1, err := write(chunk, git.ObjectBlob)
+		exc.Raiseif(err)
+		tree = append(tree, fmt.Sprintf("%o %08d\x00", 0100644, i)...)
+		tree = append(tree, chunk_sha1.Raw()...)
+	}
+	if size != st.Size {
+		exc.Raisef("%s: file changed while reading: size %d -> %d", path, st.Size, size)
+	}
+
+	tree_sha1, err := write(tree, git.ObjectTree)
+	exc.Raiseif(err)
+
+	if sc != nil && g != nil {
+		sc.Update(path, &st, tree_sha1, true)
+	}
+
+	return tree_sha1
+}
+
+// chunks_indexinfo returns `git update-index --index-info` entries to add tree
+// of chunks to index at path.
+func chunks_indexinfo(g *git.Repository, tree_sha1 Sha1, path string) []string {
+	tree, err := ReadObject(g, tree_sha1, git.ObjectTree)
+	exc.Raiseif(err)
+	data := tree.Data()
+
+	// <mode> SP <name> NUL <raw sha1>
+	rawsize := tree_sha1.Format().RawSize()
+	entryv := []string{}
+	for len(data) > 0 {
+		nul := bytes.IndexByte(data, 0)
+		if nul == -1 || len(data) < nul+1+rawsize {
+			exc.Raisef("%s: tree %s: invalid entry", path, tree_sha1)
+		}
+		var mode uint32
+		var name string
+		_, err := fmt.Sscanf(string(data[:nul]), "%o %s", &mode, &name)
+		exc.Raiseif(err)
+		sha1 := Sha1FromRaw(tree_sha1.Format(), data[nul+1:])
+		entryv = append(entryv, fmt.Sprintf("%o %s\t%s/%s", mode, sha1, path, name))
+		data = data[nul+1+rawsize:]
+	}
+	return entryv
+}
+
+// parseChunkManifest parses manifest of chunked file.
+//
+// ok=false is returned if data is not chunk manifest.
+func parseChunkManifest(data string) (size int64, ok bool) {
+	magic, tail, err := xstrings.HeadTail(data, "\n")
+	if err != nil || magic != chunkManifestMagic {
+		return 0, false
+	}
+	_, err = fmt.Sscanf(tail, "size %d\n", &size)
+	if err != nil {
+		return 0, false
+	}
+	return size, true
+}
+
+// tree of chunks -> file
+func chunks_to_file(ctx context.Context, g *git.Repository, tree_sha1 Sha1, path string) (err error) {
+	defer xerr.Contextf(&err, "%s: reassemble from chunks %s", path, tree_sha1)
+
+	lstree := xgit(ctx, "ls-tree", "-z", tree_sha1, RunWith{raw: true})
+	var size int64
+	var mode uint32
+	var chunkv []Sha1
+	for _, __ := range xstrings.SplitLines(lstree, "\x00") {
+		emode, type_, sha1, name, err := parse_lstree_entry(__)
+		if err != nil || type_ != "blob" {
+			return fmt.Errorf("invalid/unexpected ls-tree entry %q", __)
+		}
+		if name == chunkManifestName {
+			blob, err := ReadObject(g, sha1, git.ObjectBlob)
+			if err != nil {
+				return err
+			}
+			var ok bool
+			size, ok = parseChunkManifest(mem.String(blob.Data()))
+			if !ok {
+				return fmt.Errorf("invalid manifest")
+			}
+			mode = emode
+			continue
+		}
+		chunkv = append(chunkv, sha1)
+	}
+	if mode == 0 {
+		return fmt.Errorf("no manifest")
+	}
+
+	fd, err := syscall.Open(path, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_TRUNC, mode)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	f := os.NewFile(uintptr(fd), path)
+	defer func() {
+		err2 := f.Close()
+		if err == nil {
+			err = err2
+		}
+	}()
+
+	written := int64(0)
+	for _, chunk_sha1 := range chunkv {
+		blob, err := ReadObject(g, chunk_sha1, git.ObjectBlob)
+		if err != nil {
+			return err
+		}
+		n, err := f.Write(blob.Data())
+		written += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	if written != size {
+		return fmt.Errorf("size mismatch: reassembled %d; manifest says %d", written, size)
+	}
+	return nil
+}
+
+// is_chunk_manifest returns whether path in backup tree could be manifest of chunked file.
+func is_chunk_manifest(path string) bool {
+	return strings.HasSuffix("/"+path, "/"+chunkManifestName)
+}
+
+// is_chunk_manifest_blob returns whether blob is manifest of chunked file and
+// not just a file with the same name as manifest.
+func is_chunk_manifest_blob(g *git.Repository, blob_sha1 Sha1) bool {
+	blob, err := ReadObject(g, blob_sha1, git.ObjectBlob)
+	exc.Raiseif(err)
+	_, ok := parseChunkManifest(mem.String(blob.Data()))
+	return ok
+}
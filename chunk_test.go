@@ -0,0 +1,191 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"lab.nexedi.com/kirr/go123/xstrings"
+)
+
+// setChunkParams sets small chunking parameters for tests.
+func setChunkParams(t *testing.T) {
+	min0, max0, bits0 := chunkMin, chunkMax, chunkAvgBits
+	t.Cleanup(func() {
+		chunkMin, chunkMax, chunkAvgBits = min0, max0, bits0
+	})
+	chunkMin, chunkMax, chunkAvgBits = 1<<10, 16<<10, 12
+}
+
+// xchunks splits data into chunks.
+func xchunks(t *testing.T, data []byte) [][]byte {
+	chunkv := [][]byte{}
+	c := NewChunker(bytes.NewReader(data))
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunkv = append(chunkv, append([]byte(nil), chunk...))
+	}
+	return chunkv
+}
+
+func TestChunker(t *testing.T) {
+	setChunkParams(t)
+
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunkv := xchunks(t, data)
+	if !bytes.Equal(bytes.Join(chunkv, nil), data) {
+		t.Fatal("chunks do not add up to data")
+	}
+	for i, chunk := range chunkv {
+		if len(chunk) > chunkMax || (len(chunk) < chunkMin && i != len(chunkv)-1) {
+			t.Errorf("chunk #%d: len = %d  ; want in [%d, %d]", i, len(chunk), chunkMin, chunkMax)
+		}
+	}
+
+	// insertion in the middle changes only chunks around it
+	data2 := append([]byte(nil), data[:len(data)/2]...)
+	data2 = append(data2, "hello world"...)
+	data2 = append(data2, data[len(data)/2:]...)
+	chunkv2 := xchunks(t, data2)
+
+	seen := map[string]bool{}
+	for _, chunk := range chunkv {
+		seen[string(chunk)] = true
+	}
+	nnew := 0
+	for _, chunk := range chunkv2 {
+		if !seen[string(chunk)] {
+			nnew++
+		}
+	}
+	if nnew > 2 {
+		t.Errorf("insertion: %d new chunks out of %d  ; want <= 2", nnew, len(chunkv2))
+	}
+}
+
+// verify pull/restore of chunked files.
+func TestPullChunked(t *testing.T) {
+	ctx := context.Background()
+	setChunkParams(t)
+
+	workdir := xworkdir(t)
+
+	src := workdir + "/src"
+	err := os.Mkdir(src, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := make([]byte, 1<<20)
+	rand.New(rand.NewSource(2)).Read(big)
+	big2 := append([]byte(nil), big...)
+	copy(big2[len(big2)/3:], "edited in the middle")
+	filev := map[string][]byte{
+		"1.dump":               big,
+		"2.dump":               big2,
+		"x.dat":                big,                    // not selected for chunking
+		"s.dump":               []byte("small"),        // too small for chunking
+		"d/.gitbackup-chunked": []byte("not manifest"), // just a file with manifest name
+	}
+	for name, data := range filev {
+		err = os.MkdirAll(src+"/"+name[:strings.LastIndex("/"+name, "/")], 0777)
+		if err == nil {
+			err = ioutil.WriteFile(src+"/"+name, data, 0755)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gb := xbackupInit(ctx, t, "backup.git")
+	xgit(ctx, "config", "backup.chunk", "*.dump")
+
+	cmd_pull(ctx, gb, []string{src + ":b"})
+
+	for name, chunked := range map[string]bool{"1.dump": true, "2.dump": true, "x.dat": false, "s.dump": false} {
+		type_ := xgit(ctx, "cat-file", "-t", "HEAD:b/"+name)
+		if (type_ == "tree") != chunked {
+			t.Errorf("pull: %s: stored as %s  ; chunked = %v", name, type_, chunked)
+		}
+	}
+
+	// similar files share most of the chunks
+	chunks := func(name string) map[string]bool {
+		chunkv := map[string]bool{}
+		for _, __ := range xstrings.SplitLines(xgit(ctx, "ls-tree", "HEAD:b/"+name), "\n") {
+			_, _, sha1, _, err := parse_lstree_entry(__)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chunkv[sha1.String()] = true
+		}
+		return chunkv
+	}
+	chunks1, chunks2 := chunks("1.dump"), chunks("2.dump")
+	nshared := 0
+	for sha1 := range chunks2 {
+		if chunks1[sha1] {
+			nshared++
+		}
+	}
+	if nshared < len(chunks2)-2 {
+		t.Errorf("pull: similar files share only %d out of %d chunks", nshared, len(chunks2))
+	}
+
+	// second pull of unchanged files reuses statcache and gives the same tree
+	head := xgit(ctx, "rev-parse", "HEAD^{tree}")
+	cmd_pull(ctx, gb, []string{src + ":b"})
+	if head2 := xgit(ctx, "rev-parse", "HEAD^{tree}"); head2 != head {
+		t.Errorf("re-pull: tree changed: %s -> %s", head, head2)
+	}
+
+	dst := workdir + "/dst"
+	cmd_restore(ctx, gb, []string{"HEAD", "b:" + dst})
+	for name, want := range filev {
+		have, err := ioutil.ReadFile(dst + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(have, want) {
+			t.Errorf("restore: %s: content differs", name)
+		}
+	}
+	st, err := os.Stat(dst + "/1.dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode()&0100 == 0 {
+		t.Errorf("restore: 1.dump: mode %s  ; want executable", st.Mode())
+	}
+}
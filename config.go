@@ -0,0 +1,185 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+package main
+// Git-backup | Backup jobs configuration
+//
+// Backup jobs are declared in git config of backup repository, or in a
+// standalone file of the same format given with `pull --config`:
+//
+//   [backup "www"]
+//           pull = /srv/www:www
+//           pull = /srv/dir\\:with\\:colons:misc
+//           pull = git+urls:/etc/repos.txt:repos
+//           exclude = cache/
+//           chunk = *.sql
+//           one-file-system = true
+//           max-file-size = 1G
+//
+// ':' in pullspecs is escaped as '\:', which is written as '\\:' in config
+// files, as git config itself unescapes '\\' to '\'. Single '\:' is only for
+// pullspecs given on command line.
+//
+// `git-backup pull www` then pulls all sources of the job, with exclude
+// patterns and other options of the job applied to them. Options given on
+// command line apply to all pulled sources on top of job options.
+//
+// Options are per job: they apply to every pull entry of the job. Sources,
+// that need different options, are declared as separate jobs, which can be
+// pulled together with e.g. `git-backup pull www misc`.
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"lab.nexedi.com/kirr/go123/xerr"
+	"lab.nexedi.com/kirr/go123/xstrings"
+)
+
+// BackupJob represents one [backup "<name>"] configuration section.
+type BackupJob struct {
+	name      string
+	pullspecv []PullSpec // with job options set
+}
+
+// loadJobs loads backup jobs from git config of backup repository, or, if
+// configfile != "", from that file.
+func loadJobs(ctx context.Context, configfile string) (jobtab map[string]*BackupJob, err error) {
+	where := "backup repository config"
+	argv := []interface{}{"config"}
+	if configfile != "" {
+		where = configfile
+		argv = append(argv, "-f", configfile)
+	}
+	defer xerr.Contextf(&err, "%s: load backup jobs", where)
+
+	argv = append(argv, "-z", "--get-regexp", `^backup\.`)
+	gerr, stdout, _ := ggit(ctx, argv...)
+	if gerr != nil && gerr.ExitCode() != 1 { // 1 = nothing found
+		return nil, gerr
+	}
+
+	// "key\nvalue\0", or "key\0" for key without value
+	jobtab = map[string]*BackupJob{}
+	optstab := map[string]*SourceOptions{}
+	namev := []string{}
+	for _, entry := range xstrings.SplitLines(stdout, "\x00") {
+		key, value, novalue := entry, "", true
+		if nl := strings.Index(entry, "\n"); nl != -1 {
+			key, value, novalue = entry[:nl], entry[nl+1:], false
+		}
+
+		// backup.<name>.<var>; backup.exclude & co are not jobs
+		name := strings.TrimPrefix(key, "backup.")
+		dot := strings.LastIndex(name, ".")
+		if dot == -1 {
+			continue
+		}
+		name, var_ := name[:dot], name[dot+1:]
+
+		job, ok := jobtab[name]
+		if !ok {
+			job = &BackupJob{name: name}
+			jobtab[name] = job
+			optstab[name] = &SourceOptions{}
+			namev = append(namev, name)
+		}
+		opts := optstab[name]
+
+		if novalue && var_ != "one-file-system" && var_ != "reflog" {
+			return nil, fmt.Errorf("%s: no value", key)
+		}
+		switch var_ {
+		case "pull":
+			spec, err := parse_pullspec(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", key, err)
+			}
+			job.pullspecv = append(job.pullspecv, spec)
+
+		case "exclude":
+			opts.excludev = append(opts.excludev, value)
+
+		case "chunk":
+			opts.chunkv = append(opts.chunkv, value)
+
+		case "one-file-system":
+			opts.oneFileSystem, err = parse_bool(value, novalue)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", key, err)
+			}
+
+		case "reflog":
+			opts.reflog, err = parse_bool(value, novalue)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", key, err)
+			}
+
+		case "repo-names":
+			opts.reponames = value
+
+		case "max-file-size":
+			opts.maxFileSize, err = parse_size(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", key, err)
+			}
+
+		default:
+			return nil, fmt.Errorf("%s: unknown option", key)
+		}
+	}
+
+	for _, name := range namev {
+		job := jobtab[name]
+		if len(job.pullspecv) == 0 {
+			return nil, fmt.Errorf("backup %q: nothing to pull", name)
+		}
+		for i := range job.pullspecv {
+			job.pullspecv[i].opts = *optstab[name]
+		}
+	}
+
+	return jobtab, nil
+}
+
+// jobnames returns sorted names of jobs in jobtab.
+func jobnames(jobtab map[string]*BackupJob) []string {
+	namev := []string{}
+	for name := range jobtab {
+		namev = append(namev, name)
+	}
+	sort.Strings(namev)
+	return namev
+}
+
+// parse_bool parses boolean value as git config does.
+func parse_bool(value string, novalue bool) (bool, error) {
+	if novalue {
+		return true, nil
+	}
+	switch strings.ToLower(value) {
+	case "true", "yes", "on", "1":
+		return true, nil
+	case "false", "no", "off", "0", "":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean %q", value)
+}
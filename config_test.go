@@ -0,0 +1,126 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadJobs(t *testing.T) {
+	ctx := context.Background()
+
+	workdir := xworkdir(t)
+
+	config := workdir + "/backup.conf"
+	xconfig := func(text string) {
+		err := ioutil.WriteFile(config, []byte(text), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	xconfig(`
+[backup]
+	exclude = *.log		; not a job
+[backup "www"]
+	pull = /srv/www:www
+	pull = /srv/a\\:b:misc
+	exclude = cache/
+	exclude = *.tmp
+	chunk = *.sql
+	one-file-system
+	max-file-size = 1M
+[backup "etc"]
+	pull = /etc:etc
+`)
+	jobtab, err := loadJobs(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if namev := jobnames(jobtab); !reflect.DeepEqual(namev, []string{"etc", "www"}) {
+		t.Fatalf("jobs: %q  ; want [etc www]", namev)
+	}
+
+	wwwopts := SourceOptions{excludev: []string{"cache/", "*.tmp"}, oneFileSystem: true,
+		maxFileSize: 1 << 20, chunkv: []string{"*.sql"}}
+	want := []PullSpec{
+		{dir: "/srv/www", prefix: "www", opts: wwwopts},
+		{dir: "/srv/a:b", prefix: "misc", opts: wwwopts},
+	}
+	if have := jobtab["www"].pullspecv; !reflect.DeepEqual(have, want) {
+		t.Errorf("www:\nhave: %#v\nwant: %#v", have, want)
+	}
+	want = []PullSpec{{dir: "/etc", prefix: "etc"}}
+	if have := jobtab["etc"].pullspecv; !reflect.DeepEqual(have, want) {
+		t.Errorf("etc:\nhave: %#v\nwant: %#v", have, want)
+	}
+
+	for _, bad := range []string{
+		"[backup \"x\"]\n\tpull = /a\n",                    // no prefix
+		"[backup \"x\"]\n\tpull = /a:b\n\tfrobnicate = 1\n", // unknown option
+		"[backup \"x\"]\n\texclude = *.log\n",               // nothing to pull
+		"[backup \"x\"]\n\tpull = /a:b\n\tmax-file-size = 1X\n",
+	} {
+		xconfig(bad)
+		_, err := loadJobs(ctx, config)
+		if err == nil {
+			t.Errorf("load %q -> ok  ; want error", bad)
+		}
+	}
+}
+
+// verify pull of backup jobs declared in configuration.
+func TestPullConfig(t *testing.T) {
+	ctx := context.Background()
+
+	workdir := xworkdir(t)
+
+	for _, f := range []string{"a:1/x", "a:1/x.log", "b/y", "b/y.log"} {
+		err := os.MkdirAll(workdir+"/"+f[:strings.LastIndex(f, "/")], 0777)
+		if err == nil {
+			err = ioutil.WriteFile(workdir+"/"+f, []byte(f), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gb := xbackupInit(ctx, t, "backup.git")
+
+	// job from backup repository config
+	xgit(ctx, "config", "backup.a.pull", strings.ReplaceAll(workdir, ":", `\:`)+`/a\:1:a`)
+	xgit(ctx, "config", "backup.a.exclude", "*.log")
+	cmd_pull(ctx, gb, []string{"a"})
+
+	// all jobs from standalone file
+	config := workdir + "/backup.conf"
+	xgit(ctx, "config", "-f", config, "backup.b.pull", workdir+"/b:b")
+	cmd_pull(ctx, gb, []string{"--config", config})
+
+	lstree := xgit(ctx, "ls-tree", "-r", "--name-only", "HEAD", "a", "b")
+	if want := "a/x\nb/y\nb/y.log"; lstree != want {
+		t.Errorf("pulled:\n%s\nwant:\n%s", lstree, want)
+	}
+}
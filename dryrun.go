@@ -0,0 +1,262 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+package main
+// Git-backup | Pull dry-run
+//
+// With --dry-run pull walks pulled directories and lists refs of found
+// repositories as usual, but, instead of writing objects, refs and commit, it
+// only computes what would change compared to current backup state, and
+// prints that.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	pathpkg "path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"lab.nexedi.com/kirr/go123/exc"
+	"lab.nexedi.com/kirr/go123/xstrings"
+
+	"lab.nexedi.com/kirr/git-backup/internal/git"
+)
+
+// PullPlan collects changes that pull would make.
+//
+// PullPlan is safe to use from several goroutines simultaneously.
+type PullPlan struct {
+	HEAD  string        `json:"head"` // "" if backup repository is empty
+	Files []PlannedFile `json:"files"`
+	Repos []PlannedRepo `json:"repos"`
+
+	format    ObjectFormat    // of backup repository
+	mu        sync.Mutex
+	headtab   map[string]Sha1 // path in backup -> blob/tree at HEAD, for pulled prefixes
+	headblobv []string        // paths of blobs in headtab
+	seen      StrSet          // paths in backup seen while walking
+}
+
+// PlannedFile describes what pull would do with a file.
+type PlannedFile struct {
+	Path    string `json:"path"`             // in backup
+	Source  string `json:"source,omitempty"` // "" for deleted files
+	Status  string `json:"status"`           // new | modified | unchanged | deleted
+	Size    int64  `json:"size"`
+	Chunked bool   `json:"chunked,omitempty"`
+}
+
+// PlannedRepo describes what pull would do with a repository.
+type PlannedRepo struct {
+	Path    string   `json:"path"` // in backup
+	Source  string   `json:"source"`
+	Refs    int      `json:"refs"`     // number of refs, including detached HEADs
+	NewTips []string `json:"new_tips"` // sha1 of refs not yet in backup
+}
+
+func newPullPlan(HEAD Sha1, format ObjectFormat) *PullPlan {
+	plan := &PullPlan{Files: []PlannedFile{}, Repos: []PlannedRepo{},
+		format: format, headtab: map[string]Sha1{}, seen: StrSet{}}
+	if !HEAD.IsNull() {
+		plan.HEAD = HEAD.String()
+	}
+	return plan
+}
+
+// LoadHead loads what HEAD has under prefix.
+func (plan *PullPlan) LoadHead(ctx context.Context, prefix string) {
+	if plan.HEAD == "" {
+		return
+	}
+	// NOTE -t to also see trees of chunked files
+	lstree := xgit(ctx, "ls-tree", "--full-tree", "-r", "-t", "-z", "--", plan.HEAD, prefix, RunWith{raw: true})
+
+	plan.mu.Lock()
+	defer plan.mu.Unlock()
+	for _, __ := range xstrings.SplitLines(lstree, "\x00") {
+		_, type_, sha1, path, err := parse_lstree_entry(__)
+		exc.Raiseif(err)
+		plan.headtab[path] = sha1
+		if type_ == "blob" {
+			plan.headblobv = append(plan.headblobv, path)
+		}
+	}
+}
+
+// File plans pulling file at path, found while walking dir, into backup_path.
+func (plan *PullPlan) File(dir, path, backup_path string, chunked bool, sc *StatCache) {
+	var st syscall.Stat_t
+	err := syscall.Lstat(path, &st)
+	if err != nil {
+		exc.Raise(&os.PathError{Op: "lstat", Path: path, Err: err})
+	}
+
+	var sha1 Sha1
+	ok := false
+	if sc != nil && !isGitlink(path) {
+		sha1, ok = sc.Lookup(path, &st, chunked)
+	}
+	if !ok {
+		switch {
+		case chunked:
+			sha1 = file_to_chunks(nil, plan.format, path, nil)
+		case isGitlink(path) && st.Mode&syscall.S_IFMT == syscall.S_IFREG:
+			data := gitlink_content(dir, path)
+			sha1, err = HashObject(plan.format, bytes.NewReader(data), int64(len(data)), git.ObjectBlob)
+			exc.Raiseif(err)
+		default:
+			sha1 = file_hash(plan.format, path, &st)
+		}
+	}
+
+	plan.mu.Lock()
+	defer plan.mu.Unlock()
+	plan.seen.Add(backup_path)
+	status := "new"
+	if head, ok := plan.headtab[backup_path]; ok {
+		status = "modified"
+		if head == sha1 {
+			status = "unchanged"
+		}
+	}
+	plan.Files = append(plan.Files, PlannedFile{Path: backup_path, Source: path,
+		Status: status, Size: st.Size, Chunked: chunked})
+}
+
+// file_hash computes id, in object format f, of blob file_to_blob would
+// convert file at path to.
+func file_hash(f ObjectFormat, path string, st *syscall.Stat_t) Sha1 {
+	var r io.Reader
+	size := st.Size
+	if st.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+		target, err := os.Readlink(path)
+		exc.Raiseif(err)
+		r = strings.NewReader(target)
+		size = int64(len(target))
+	} else {
+		file, err := os.Open(path)
+		exc.Raiseif(err)
+		defer file.Close()
+		r = file
+	}
+
+	sha1, err := HashObject(f, r, size, git.ObjectBlob)
+	exc.Raiseif(err)
+	return sha1
+}
+
+// Seen marks path in backup as pulled without planning it as file.
+func (plan *PullPlan) Seen(backup_path string) {
+	plan.mu.Lock()
+	defer plan.mu.Unlock()
+	plan.seen.Add(backup_path)
+}
+
+// Repo plans pulling repository with refv into repopath.
+func (plan *PullPlan) Repo(repo, repopath string, refv []Ref, alreadyHave *Sha1SetSync) {
+	r := PlannedRepo{Path: repopath, Source: repo, Refs: len(refv), NewTips: []string{}}
+	newtips := Sha1Set{}
+	for _, ref := range refv {
+		if !alreadyHave.Contains(ref.sha1) && !newtips.Contains(ref.sha1) {
+			newtips.Add(ref.sha1)
+			r.NewTips = append(r.NewTips, ref.sha1.String())
+		}
+	}
+	sort.Strings(r.NewTips)
+
+	plan.mu.Lock()
+	defer plan.mu.Unlock()
+	plan.Repos = append(plan.Repos, r)
+}
+
+// Finish adds files, that are in HEAD under pulled prefixes, but were not seen, as deleted.
+func (plan *PullPlan) Finish() {
+	plan.mu.Lock()
+	defer plan.mu.Unlock()
+
+	for _, path := range plan.headblobv {
+		chunked := false
+		if is_chunk_manifest(path) {
+			path, chunked = pathpkg.Dir(path), true
+		} else if _, chunk := plan.headtab[pathpkg.Dir(path)+"/"+chunkManifestName]; chunk {
+			continue // covered by manifest
+		}
+		if !plan.seen.Contains(path) {
+			plan.Files = append(plan.Files, PlannedFile{Path: path, Status: "deleted", Chunked: chunked})
+		}
+	}
+
+	sort.Slice(plan.Files, func(i, j int) bool {
+		return plan.Files[i].Path < plan.Files[j].Path
+	})
+	sort.Slice(plan.Repos, func(i, j int) bool {
+		return plan.Repos[i].Path < plan.Repos[j].Path
+	})
+}
+
+// Print prints the plan to w.
+func (plan *PullPlan) Print(w io.Writer, asJSON bool) error {
+	if asJSON {
+		data, err := json.MarshalIndent(plan, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+	}
+
+	head := plan.HEAD
+	if head == "" {
+		head = "(empty)"
+	}
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "# dry-run: changes against %s\n", head)
+	nunchanged := 0
+	for _, f := range plan.Files {
+		if f.Status == "unchanged" {
+			nunchanged++
+			continue
+		}
+		what := f.Status
+		if f.Chunked {
+			what += ",chunked"
+		}
+		if f.Status == "deleted" {
+			fmt.Fprintf(out, "%s\t\t%s\n", what, f.Path)
+		} else {
+			fmt.Fprintf(out, "%s\t%d\t%s\t<- %s\n", what, f.Size, f.Path, f.Source)
+		}
+	}
+	for _, r := range plan.Repos {
+		fmt.Fprintf(out, "repo\t%s\t<- %s\t(%d refs, %d new tips)\n", r.Path, r.Source, r.Refs, len(r.NewTips))
+		for _, tip := range r.NewTips {
+			fmt.Fprintf(out, "\tnew tip %s\n", tip)
+		}
+	}
+	fmt.Fprintf(out, "# %d files unchanged\n", nunchanged)
+
+	return out.Flush()
+}
@@ -0,0 +1,138 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// verify that pull --dry-run shows changes and does not write anything.
+func TestPullDryRun(t *testing.T) {
+	ctx := context.Background()
+
+	workdir := xworkdir(t)
+
+	src := workdir + "/src"
+	xwrite := func(path, data string) {
+		err := ioutil.WriteFile(src+"/"+path, []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.Mkdir(src, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xwrite("same", "same")
+	xwrite("changed", "old")
+	xwrite("deleted", "deleted")
+	xgit(ctx, "init", "-q", "--bare", src+"/repo.git")
+	xgit(ctx, "-C", src+"/repo.git", "-c", "user.name=a", "-c", "user.email=b",
+		"commit-tree", "-m", "x", "4b825dc642cb6eb9a060e54bf8d69288fbee4904")
+
+	gb := xbackupInit(ctx, t, "backup.git")
+
+	// dry-run on empty backup
+	xdryrun := func() *PullPlan {
+		t.Helper()
+		stdout := os.Stdout
+		f, err := ioutil.TempFile(workdir, "stdout")
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Stdout = f
+		cmd_pull(ctx, gb, []string{"--dry-run", "--json", src + ":b"})
+		os.Stdout = stdout
+		f.Close()
+
+		data, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan := &PullPlan{}
+		err = json.Unmarshal(data, plan)
+		if err != nil {
+			t.Fatalf("%s\n%s", err, data)
+		}
+		return plan
+	}
+	plan := xdryrun()
+	if plan.HEAD != "" || len(plan.Files) == 0 {
+		t.Fatalf("dry-run on empty backup: %#v", plan)
+	}
+	if gerr, _, _ := ggit(ctx, "rev-parse", "--verify", "HEAD"); gerr == nil {
+		t.Fatal("dry-run on empty backup: HEAD created")
+	}
+
+	cmd_pull(ctx, gb, []string{src + ":b"})
+	head := xgit(ctx, "rev-parse", "HEAD")
+	objects := xgit(ctx, "count-objects", "-v")
+
+	xwrite("changed", "new")
+	xwrite("added", "added")
+	err = os.Remove(src + "/deleted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	xgit(ctx, "-C", src+"/repo.git", "update-ref", "refs/heads/master",
+		xgit(ctx, "-C", src+"/repo.git", "-c", "user.name=a", "-c", "user.email=b",
+			"commit-tree", "-m", "y", "4b825dc642cb6eb9a060e54bf8d69288fbee4904"))
+	newtip := xgit(ctx, "-C", src+"/repo.git", "rev-parse", "refs/heads/master")
+
+	plan = xdryrun()
+	if plan.HEAD != head {
+		t.Errorf("dry-run: head %s  ; want %s", plan.HEAD, head)
+	}
+	status := map[string]string{}
+	for _, f := range plan.Files {
+		status[f.Path] = f.Status
+	}
+	for path, want := range map[string]string{
+		"b/same":          "unchanged",
+		"b/changed":       "modified",
+		"b/added":         "new",
+		"b/deleted":       "deleted",
+		"b/repo.git/HEAD": "unchanged",
+	} {
+		if status[path] != want {
+			t.Errorf("dry-run: %s: %q  ; want %q", path, status[path], want)
+		}
+	}
+	wantRepos := []PlannedRepo{{Path: "b/repo.git", Source: src + "/repo.git", Refs: 1, NewTips: []string{newtip}}}
+	if !reflect.DeepEqual(plan.Repos, wantRepos) {
+		t.Errorf("dry-run: repos:\nhave: %#v\nwant: %#v", plan.Repos, wantRepos)
+	}
+
+	// nothing is written
+	if h := xgit(ctx, "rev-parse", "HEAD"); h != head {
+		t.Errorf("dry-run: HEAD changed: %s -> %s", head, h)
+	}
+	if o := xgit(ctx, "count-objects", "-v"); o != objects {
+		t.Errorf("dry-run: objects written:\n%s\n->\n%s", objects, o)
+	}
+	if refs := xgit(ctx, "for-each-ref", "refs/backup/", "refs/backup.locked"); refs != "" {
+		t.Errorf("dry-run: refs written:\n%s", refs)
+	}
+}
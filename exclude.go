@@ -0,0 +1,232 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+package main
+// Git-backup | Gitignore-style exclude rules for pull
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	pathpkg "path"
+	"strings"
+
+	"lab.nexedi.com/kirr/go123/mem"
+	"lab.nexedi.com/kirr/go123/xerr"
+	"lab.nexedi.com/kirr/go123/xstrings"
+)
+
+// name of per-directory file with exclude patterns
+const backupIgnoreFile = ".git-backupignore"
+
+// ExcludePattern is one gitignore-style pattern.
+//
+// See gitignore(5) for details. In short:
+//
+//  - "!pattern" re-includes what was excluded by previous patterns;
+//  - "pattern/" matches only directories;
+//  - pattern with "/" at the beginning or in the middle is matched relative to
+//    the directory the pattern is defined for; otherwise it is matched against
+//    entry name at any level below that directory;
+//  - "**" matches any number of path components.
+type ExcludePattern struct {
+	glob     string // pattern without "!" prefix and "/" suffix
+	negate   bool   // "!pattern"
+	dironly  bool   // "pattern/"
+	anchored bool   // glob is matched relative to base
+
+	base   string // directory the pattern is defined for, relative to walk root ("" = root)
+	source string // for info only: where the pattern comes from
+}
+
+// parseExcludePattern parses one line of exclude patterns.
+//
+// ok=false is returned for empty lines and comments.
+func parseExcludePattern(line, base, source string) (p ExcludePattern, ok bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return p, false
+	}
+
+	p.base = base
+	p.source = source
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dironly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		p.anchored = true
+		line = strings.TrimLeft(line, "/")
+	}
+	if line == "" {
+		return p, false
+	}
+	p.glob = line
+	return p, true
+}
+
+// match returns whether pattern matches an entry.
+//
+// relpath is path of the entry relative to walk root.
+func (p *ExcludePattern) match(relpath string, isdir bool) bool {
+	if p.dironly && !isdir {
+		return false
+	}
+	if p.base != "" {
+		if !strings.HasPrefix(relpath, p.base+"/") {
+			return false
+		}
+		relpath = relpath[len(p.base)+1:]
+	}
+
+	if !p.anchored {
+		return globmatch(p.glob, pathpkg.Base(relpath))
+	}
+	return globmatchv(strings.Split(p.glob, "/"), strings.Split(relpath, "/"))
+}
+
+func (p *ExcludePattern) String() string {
+	s := p.glob
+	if p.anchored && !strings.Contains(s, "/") {
+		s = "/" + s
+	}
+	if p.negate {
+		s = "!" + s
+	}
+	if p.dironly {
+		s += "/"
+	}
+	return s
+}
+
+// globmatch matches one path component against one pattern component.
+func globmatch(glob, name string) bool {
+	ok, err := pathpkg.Match(glob, name)
+	return ok && err == nil
+}
+
+// globmatchv matches path components against pattern components with "**" support.
+func globmatchv(globv, namev []string) bool {
+	for len(globv) > 0 {
+		if globv[0] == "**" {
+			// "**" matches zero or more components
+			for i := 0; i <= len(namev); i++ {
+				if globmatchv(globv[1:], namev[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(namev) == 0 || !globmatch(globv[0], namev[0]) {
+			return false
+		}
+		globv, namev = globv[1:], namev[1:]
+	}
+	return len(namev) == 0
+}
+
+// Excluder decides which entries to skip while walking a directory on pull.
+//
+// Patterns are taken, in order of increasing precedence, from backup
+// repository configuration, from .git-backupignore files of walked directory
+// and its subdirectories, and from command line. Among patterns of the same
+// origin the last matching pattern wins, and patterns from deeper
+// .git-backupignore files take precedence over patterns from upper ones.
+type Excluder struct {
+	configv  []ExcludePattern            // from backup repository config
+	cmdlinev []ExcludePattern            // from command line
+	dirtab   map[string][]ExcludePattern // relative dir -> patterns from its .git-backupignore
+}
+
+// newExcluder creates Excluder for walking one directory.
+func newExcluder(configv, cmdlinev []string) *Excluder {
+	x := &Excluder{dirtab: map[string][]ExcludePattern{}}
+	for _, line := range configv {
+		if p, ok := parseExcludePattern(line, "", "config backup.exclude"); ok {
+			x.configv = append(x.configv, p)
+		}
+	}
+	for _, line := range cmdlinev {
+		if p, ok := parseExcludePattern(line, "", "--exclude"); ok {
+			x.cmdlinev = append(x.cmdlinev, p)
+		}
+	}
+	return x
+}
+
+// LoadDir loads patterns from .git-backupignore of directory relpath, if present.
+//
+// It must be called for a directory before its entries are checked with Excluded.
+func (x *Excluder) LoadDir(dirpath, relpath string) (err error) {
+	ignorefile := dirpath + "/" + backupIgnoreFile
+	defer xerr.Contextf(&err, "%s", ignorefile)
+
+	data, err := ioutil.ReadFile(ignorefile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+
+	var patternv []ExcludePattern
+	for i, line := range xstrings.SplitLines(mem.String(data), "\n") {
+		p, ok := parseExcludePattern(line, relpath, fmt.Sprintf("%s:%d", ignorefile, i+1))
+		if ok {
+			patternv = append(patternv, p)
+		}
+	}
+	if len(patternv) != 0 {
+		x.dirtab[relpath] = patternv
+	}
+	return nil
+}
+
+// Excluded checks whether entry at relpath (relative to walk root) has to be skipped.
+//
+// If it has, the pattern that caused exclusion is returned.
+func (x *Excluder) Excluded(relpath string, isdir bool) (excluded bool, by *ExcludePattern) {
+	check := func(patternv []ExcludePattern) {
+		for i := range patternv {
+			p := &patternv[i]
+			if p.match(relpath, isdir) {
+				excluded, by = !p.negate, p
+			}
+		}
+	}
+
+	check(x.configv)
+
+	// .git-backupignore of root and all parent directories, from upper to deeper
+	check(x.dirtab[""])
+	for i := 0; i < len(relpath); i++ {
+		if relpath[i] == '/' {
+			check(x.dirtab[relpath[:i]])
+		}
+	}
+
+	check(x.cmdlinev)
+	return excluded, by
+}
@@ -0,0 +1,153 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExcluder(t *testing.T) {
+	x := newExcluder(
+		/*config*/ []string{"*.tmp", "cache/", "# comment", ""},
+		/*cmdline*/ []string{"!keep.tmp", "/top"},
+	)
+	// .git-backupignore in root and in a/
+	x.dirtab[""] = []ExcludePattern{}
+	for _, line := range []string{"a/**/x.log", "!cache/"} {
+		p, _ := parseExcludePattern(line, "", "root")
+		x.dirtab[""] = append(x.dirtab[""], p)
+	}
+	for _, line := range []string{"b/c", "cache/"} {
+		p, _ := parseExcludePattern(line, "a", "a")
+		x.dirtab["a"] = append(x.dirtab["a"], p)
+	}
+
+	var tests = []struct {
+		path     string
+		isdir    bool
+		excluded bool
+	}{
+		{"hello.txt", false, false},
+		{"hello.tmp", false, true},
+		{"d/hello.tmp", false, true},
+		{"keep.tmp", false, false},  // cmdline overrides config
+		{"cache", true, false},      // root .git-backupignore overrides config
+		{"cache", false, false},     // dir-only pattern does not match files
+		{"a/cache", true, true},     // a/.git-backupignore overrides root
+		{"top", true, true},         // anchored
+		{"d/top", true, false},      // anchored - not matched deeper
+		{"a/x.log", false, true},    // ** matches zero components
+		{"a/1/2/x.log", false, true},
+		{"b/x.log", false, false},
+		{"a/b/c", false, true},      // anchored relative to a/
+		{"b/c", false, false},
+		{"a/d/b/c", false, false},
+	}
+
+	for _, tt := range tests {
+		excluded, _ := x.Excluded(tt.path, tt.isdir)
+		if excluded != tt.excluded {
+			t.Errorf("excluded(%q, dir=%v) -> %v  ; want %v", tt.path, tt.isdir, excluded, tt.excluded)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	var tests = []struct {
+		s    string
+		size int64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"123", 123, true},
+		{"4K", 4096, true},
+		{"2m", 2 << 20, true},
+		{"1G", 1 << 30, true},
+		{"", 0, false},
+		{"K", 0, false},
+		{"-1", 0, false},
+		{"1.5M", 0, false},
+		{"100000000000T", 0, false},
+	}
+
+	for _, tt := range tests {
+		size, err := parse_size(tt.s)
+		if (err == nil) != tt.ok || size != tt.size {
+			t.Errorf("parse_size(%q) -> %d, %v  ; want %d, ok=%v", tt.s, size, err, tt.size, tt.ok)
+		}
+	}
+}
+
+// verify that pull skips excluded entries.
+func TestPullExclude(t *testing.T) {
+	ctx := context.Background()
+
+	workdir := xworkdir(t)
+
+	// source tree
+	src := workdir + "/src"
+	xwrite := func(path, data string) {
+		err := os.MkdirAll(src+"/"+path[:strings.LastIndex("/"+path, "/")], 0777)
+		if err == nil {
+			err = ioutil.WriteFile(src+"/"+path, []byte(data), 0666)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	xwrite("hello.txt", "hello")
+	xwrite("big.dat", strings.Repeat("x", 2048))
+	xwrite("x.tmp", "tmp")
+	xwrite("keep.tmp", "keep")
+	xwrite("cache/c", "cache")
+	xwrite("sub/.git-backupignore", "*.log\n!important.log\n")
+	xwrite("sub/a.log", "log")
+	xwrite("sub/important.log", "important")
+	xwrite("sub/nolog/a.log", "log")
+	xwrite("other/a.log", "log")
+	l, err := net.Listen("unix", src+"/sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	gb := xbackupInit(ctx, t, "backup.git")
+	xgit(ctx, "config", "--add", "backup.exclude", "*.tmp")
+	xgit(ctx, "config", "--add", "backup.exclude", "cache/")
+
+	cmd_pull(ctx, gb, []string{"--exclude=!keep.tmp", "--exclude", "nolog/", "--max-file-size=1K", src + ":b"})
+
+	files := strings.Fields(xgit(ctx, "ls-tree", "-r", "--name-only", "HEAD", "b"))
+	want := []string{
+		"b/hello.txt",
+		"b/keep.tmp",
+		"b/other/a.log",
+		"b/sub/.git-backupignore",
+		"b/sub/important.log",
+	}
+	if strings.Join(files, "\n") != strings.Join(want, "\n") {
+		t.Errorf("pull with excludes:\nhave: %q\nwant: %q", files, want)
+	}
+}
@@ -1,4 +1,4 @@
-// Copyright (C) 2015-2025  Nexedi SA and Contributors.
+// Copyright (C) 2015-2026  Nexedi SA and Contributors.
 //                          Kirill Smelkov <kirr@nexedi.com>
 //
 // This program is free software: you can Use, Study, Modify and Redistribute
@@ -49,9 +49,10 @@ Data for all backuped files and repositories can be accessed if one has access
 to backup repository, so either they all should be in the same security domain,
 or extra care has to be taken to protect access to backup repository.
 
-File permissions are not managed with strict details due to inherent
-nature of Git. This aspect can be improved with e.g. etckeeper-like
-(http://etckeeper.branchable.com/) approach if needed.
+Git trees keep only file type and executable bit. Full file metadata -
+permissions, ownership, mtime and extended attributes including POSIX ACLs -
+is saved to sidecar manifests in backup tree and is reapplied on restore
+(see meta.go).
 
 Please see README.rst with user-level overview on how to use git-backup.
 
@@ -74,7 +75,6 @@ import (
 	"os"
 	"os/signal"
 	pathpkg "path"
-	"path/filepath"
 	"runtime"
 	"runtime/debug"
 	"sort"
@@ -128,8 +128,14 @@ var njobs = runtime.NumCPU()
 
 // -------- create/extract blob --------
 
+// files bigger than this are converted to/from blobs via streaming
+var blobStreamThreshold int64 = 64 << 20
+
 // file -> blob_sha1, mode
-func file_to_blob(g *git.Repository, path string) (Sha1, uint32) {
+//
+// If sc != nil it is consulted whether the file is unchanged since it was
+// previously converted to blob, and is updated with the result.
+func file_to_blob(g *git.Repository, path string, sc *StatCache) (Sha1, uint32) {
 	var blob_content []byte
 
 	// because we want to pass mode to outside world (to e.g. `git update-index`)
@@ -140,24 +146,66 @@ func file_to_blob(g *git.Repository, path string) (Sha1, uint32) {
 		exc.Raise(&os.PathError{"lstat", path, err})
 	}
 
-	if st.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+	if sc != nil {
+		blob_sha1, ok := sc.Lookup(path, &st, false)
+		if ok {
+			return blob_sha1, st.Mode
+		}
+	}
+
+	var blob_sha1 Sha1
+	switch {
+	case st.Mode&syscall.S_IFMT == syscall.S_IFLNK:
 		__, err := os.Readlink(path)
 		blob_content = mem.Bytes(__)
 		exc.Raiseif(err)
-	} else {
+
+	// big files are streamed not to load them into memory
+	case st.Size > blobStreamThreshold:
+		f, err := os.Open(path)
+		exc.Raiseif(err)
+		defer f.Close()
+		blob_sha1, err = WriteObjectStream(g, f, st.Size, git.ObjectBlob)
+		exc.Raiseif(err)
+
+	default:
 		blob_content, err = ioutil.ReadFile(path)
 		exc.Raiseif(err)
 	}
 
-	blob_sha1, err := WriteObject(g, blob_content, git.ObjectBlob)
-	exc.Raiseif(err)
+	if blob_sha1.IsNull() {
+		blob_sha1, err = WriteObject(g, blob_content, git.ObjectBlob)
+		exc.Raiseif(err)
+	}
+
+	if sc != nil {
+		sc.Update(path, &st, blob_sha1, false)
+	}
 
 	return blob_sha1, st.Mode
 }
 
 // blob_sha1, mode -> file
 var tblob_to_file_mid_hook func()
-func blob_to_file(g *git.Repository, blob_sha1 Sha1, mode uint32, path string) {
+func blob_to_file(ctx context.Context, g *git.Repository, blob_sha1 Sha1, mode uint32, path string) {
+	err := os.MkdirAll(pathpkg.Dir(path), 0777)
+	exc.Raiseif(err)
+
+	// big files are streamed not to load them into memory
+	if mode&syscall.S_IFMT == syscall.S_IFREG {
+		size, _, err := ReadObjectHeader(g, blob_sha1)
+		exc.Raiseif(err)
+		if size > blobStreamThreshold {
+			r, err := ReadObjectStream(ctx, g, blob_sha1, git.ObjectBlob)
+			exc.Raiseif(err)
+			err = writefile_from(path, r, mode)
+			err2 := r.Close()
+			exc.Raiseif(err)
+			exc.Raiseif(err2)
+			return
+		}
+	}
+
 	blob, err := ReadObject(g, blob_sha1, git.ObjectBlob)
 	exc.Raiseif(err)
 	blob_content := blob.Data()
@@ -166,9 +214,6 @@ func blob_to_file(g *git.Repository, blob_sha1 Sha1, mode uint32, path string) {
 		tblob_to_file_mid_hook() // we used to corrupt memory if GC is invoked right here
 	}
 
-	err = os.MkdirAll(pathpkg.Dir(path), 0777)
-	exc.Raiseif(err)
-
 	if mode&syscall.S_IFMT == syscall.S_IFLNK {
 		err = os.Symlink(mem.String(blob_content), path)
 		exc.Raiseif(err)
@@ -229,7 +274,7 @@ func obj_represent_as_commit(ctx context.Context, g *git.Repository, sha1 Sha1,
 	//  v                 .tree   -> ø
 	// Commit             .parent -> Commit
 	if tagged_type == git.ObjectCommit {
-		return zcommit_tree(mktree_empty(ctx), []Sha1{tagged_sha1}, obj_encoded)
+		return zcommit_tree(mktree_empty(ctx, gformat(g)), []Sha1{tagged_sha1}, obj_encoded)
 	}
 
 	// Tag        ~>     Commit*
@@ -255,7 +300,7 @@ func obj_represent_as_commit(ctx context.Context, g *git.Repository, sha1 Sha1,
 	// Tag₁               .parent -> Commit₁*
 	if tagged_type == git.ObjectTag {
 		commit1 := obj_represent_as_commit(ctx, g, tagged_sha1, tagged_type)
-		return zcommit_tree(mktree_empty(ctx), []Sha1{commit1}, obj_encoded)
+		return zcommit_tree(mktree_empty(ctx, gformat(g)), []Sha1{commit1}, obj_encoded)
 	}
 
 	exc.Raisef("%s (%q): unknown tagged type", sha1, tagged_type)
@@ -271,15 +316,19 @@ func obj_recreate_from_commit(g *git.Repository, commit_sha1 Sha1) Sha1 {
 	xraise := func(info interface{}) { exc.Raise(&RecreateObjError{commit_sha1, info}) }
 	xraisef := func(f string, a ...interface{}) { xraise(fmt.Sprintf(f, a...)) }
 
-	commit, err := g.LookupCommit(commit_sha1.AsOid())
+	commit, err := ReadObject(g, commit_sha1, git.ObjectCommit)
 	if err != nil {
 		xraise(err)
 	}
-	if commit.ParentCount() > 1 {
+	parentv, msg, err := commit_parse(mem.String(commit.Data()))
+	if err != nil {
+		xraise(err)
+	}
+	if len(parentv) > 1 {
 		xraise(">1 parents")
 	}
 
-	obj_type, obj_raw, err := xstrings.HeadTail(commit.Message(), "\n")
+	obj_type, obj_raw, err := xstrings.HeadTail(msg, "\n")
 	if err != nil {
 		xraise("invalid encoded format")
 	}
@@ -308,10 +357,10 @@ func obj_recreate_from_commit(g *git.Repository, commit_sha1 Sha1) Sha1 {
 		xraisef("encoded tag: %s", err)
 	}
 	if tag.tagged_type == git.ObjectTag {
-		if commit.ParentCount() == 0 {
+		if len(parentv) == 0 {
 			xraise("encoded tag corrupt (tagged is tag but []parent is empty)")
 		}
-		obj_recreate_from_commit(g, Sha1FromOid(commit.ParentId(0)))
+		obj_recreate_from_commit(g, parentv[0])
 	}
 
 	return tag_sha1
@@ -330,367 +379,584 @@ func (e *RecreateObjError) Error() string {
 
 func cmd_pull_usage() {
 	fmt.Fprint(os.Stderr,
-`git-backup pull <dir1>:<prefix1> <dir2>:<prefix2> ...
+`git-backup pull [options] <pullspec1|job1> <pullspec2|job2> ...
 
 Pull bare Git repositories & just files from dir1 into backup prefix1,
 from dir2 into backup prefix2, etc...
+
+  pullspec is one of:
+
+    <dir>:<prefix>                      pull Git repositories & files found
+                                        under local dir into prefix;
+    git+url:<url>:<prefix>/<name>       pull one Git repository from url;
+    git+urls:<file>:<prefix>            pull Git repositories listed in file.
+
+  url is any URL git can fetch from, e.g. ssh://, https://, git:// or file://.
+  Every non-empty line of the list file, except #-comments, is
+
+    <url> [<name>]
+
+  where name defaults to last path component of url.
+
+  ':' in dir, url, file or prefix has to be escaped as '\:', and '\' as '\\'.
+
+  job is name of a backup job declared in configuration as
+
+    [backup "<job>"]
+            pull = <pullspec>           ; can be given several times
+            exclude = <pattern>         ; can be given several times
+            chunk = <pattern>           ; can be given several times
+            one-file-system = <bool>
+            max-file-size = <n>
+            reflog = <bool>
+            repo-names = <file>
+
+  Options of a job apply to all its pullspecs; options given on command line
+  apply to everything pulled on top of them. Sources that need different
+  options are declared as separate jobs.
+
+  options:
+
+    --config <file>     take backup jobs from file instead of configuration of
+                        the backup repository; without arguments pull all jobs
+                        from that file.
+
+    --no-stat-cache     do not trust stat cache and re-read all files;
+                        the stat cache is still refreshed.
+    --wait <timeout>    if backup repository is locked by another pull, wait
+                        up to timeout, e.g. 30m, for it to finish instead of
+                        failing; see git-backup lock.
+
+    --checkpoint <N|T>  commit progress every N pulled repositories, or
+                        every T, e.g. 30m, so that pulled is not lost if
+                        pull is interrupted.
+    --resume            continue interrupted pull with the same pullspecs
+                        after its last checkpoint, without fetching again
+                        repositories pulled by then.
+
+    --exclude <pattern> do not pull files and directories matching pattern;
+                        can be given several times.
+    --one-file-system   do not descend into directories on other filesystems.
+    --max-file-size <n> do not pull files bigger than n bytes (K, M, G suffixes
+                        are accepted).
+    --chunk <pattern>   split big files matching pattern into content-defined
+                        chunks, so that only changed parts of such files take
+                        new space in backup; can be given several times.
+    --reflog            also pull objects referenced from reflogs of local
+                        repositories, so that reflogs of restored repositories
+                        stay usable.
+    --repo-names <file> take human-readable names of repositories from file,
+                        e.g. project paths of GitLab repositories, which
+                        are kept on disk under opaque names, and save them
+                        to backup; see restore --by-name.
+
+    --dry-run           do not write anything to backup; only show which files
+                        would be new, modified or deleted compared to current
+                        backup state, and which repositories would be pulled
+                        with how many refs and new tips.
+    --json              with --dry-run: show that as JSON.
+
+Exclude patterns have gitignore(5) syntax and are relative to pulled dir.
+Besides --exclude, they are also taken from .git-backupignore files in pulled
+directories and from backup.exclude configuration of the backup repository.
+Patterns given on command line take precedence over .git-backupignore, which
+in turn takes precedence over configuration. Skipped entries are reported in
+verbose output.
+
+Chunk patterns have the same syntax as exclude patterns and are also taken
+from backup.chunk configuration of the backup repository. Chunked files are
+transparently reassembled on restore.
+
+File metadata is saved for everything pulled. FIFOs, device nodes, empty
+directories and hardlinks are recorded there and are recreated on restore.
+Sockets are never pulled.
 `)
 }
 
 type PullSpec struct {
 	dir, prefix string
+
+	// options from backup job configuration; command line options override them
+	opts SourceOptions
+
+	// Git repositories to pull from URLs; url pullspec has only one
+	// repository with empty name pulled into prefix itself.
+	remotev []RemoteRepo
+}
+
+// RemoteRepo is a Git repository to be pulled from URL.
+type RemoteRepo struct {
+	url  string
+	name string // pulled into <prefix>/<name>; "" - into <prefix>
+}
+
+// PullOptions represents options for pull.
+type PullOptions struct {
+	noStatCache bool          // re-read all files instead of trusting stat cache
+	wait        time.Duration // wait that long for backup repository lock to be released
+
+	checkpointN int           // commit progress every N pulled repositories
+	checkpointT time.Duration // or every T (see checkpoint.go)
+	resume      bool          // continue pull after its last checkpoint
+
+	// options from command line for all sources
+	SourceOptions
+
+	dryRun bool // only show what would be pulled
+	json   bool // show it as JSON
+}
+
+// SourceOptions represents options for pulling from a source directory.
+type SourceOptions struct {
+	excludev      []string // exclude patterns
+	oneFileSystem bool     // do not cross filesystem boundaries
+	maxFileSize   int64    // skip files bigger than this; 0 = no limit
+
+	chunkv []string // patterns of files to chunk
+
+	reflog bool // also pull objects referenced from reflogs
+
+	reponames string // file with names of repositories (see names.go)
+}
+
+// merge returns options of o overridden by options set in o2.
+func (o SourceOptions) merge(o2 SourceOptions) SourceOptions {
+	o.excludev = append(append([]string{}, o.excludev...), o2.excludev...)
+	o.chunkv = append(append([]string{}, o.chunkv...), o2.chunkv...)
+	o.oneFileSystem = o.oneFileSystem || o2.oneFileSystem
+	o.reflog = o.reflog || o2.reflog
+	if o2.maxFileSize != 0 {
+		o.maxFileSize = o2.maxFileSize
+	}
+	if o2.reponames != "" {
+		o.reponames = o2.reponames
+	}
+	return o
+}
+
+// FetchOptions tells fetch how to fetch from a repository.
+type FetchOptions struct {
+	kind   RepoKind     // of fetched repository
+	objfmt ObjectFormat // of backup repository
+
+	// backup repository is shallow, and the repository has history behind
+	// its shallow commits - fetch all tips with full depth, so that the
+	// history is fetched.
+	deepen bool
+}
+
+// request to fetch a repository
+type FetchReq struct {
+	repo     string // fetch from repository located here
+	repopath string // into backup under this path
+
+	// for info only: request was generated pulling into this backup prefix
+	prefix string
+
+	// repository is not a local directory - its HEAD file has to be synthesized
+	remote bool
+
+	// also fetch objects referenced from reflogs
+	reflog bool
 }
 
 func cmd_pull(ctx context.Context, gb *git.Repository, argv []string) {
+	opts := PullOptions{}
 	flags := flag.FlagSet{Usage: cmd_pull_usage}
 	flags.Init("", flag.ExitOnError)
+	flags.BoolVar(&opts.noStatCache, "no-stat-cache", false, "do not trust stat cache and re-read all files")
+	flags.DurationVar(&opts.wait, "wait", 0, "wait that long for backup repository lock")
+	checkpoint := flags.String("checkpoint", "", "commit progress every N repositories or every T")
+	flags.BoolVar(&opts.resume, "resume", false, "continue interrupted pull after its last checkpoint")
+	flags.Var((*StrList)(&opts.excludev), "exclude", "do not pull entries matching pattern")
+	flags.BoolVar(&opts.oneFileSystem, "one-file-system", false, "do not cross filesystem boundaries")
+	maxFileSize := flags.String("max-file-size", "", "do not pull files bigger than this")
+	flags.Var((*StrList)(&opts.chunkv), "chunk", "split big files matching pattern into chunks")
+	flags.BoolVar(&opts.reflog, "reflog", false, "also pull objects referenced from reflogs")
+	flags.StringVar(&opts.reponames, "repo-names", "", "take names of repositories from this file")
+	flags.BoolVar(&opts.dryRun, "dry-run", false, "only show what would be pulled")
+	flags.BoolVar(&opts.json, "json", false, "with --dry-run: show it as JSON")
+	configfile := flags.String("config", "", "load backup jobs from this file instead of backup repository config")
 	flags.Parse(argv)
 
+	if opts.json {
+		if !opts.dryRun {
+			fmt.Fprintf(os.Stderr, "E: --json requires --dry-run\n")
+			cmd_pull_usage()
+			os.Exit(1)
+		}
+		verbose = 0 // keep stdout valid JSON
+	}
+
+	if *maxFileSize != "" {
+		size, err := parse_size(*maxFileSize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "E: --max-file-size: %s\n", err)
+			cmd_pull_usage()
+			os.Exit(1)
+		}
+		opts.maxFileSize = size
+	}
+
+	if *checkpoint != "" {
+		var err error
+		opts.checkpointN, opts.checkpointT, err = parse_checkpoint(*checkpoint)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "E: --checkpoint: %s\n", err)
+			cmd_pull_usage()
+			os.Exit(1)
+		}
+	}
+
+	// jobs are loaded only if needed
+	var jobtab map[string]*BackupJob
+	xjobs := func() map[string]*BackupJob {
+		if jobtab == nil {
+			var err error
+			jobtab, err = loadJobs(ctx, *configfile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "E: %s\n", err)
+				os.Exit(1)
+			}
+		}
+		return jobtab
+	}
+
 	argv = flags.Args()
 	if len(argv) < 1 {
-		cmd_pull_usage()
-		os.Exit(1)
+		if *configfile == "" {
+			cmd_pull_usage()
+			os.Exit(1)
+		}
+		// pull all jobs from config file
+		argv = jobnames(xjobs())
+		if len(argv) == 0 {
+			fmt.Fprintf(os.Stderr, "E: %s: no backup jobs\n", *configfile)
+			os.Exit(1)
+		}
 	}
 
 	pullspecv := []PullSpec{}
 	for _, arg := range argv {
-		dir, prefix, err := xstrings.Split2(arg, ":")
+		// <dir>:<prefix> or <job>
+		if _, _, err := spec_split(arg, false); err != nil {
+			job, ok := xjobs()[arg]
+			if !ok {
+				fmt.Fprintf(os.Stderr, "E: %q is neither pullspec nor backup job\n", arg)
+				cmd_pull_usage()
+				os.Exit(1)
+			}
+			pullspecv = append(pullspecv, job.pullspecv...)
+			continue
+		}
+
+		spec, err := parse_pullspec(arg)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "E: invalid pullspec %q\n", arg)
+			fmt.Fprintf(os.Stderr, "E: %s\n", err)
 			cmd_pull_usage()
 			os.Exit(1)
 		}
 
-		pullspecv = append(pullspecv, PullSpec{dir, prefix})
+		pullspecv = append(pullspecv, spec)
 	}
 
-	cmd_pull_(ctx, gb, pullspecv)
+	cmd_pull_(ctx, gb, pullspecv, opts)
 }
 
-// Ref is info about a reference pointing to sha1.
-type Ref struct {
-	name string // reference name without "refs/" prefix
-	sha1 Sha1
-}
+// parse_pullspec parses pullspec given on command line.
+func parse_pullspec(arg string) (spec PullSpec, err error) {
+	defer xerr.Contextf(&err, "invalid pullspec %q", arg)
 
-func cmd_pull_(ctx context.Context, gb *git.Repository, pullspecv []PullSpec) {
-	// while pulling, we'll keep refs from all pulled repositories under temp
-	// unique work refs namespace.
-	backup_time := time.Now().Format("20060102-1504")               // %Y%m%d-%H%M
-	backup_refs_work := fmt.Sprintf("refs/backup/%s/", backup_time) // refs/backup/20150820-2109/
-
-	// prevent another `git-backup pull` from running simultaneously
-	backup_lock := "refs/backup.locked"
-	xgit(ctx, "update-ref", backup_lock, mktree_empty(ctx), Sha1{})
-	defer xgit(context.Background(), "update-ref", "-d", backup_lock)
-
-	// make sure there is root commit
-	var HEAD Sha1
-	var err error
-	gerr, __, _ := ggit(ctx, "rev-parse", "--verify", "HEAD")
-	if gerr != nil {
-		infof("# creating root commit")
-		// NOTE `git commit` does not work in bare repo - do commit by hand
-		HEAD = xcommit_tree(gb, mktree_empty(ctx), []Sha1{}, "Initialize git-backup repository")
-		xgit(ctx, "update-ref", "-m", "git-backup pull init", "HEAD", HEAD)
-	} else {
-		HEAD, err = Sha1Parse(__)
-		exc.Raiseif(err)
+	// url and list file may contain ":" themselves - prefix is after the last ":"
+	splitlast := func(s string) (head, tail string, err error) {
+		head, tail, err = spec_split(s, true)
+		if err != nil {
+			return "", "", fmt.Errorf("no prefix")
+		}
+		return head, tail, nil
 	}
 
-	// build index of "already-have" objects: all commits + tag/tree/blob that
-	// were at heads of already pulled repositories.
-	//
-	// Build it once and use below to check ourselves whether a head from a pulled
-	// repository needs to be actually fetched. If we don't, `git fetch-pack`
-	// will do similar to "all commits" linear scan for every pulled repository,
-	// which are many out there.
-	alreadyHave := Sha1Set{}
-	infof("# building \"already-have\" index")
-
-	// already have: all commits
-	//
-	// As of lab.nexedi.com/20180612 there are ~ 1.7·10⁷ objects total in backup.
-	// Of those there are ~ 1.9·10⁶ commit objects, i.e. ~10% of total.
-	// Since 1 sha1 is 2·10¹ bytes, the space needed for keeping sha1 of all
-	// commits is ~ 4·10⁷B = ~40MB. It is thus ok to keep this index in RAM for now.
-	for _, __ := range xstrings.SplitLines(xgit(ctx, "rev-list", HEAD), "\n") {
-		sha1, err := Sha1Parse(__)
-		exc.Raiseif(err)
-		alreadyHave.Add(sha1)
+	switch {
+	case strings.HasPrefix(arg, "git+url:"):
+		url, repopath, err := splitlast(strings.TrimPrefix(arg, "git+url:"))
+		if err != nil {
+			return spec, err
+		}
+		return PullSpec{prefix: repopath, remotev: []RemoteRepo{{url, ""}}}, nil
+
+	case strings.HasPrefix(arg, "git+urls:"):
+		listfile, prefix, err := splitlast(strings.TrimPrefix(arg, "git+urls:"))
+		if err != nil {
+			return spec, err
+		}
+		remotev, err := load_urllist(listfile)
+		if err != nil {
+			return spec, err
+		}
+		return PullSpec{prefix: prefix, remotev: remotev}, nil
+
+	default:
+		dir, prefix, err := spec_split(arg, false)
+		if err != nil {
+			return spec, fmt.Errorf("no prefix")
+		}
+		return PullSpec{dir: dir, prefix: prefix}, nil
 	}
+}
 
-	// already have: tag/tree/blob that were at heads of already pulled repositories
-	//
-	// As of lab.nexedi.com/20180612 there are ~ 8.4·10⁴ refs in total.
-	// Of those encoded tag/tree/blob are ~ 3.2·10⁴, i.e. ~40% of total.
-	// The number of tag/tree/blob objects in alreadyHave is thus negligible
-	// compared to the number of "all commits".
-	hcommit, err := gb.LookupCommit(HEAD.AsOid())
-	exc.Raiseif(err)
-	htree, err := hcommit.Tree()
-	exc.Raiseif(err)
-	if htree.EntryByName("backup.refs") != nil {
-		repotab, err := loadBackupRefs(ctx, fmt.Sprintf("%s:backup.refs", HEAD))
-		exc.Raiseif(err)
+// load_urllist loads list of repositories to pull from file.
+//
+// Every non-empty line of the file, except #-comments, is "<url> [<name>]".
+// Name defaults to last path component of url and is used as is: repositories
+// are recognized by their structure, not by .git suffix.
+func load_urllist(path string) (remotev []RemoteRepo, err error) {
+	defer xerr.Contextf(&err, "%s", path)
 
-		for _, repo := range repotab {
-			for _, xref := range repo.refs {
-				if xref.sha1 != xref.sha1_ && !alreadyHave.Contains(xref.sha1) {
-					// make sure encoded tag/tree/blob objects represented as
-					// commits are present. We do so, because we promise to
-					// fetch that all objects in alreadyHave are present.
-					obj_recreate_from_commit(gb, xref.sha1_)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
 
-					alreadyHave.Add(xref.sha1)
-				}
+	for i, line := range xstrings.SplitLines(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fieldv := strings.Fields(line)
+		url, name := fieldv[0], ""
+		switch len(fieldv) {
+		case 1:
+			name = pathpkg.Base(strings.TrimRight(url, "/"))
+			if i := strings.LastIndex(name, ":"); i != -1 {
+				name = name[i+1:] // host:repo.git
 			}
+		case 2:
+			name = fieldv[1]
+		default:
+			return nil, fmt.Errorf("%d: invalid entry %q", i+1, line)
 		}
+
+		if name == "" || name == "." || name == ".." {
+			return nil, fmt.Errorf("%d: invalid repository name %q", i+1, name)
+		}
+		remotev = append(remotev, RemoteRepo{url, name})
 	}
 
-	// walk over specified dirs, pulling objects from git and blobbing non-git-object files
-	blobbedv := []string{} // info about file pulled to blob, and not yet added to index
-	for _, __ := range pullspecv {
-		dir, prefix := __.dir, __.prefix
+	return remotev, nil
+}
 
-		// make sure index is empty for prefix (so that we start from clean
-		// prefix namespace and this way won't leave stale removed things)
-		xgit(ctx, "rm", "--cached", "-r", "--ignore-unmatch", "--", prefix)
+// isrepo returns whether directory at path is a git repository.
+//
+// Like git itself, we recognize repositories by structure - HEAD, objects/
+// and refs/ or reftable/ - and not by name: in some hosting layouts bare
+// repositories are named without .git suffix.
+func isrepo(path string) bool {
+	head, err := os.Stat(path + "/HEAD")
+	if err != nil || !head.Mode().IsRegular() {
+		return false
+	}
+	objects, err := os.Stat(path + "/objects")
+	if err != nil || !objects.IsDir() {
+		return false
+	}
+	for _, refs := range []string{"refs", "reftable"} {
+		if st, err := os.Stat(path + "/" + refs); err == nil && st.IsDir() {
+			return true
+		}
+	}
+	return false
+}
 
-		here := my.FuncName()
-		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) (errout error) {
-			if err != nil {
-				if os.IsNotExist(err) {
-					// a file or directory was removed in parallel to us scanning the tree.
-					infof("Warning: Skipping %s: %s", path, err)
-					return nil
-				}
-				// any other error -> stop
-				return err
-			}
+// pull_skip checks whether entry at path, found while walking dir, should not be pulled.
+//
+// If so, the reason is returned.
+func pull_skip(excluder *Excluder, opts SourceOptions, dir, path string, info os.FileInfo, rootdev uint64) (reason string) {
+	relpath := strip_prefix(dir, path)
+	if relpath != "" {
+		if excluded, by := excluder.Excluded(relpath, info.IsDir()); excluded {
+			return fmt.Sprintf("excluded by %q from %s", by, by.source)
+		}
+	}
 
-			if ctx.Err() != nil {
-				return ctx.Err()
-			}
+	switch {
+	case info.Mode()&os.ModeSocket != 0:
+		return "socket"
 
-			// propagate exceptions properly via filepath.Walk as errors with calling context
-			// (filepath is not our code)
-			defer exc.Catch(func(e *exc.Error) {
-				errout = exc.Addcallingcontext(here, e)
-			})
+	case info.IsDir():
+		st := info.Sys().(*syscall.Stat_t)
+		if opts.oneFileSystem && uint64(st.Dev) != rootdev {
+			return "on another filesystem"
+		}
 
-			// files -> blobs + queue info for adding blobs to index
-			if !info.IsDir() {
-				// everything related to *.git/refs is ignored
-				// (see below comment about .git/refs for details)
-				if strings.HasSuffix(path, ".git/packed-refs") {
-					return nil
-				}
+	case info.Mode().IsRegular():
+		if opts.maxFileSize != 0 && info.Size() > opts.maxFileSize {
+			return fmt.Sprintf("size %d > max-file-size %d", info.Size(), opts.maxFileSize)
+		}
+	}
 
-				infof("# file %s\t<- %s", prefix, path)
-				blob, mode := file_to_blob(gb, path)
-				blobbedv = append(blobbedv,
-					fmt.Sprintf("%o %s\t%s", mode, blob, reprefix(dir, prefix, path)))
-				return nil
-			}
+	return ""
+}
 
-			// directories -> look for *.git and handle git object specially.
+// Ref is info about a reference pointing to sha1.
+type Ref struct {
+	name   string // reference name without "refs/" prefix
+	sha1   Sha1
+	symref string // for symbolic refs: name of reference it points to, e.g. "refs/heads/main"
+}
 
-			// do not recurse into *.git/objects/  - we'll save them specially
-			if strings.HasSuffix(path, ".git/objects") {
-				return filepath.SkipDir
-			}
+// BackupRefsMaker prepares backup.refs from refs of pulled repositories, and
+// refs of repositories from previous backup.refs.
+//
+// Refs of pulled repositories are converted to backup.refs entries once, when
+// they are added, so that backup.refs can be prepared several times during a
+// pull, e.g. for checkpoints, without converting all refs again.
+type BackupRefsMaker struct {
+	gb *git.Repository
+
+	pulledtab      map[string][]BackupRef // repopath -> its entries with sha1_ computed
+	noncommit_seen map[Sha1]Sha1          // {} sha1 -> sha1_ (there are many duplicate tags)
+}
 
-			// neither we do not recurse into *.git/refs & co  - we'll save refs via backup.refs blob
-			if strings.HasSuffix(path, ".git/refs") || strings.HasSuffix(path, ".git/reftable") {
-				return filepath.SkipDir
-			}
+func newBackupRefsMaker(gb *git.Repository) *BackupRefsMaker {
+	return &BackupRefsMaker{
+		gb:             gb,
+		pulledtab:      map[string][]BackupRef{},
+		noncommit_seen: map[Sha1]Sha1{},
+	}
+}
 
-			// else we recurse, but handle *.git specially - via fetching objects from it
-			if !strings.HasSuffix(path, ".git") {
-				return nil
-			}
-			head, err := os.Stat(path + "/HEAD")
-			if os.IsNotExist(err) || head.IsDir() {
-				return nil // not a git repository
+// Add adds refs of pulled repositories.
+//
+// tag/tree/blob objects refs point to are represented as commits here.
+func (m *BackupRefsMaker) Add(ctx context.Context, pulledtab map[string][]Ref) {
+	// types of all pulled objects
+	heads := Sha1Set{}
+	for _, refv := range pulledtab {
+		for _, ref := range refv {
+			if ref.symref == "" {
+				heads.Add(ref.sha1)
 			}
-			if err != nil {
-				return err
+		}
+	}
+	typetab := xgittypes(ctx, heads.Elements())
+
+	for repopath, refv := range pulledtab {
+		// NOTE repo name is escaped as it can contain e.g. spaces, and we
+		// want its part in backup.refs to be the same as if it was prepared
+		// from refs (which must not contain spaces). Escaping also frees ':'
+		// to be the delimiter in between repo name and ref.
+		reporefprefix := path_refescape(repopath)
+		entryv := make([]BackupRef, 0, len(refv))
+		for _, ref := range refv {
+			if ref.symref != "" {
+				entryv = append(entryv, BackupRef{reporefprefix + ":" + ref.name, BackupRefSha1{symref: ref.symref}})
+				continue // what it points to is saved via target ref
 			}
 
-			// git repo - let's pull all refs from it to our backup refs namespace
-			infof("# git  %s\t<- %s", prefix, path)
-			refv, _, err := fetch(ctx, path, alreadyHave)
-			exc.Raiseif(err)
-
-			// TODO don't store to git references all references from fetched repository:
-			//
-			//      We need to store to git references only references that were actually
-			//      fetched - so that next fetch, e.g. from a fork that also has new data
-			//      as its upstream, won't have to transfer what we just have fetched
-			//      from upstream.
-			//
-			//      For this purpose we can also save references by naming them as their
-			//      sha1, not actual name, which will automatically deduplicate them in
-			//      between several repositories, especially when/if pull will be made to
-			//      work in parallel.
-			//
-			//      Such changed-only deduplicated references should be O(δ) - usually only
-			//      a few, and this way we will also automatically avoid O(n^2) behaviour
-			//      of every git fetch scanning all local references at its startup.
-			//
-			//      For backup.refs, we can generate it directly from refv of all fetched
-			//      repositories saved in RAM.
-			reporefprefix := backup_refs_work +
-				// NOTE repo name is escaped as it can contain e.g. spaces, and refs must not
-				path_refescape(reprefix(dir, prefix, path))
-			for _, ref := range refv {
-				err = mkref(gb, reporefprefix+"/"+ref.name, ref.sha1)
-				exc.Raiseif(err)
+			// represent tag/tree/blob as specially crafted commit, because we
+			// cannot use it as commit parent.
+			sha1_ := ref.sha1
+			if obj_type := typetab[ref.sha1]; obj_type != git.ObjectCommit {
+				var seen bool
+				sha1_, seen = m.noncommit_seen[ref.sha1]
+				if !seen {
+					sha1_ = obj_represent_as_commit(ctx, m.gb, ref.sha1, obj_type)
+					m.noncommit_seen[ref.sha1] = sha1_
+				}
 			}
-
-			// XXX do we want to do full fsck of source git repo on pull as well ?
-
-			return nil
-		})
-
-		// re-raise / raise error after Walk
-		if err != nil {
-			e := exc.Aserror(err)
-			e = exc.Addcontext(e, "pulling from "+dir)
-			exc.Raise(e)
+			entryv = append(entryv, BackupRef{reporefprefix + ":" + ref.name, BackupRefSha1{sha1: ref.sha1, sha1_: sha1_}})
 		}
+		m.pulledtab[repopath] = entryv
 	}
+}
 
-	// add to index files we converted to blobs
-	xgit(ctx, "update-index", "--add", "--index-info", RunWith{stdin: strings.Join(blobbedv, "\n")})
-
-	// all refs from all found git repositories populated.
-	// now prepare manifest with ref -> sha1 and do a synthetic commit merging all that sha1
-	// (so they become all reachable from HEAD -> survive repack and be transferable on git pull)
-	//
-	// NOTE we handle tag/tree/blob objects specially - because these objects cannot
-	// be in commit parents, we convert them to specially-crafted commits and use them.
-	// The commits prepared contain full info how to restore original objects.
+// Has returns whether refs of repository at repopath were added.
+func (m *BackupRefsMaker) Has(repopath string) bool {
+	_, ok := m.pulledtab[repopath]
+	return ok
+}
 
+// Make prepares backup.refs from refs of added repositories, and refs of
+// repositories from previous backup.refs, that preserve tells to keep.
+//
+// Commits, that make everything backup.refs refers to reachable, are
+// returned as well: they are to be parents of backup commit.
+func (m *BackupRefsMaker) Make(repotab_prev map[string]*BackupRepo, preserve func(repopath string) bool) (backup_refs string, parentv []Sha1) {
 	// backup.refs format:
 	//
-	//   1eeb0324 <prefix>/wendelin.core.git/heads/master
-	//   213a9243 <prefix>/wendelin.core.git/tags/v0.4 <213a9243-converted-to-commit>
+	//   1eeb0324 <prefix>/wendelin.core.git:heads/master
+	//   213a9243 <prefix>/wendelin.core.git:tags/v0.4 <213a9243-converted-to-commit>
+	//   ref:refs/heads/master <prefix>/wendelin.core.git:remotes/origin/HEAD
 	//   ...
 	//
-	// NOTE `git for-each-ref` sorts output by ref
+	// where "ref:<target>" entries represent symbolic refs, and ':' delimits
+	// repository path and ref name (see reporef_split).
+	//
+	// NOTE entries are sorted by reporef
 	//      -> backup_refs is sorted and stable between runs
-	backup_refs_dump := xgit(ctx, "for-each-ref", backup_refs_work)
-	backup_refs_list := []Ref{}       // parsed dump
-	backup_refsv := []string{}        // backup.refs content
-	backup_refs_parents := Sha1Set{}  // sha1 for commit parents, obtained from refs
-	noncommit_seen := map[Sha1]Sha1{} // {} sha1 -> sha1_ (there are many duplicate tags)
-	for _, __ := range xstrings.SplitLines(backup_refs_dump, "\n") {
-		sha1, type_, ref := Sha1{}, "", ""
-		_, err := fmt.Sscanf(__, "%s %s %s\n", &sha1, &type_, &ref)
-		if err != nil {
-			exc.Raisef("%s: strange for-each-ref entry %q", backup_refs_work, __)
-		}
-		backup_refs_list = append(backup_refs_list, Ref{ref, sha1})
-		backup_refs_entry := fmt.Sprintf("%s %s", sha1, strip_prefix(backup_refs_work, ref))
-
-		// represent tag/tree/blob as specially crafted commit, because we
-		// cannot use it as commit parent.
-		sha1_ := sha1
-		if type_ != "commit" {
-			//infof("obj_as_commit %s  %s\t%s", sha1, type_, ref)  XXX
-			var seen bool
-			sha1_, seen = noncommit_seen[sha1]
-			if !seen {
-				obj_type, ok := gittype(type_)
-				if !ok {
-					exc.Raisef("%s: invalid git type in entry %q", backup_refs_work, __)
-				}
-				sha1_ = obj_represent_as_commit(ctx, gb, sha1, obj_type)
-				noncommit_seen[sha1] = sha1_
-			}
+	//
+	// NOTE refs of repositories from previous backup.refs are reused
+	//      together with their sha1_.
+	backup_refs_list := []BackupRef{} // reporef -> sha1, sha1_ for all refs
+	for _, entryv := range m.pulledtab {
+		backup_refs_list = append(backup_refs_list, entryv...)
+	}
 
-			backup_refs_entry += fmt.Sprintf(" %s", sha1_)
+	// preserve refs of repositories from previous backup.refs
+	for repopath, repo := range repotab_prev {
+		if !preserve(repopath) {
+			continue
 		}
 
-		backup_refsv = append(backup_refsv, backup_refs_entry)
-
-		if !backup_refs_parents.Contains(sha1_) { // several refs can refer to the same sha1
-			backup_refs_parents.Add(sha1_)
+		reporefprefix := path_refescape(repopath)
+		for _, ref := range repo.refs.Values() {
+			backup_refs_list = append(backup_refs_list, BackupRef{reporefprefix + ":" + ref.name, ref.BackupRefSha1})
 		}
 	}
 
-	backup_refs := strings.Join(backup_refsv, "\n")
-	backup_refs_parentv := backup_refs_parents.Elements()
-	sort.Sort(BySha1(backup_refs_parentv)) // so parents order is stable in between runs
+	sort.Sort(ByRefname(backup_refs_list))
 
-	// backup_refs -> blob
-	backup_refs_sha1 := xgitSha1(ctx, "hash-object", "-w", "--stdin", RunWith{stdin: backup_refs})
-
-	// add backup_refs blob to index
-	xgit(ctx, "update-index", "--add", "--cacheinfo", fmt.Sprintf("100644,%s,backup.refs", backup_refs_sha1))
-
-	// index is ready - prepare tree and commit
-	backup_tree_sha1 := xgitSha1(ctx, "write-tree")
-	commit_sha1 := xcommit_tree(gb, backup_tree_sha1, append([]Sha1{HEAD}, backup_refs_parentv...),
-		"Git-backup "+backup_time)
+	backup_refsv := []string{}       // backup.refs content
+	backup_refs_parents := Sha1Set{} // sha1 for commit parents, obtained from refs
+	for _, ref := range backup_refs_list {
+		if ref.symref != "" {
+			backup_refsv = append(backup_refsv, fmt.Sprintf("ref:%s %s", ref.symref, ref.name))
+			continue
+		}
 
-	xgit(ctx, "update-ref", "-m", "git-backup pull", "HEAD", commit_sha1, HEAD)
+		backup_refs_entry := fmt.Sprintf("%s %s", ref.sha1, ref.name)
+		if ref.sha1_ != ref.sha1 {
+			backup_refs_entry += fmt.Sprintf(" %s", ref.sha1_)
+		}
+		backup_refsv = append(backup_refsv, backup_refs_entry)
 
-	// remove no-longer needed backup refs & verify they don't stay
-	backup_refs_delete := ""
-	for _, ref := range backup_refs_list {
-		backup_refs_delete += fmt.Sprintf("delete %s %s\n", ref.name, ref.sha1)
+		backup_refs_parents.Add(ref.sha1_) // several refs can refer to the same sha1
 	}
 
-	xgit(ctx, "update-ref", "--stdin", RunWith{stdin: backup_refs_delete})
-	__ = xgit(ctx, "for-each-ref", backup_refs_work)
-	if __ != "" {
-		exc.Raisef("Backup refs under %s not deleted properly", backup_refs_work)
-	}
+	backup_refs = strings.Join(backup_refsv, "\n")
+	parentv = backup_refs_parents.Elements()
+	sort.Sort(BySha1(parentv)) // so parents order is stable in between runs
+	return backup_refs, parentv
+}
 
-	// NOTE  `delete` deletes only files, but leaves empty dirs around.
-	//       more important: this affect performance of future `git-backup pull` run a *LOT*
-	//
-	//       reason is: `git pull` first check local refs, and for doing so it
-	//       recourse into all directories, even empty ones.
-	//
-	//       https://lab.nexedi.com/lab.nexedi.com/lab.nexedi.com/issues/4
-	//
-	//       So remove all dirs under backup_refs_work prefix in the end.
-	//
-	// TODO  Revisit this when reworking fetch to be parallel. Reason is: in
-	//       the process of pulling repositories, the more references we
-	//       accumulate, the longer pull starts to be, so it becomes O(n^2).
-	//
-	//       -> what to do is described nearby fetch/mkref call.
-	gitdir := xgit(ctx, "rev-parse", "--git-dir")
-	err = os.RemoveAll(gitdir + "/" + backup_refs_work)
-	exc.Raiseif(err) // NOTE err is nil if path does not exist
-
-	// if we have working copy - update it
-	bare := xgit(ctx, "rev-parse", "--is-bare-repository")
-	if bare != "true" {
-		// `git checkout-index -af`  -- does not delete deleted files
-		// `git read-tree -v -u --reset HEAD~ HEAD`  -- needs index matching
-		// original worktree to properly work, but we already have updated index
-		//
-		// so we get changes we committed as diff and apply to worktree
-		diff := xgit(ctx, "diff", "--binary", HEAD, "HEAD", RunWith{raw: true})
-		if diff != "" {
-			diffstat := xgit(ctx, "apply", "--stat", "--apply", "--binary", "--whitespace=nowarn",
-				RunWith{stdin: diff, raw: true})
-			infof("%s", diffstat)
-		}
+// repo_refv returns refs of repository from backup.refs as []Ref.
+func repo_refv(repo *BackupRepo) []Ref {
+	refv := []Ref{}
+	if repo == nil {
+		return refv // repository without refs
+	}
+	for _, ref := range repo.refs.Values() {
+		refv = append(refv, Ref{name: ref.name, sha1: ref.sha1, symref: ref.symref})
 	}
+	return refv
 }
 
 // fetch makes sure all objects from a repository are present in backup place.
 //
 // It fetches objects that are potentially missing in backup from the
 // repository in question. The objects considered to fetch are those, that are
-// reachable from all repository references.
+// reachable from all repository references, and from headv - tips not
+// advertised as references, e.g. detached HEADs.
 //
 // AlreadyHave can be given to indicate knowledge on what objects our repository
 // already has. If remote advertises tip with sha1 in alreadyHave, that tip won't be
@@ -701,15 +967,23 @@ func cmd_pull_(ctx context.Context, gb *git.Repository, pullspecv []PullSpec) {
 // AlreadyHave does not need to be complete - if we have something that is not
 // in alreadyHave - it can affect only speed, not correctness.
 //
+// On success fetched tips are added to alreadyHave, so that fetches of other
+// repositories, e.g. forks, running simultaneously or later, do not need to
+// fetch them again.
+//
 // Returned are 2 lists of references from the source repository:
 //
-//  - list of all references, and
+//  - list of all references, including headv, and
 //  - list of references we actually had to fetch.
 //
 // Note: fetch does not create any local references - the references returned
 // only describe state of references in fetched source repository.
+//
+// Fopts tell how to fetch from shallow and partial repositories, and into
+// shallow backup. Those fetches must not run simultaneously with other
+// fetches.
 var tfetchPostHook func(repo string)
-func fetch(ctx context.Context, repo string, alreadyHave Sha1Set) (refv, fetchedv []Ref, err error) {
+func fetch(ctx context.Context, repo string, fopts FetchOptions, headv []Ref, alreadyHave *Sha1SetSync) (refv, fetchedv []Ref, err error) {
 	defer xerr.Contextf(&err, "fetch %s", repo)
 	defer func() {
 		if tfetchPostHook != nil {
@@ -718,10 +992,11 @@ func fetch(ctx context.Context, repo string, alreadyHave Sha1Set) (refv, fetched
 	}()
 
 	// first check which references are advertised
-	refv, err = lsremote(ctx, repo)
+	refv, err = lsremote(ctx, repo, fopts.objfmt)
 	if err != nil {
 		return nil, nil, err
 	}
+	refv = append(refv, headv...)
 
 	// check if we already have something
 	var fetchv []Ref // references we need to actually fetch.
@@ -731,11 +1006,80 @@ func fetch(ctx context.Context, repo string, alreadyHave Sha1Set) (refv, fetched
 		}
 	}
 
-	// if there is nothing to fetch - we are done
+	// in shallow backup we might have a tip, but not history behind it -
+	// ask for tips we have as well. They are reachable from backup already
+	// and are not returned as fetched.
+	wantv := fetchv
+	if fopts.deepen {
+		wantv = refv
+	}
+
+	// objects from partial clones are fetched as promisor objects, which
+	// backup repository accepts only with a promisor remote configured.
+	partial := (fopts.kind.filter != "")
+	if partial && len(wantv) != 0 {
+		gerr, _, _ := ggit(ctx, "config", "remote."+promisorRemote+".promisor", "true")
+		if gerr != nil {
+			return nil, nil, gerr
+		}
+	}
+	err = fetch_pack(ctx, repo, fopts, wantv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// if there is nothing fetched - we are done
 	if len(fetchv) == 0 {
 		return refv, fetchv, nil
 	}
 
+	// fetched ok - now check that all fetched tips are indeed fully
+	// connected and that we also have all referenced blob/tree objects. The
+	// reason for this check is that source repository could send us a pack with
+	// e.g. some objects missing and this way even if fetch-pack would report
+	// success, chances could be we won't have all the objects we think we
+	// fetched.
+	//
+	// when checking we assume that the roots we already have at all our
+	// references are ok.
+	//
+	// related link on the subject:
+	// https://git.kernel.org/pub/scm/git/git.git/commit/?h=6d4bb3833c
+	//
+	// objects omitted by filter of partial clone are allowed to be missing.
+	var argv []interface{}
+	arg := func(v ...interface{}) { argv = append(argv, v...) }
+	arg("rev-list", "--quiet", "--objects")
+	if partial {
+		arg("--missing=allow-promisor")
+	}
+	arg("--not", "--all", "--not")
+	for _, ref := range fetchv {
+		arg(ref.sha1)
+	}
+	arg(RunWith{stderr: gitprogress()})
+
+	gerr, _, _ := ggit(ctx, argv...)
+	if gerr != nil {
+		return nil, nil, fmt.Errorf("remote did not send all neccessary objects")
+	}
+
+	// fetched ok
+	for _, ref := range fetchv {
+		alreadyHave.Add(ref.sha1)
+	}
+	return refv, fetchv, nil
+}
+
+// fetch_pack fetches objects fetchv refer to from repo.
+//
+// Fopts tell how to fetch from shallow and partial repositories, and into
+// shallow backup. gitoptv are git options to run fetch-pack with.
+func fetch_pack(ctx context.Context, repo string, fopts FetchOptions, fetchv []Ref, gitoptv ...interface{}) error {
+	if len(fetchv) == 0 {
+		return nil
+	}
+
 	// fetch by sha1 what we don't already have from advertised.
 	//
 	// even if refs would change after ls-remote but before here, we should be
@@ -745,17 +1089,35 @@ func fetch(ctx context.Context, repo string, alreadyHave Sha1Set) (refv, fetched
 	// https://git.kernel.org/pub/scm/git/git.git/commit/?h=051e4005a3
 	var argv []interface{}
 	arg := func(v ...interface{}) { argv = append(argv, v...) }
+	arg(gitoptv...)
 	arg(
 		// check objects for corruption as they are fetched
 		"-c", "fetch.fsckObjects=true",
-		"fetch-pack", "--thin",
+		"fetch-pack", "--thin")
+
+	// shallow commits of repository become shallow in backup.
+	// In shallow backup they are deepened as far as repository allows.
+	if fopts.kind.shallow || fopts.deepen {
+		arg("--update-shallow")
+	}
+	if fopts.deepen {
+		arg("--depth=2147483647")
+	}
 
+	// from partial clone only what it has can be fetched
+	if fopts.kind.filter != "" {
+		arg("--filter="+fopts.kind.filter, "--from-promisor")
+	}
+
+	arg(
 		// force upload-pack to allow us asking any sha1 we want.
 		// needed because advertised refs we got at lsremote time could have changed.
 		"--upload-pack=git -c uploadpack.allowAnySHA1InWant=true"+
 			// workarounds for git < 2.11.1, which does not have uploadpack.allowAnySHA1InWant:
 			" -c uploadpack.allowTipSHA1InWant=true -c uploadpack.allowReachableSHA1InWant=true"+
 			//
+			// and to allow --filter
+			" -c uploadpack.allowFilter=true"+
 			" upload-pack",
 
 		repo)
@@ -766,39 +1128,16 @@ func fetch(ctx context.Context, repo string, alreadyHave Sha1Set) (refv, fetched
 
 	gerr, _, _ := ggit(ctx, argv...)
 	if gerr != nil {
-		return nil, nil, gerr
-	}
-
-	// fetch-pack ran ok - now check that all fetched tips are indeed fully
-	// connected and that we also have all referenced blob/tree objects. The
-	// reason for this check is that source repository could send us a pack with
-	// e.g. some objects missing and this way even if fetch-pack would report
-	// success, chances could be we won't have all the objects we think we
-	// fetched.
-	//
-	// when checking we assume that the roots we already have at all our
-	// references are ok.
-	//
-	// related link on the subject:
-	// https://git.kernel.org/pub/scm/git/git.git/commit/?h=6d4bb3833c
-	argv = nil
-	arg("rev-list", "--quiet", "--objects", "--not", "--all", "--not")
-	for _, ref := range fetchv {
-		arg(ref.sha1)
-	}
-	arg(RunWith{stderr: gitprogress()})
-
-	gerr, _, _ = ggit(ctx, argv...)
-	if gerr != nil {
-		return nil, nil, fmt.Errorf("remote did not send all neccessary objects")
+		return gerr
 	}
-
-	// fetched ok
-	return refv, fetchv, nil
+	return nil
 }
 
 // lsremote lists all references advertised by repo.
-func lsremote(ctx context.Context, repo string) (refv []Ref, err error) {
+//
+// It is an error if repo has object format different from objfmt - the format
+// of backup repository.
+func lsremote(ctx context.Context, repo string, objfmt ObjectFormat) (refv []Ref, err error) {
 	defer xerr.Contextf(&err, "lsremote %s", repo)
 
 	// NOTE --refs instructs to omit peeled refs like
@@ -811,15 +1150,31 @@ func lsremote(ctx context.Context, repo string) (refv []Ref, err error) {
 	//   https://public-inbox.org/git/20180610143231.7131-1-kirr@nexedi.com/
 	//
 	// we don't need to pull them anyway.
-	gerr, stdout, _ := ggit(ctx, "ls-remote", "--refs", repo)
+	//
+	// --symref asks to also show where symbolic refs point to. Only servers
+	// speaking protocol v2 advertise that - with older ones symbolic refs are
+	// saved as regular refs.
+	gerr, stdout, _ := ggit(ctx, "ls-remote", "--refs", "--symref", repo)
 	if gerr != nil {
 		return nil, gerr
 	}
 
+	//  ref: target refname     (only for symbolic refs)
 	//  oid refname
 	//  oid refname
 	//  ...
+	symreftab := map[string]string{} // refname -> target
 	for _, entry := range xstrings.SplitLines(stdout, "\n") {
+		if strings.HasPrefix(entry, "ref: ") {
+			target, ref := "", ""
+			_, err := fmt.Sscanf(entry, "ref: %s %s\n", &target, &ref)
+			if err != nil {
+				return nil, fmt.Errorf("strange output entry: %q", entry)
+			}
+			symreftab[strings.TrimPrefix(ref, "refs/")] = target
+			continue
+		}
+
 		sha1, ref := Sha1{}, ""
 		_, err := fmt.Sscanf(entry, "%s %s\n", &sha1, &ref)
 		if err != nil {
@@ -832,22 +1187,105 @@ func lsremote(ctx context.Context, repo string) (refv []Ref, err error) {
 		}
 		ref = strings.TrimPrefix(ref, "refs/")
 
-		refv = append(refv, Ref{ref, sha1})
+		// objects can be fetched only from repositories with the same object format
+		if f := sha1.Format(); f != objfmt {
+			return nil, fmt.Errorf("repository has %s object format, while backup repository has %s; " +
+				"repositories with different object formats cannot be pulled into one backup", f, objfmt)
+		}
+
+		refv = append(refv, Ref{name: ref, sha1: sha1})
+	}
+
+	// symbolic refs are saved as such only if what they point to is saved as well
+	reftab := StrSet{}
+	for _, ref := range refv {
+		reftab.Add(ref.name)
+	}
+	for i := range refv {
+		target, ok := symreftab[refv[i].name]
+		if ok && strings.HasPrefix(target, "refs/") && reftab.Contains(strings.TrimPrefix(target, "refs/")) {
+			refv[i].symref = target
+		}
 	}
 
 	return refv, nil
 }
 
+// remote_config returns content for config file of bare repository pulled
+// from remote, that has object format objfmt.
+func remote_config(objfmt ObjectFormat) string {
+	if objfmt == ObjectFormatSHA1 {
+		return "[core]\n\trepositoryformatversion = 0\n\tbare = true\n"
+	}
+	return "[core]\n\trepositoryformatversion = 1\n\tbare = true\n" +
+		"[extensions]\n\tobjectformat = " + objfmt.String() + "\n"
+}
+
+// lsremote_head returns content for HEAD file of repo as advertised by it.
+//
+// It is "ref: <symref>\n" if remote HEAD is symbolic reference, and "<sha1>\n" if HEAD
+// is detached. For repositories that do not advertise HEAD, e.g. empty ones,
+// HEAD is assumed to point to refs/heads/master.
+func lsremote_head(ctx context.Context, repo string) (head string, err error) {
+	defer xerr.Contextf(&err, "lsremote %s HEAD", repo)
+
+	gerr, stdout, _ := ggit(ctx, "ls-remote", "--symref", repo, "HEAD")
+	if gerr != nil {
+		return "", gerr
+	}
+
+	//  ref: refs/heads/master	HEAD    (only for symbolic HEAD)
+	//  oid	HEAD
+	head = "ref: refs/heads/master\n"
+	for _, entry := range xstrings.SplitLines(stdout, "\n") {
+		__, name, err := xstrings.HeadTail(entry, "\t")
+		if err != nil || name != "HEAD" {
+			return "", fmt.Errorf("strange output entry: %q", entry)
+		}
+		if strings.HasPrefix(__, "ref: refs/") {
+			return __ + "\n", nil
+		}
+		sha1, err := Sha1Parse(__)
+		if err != nil {
+			return "", fmt.Errorf("strange output entry: %q", entry)
+		}
+		head = sha1.String() + "\n"
+	}
+
+	return head, nil
+}
+
 // -------- git-backup restore --------
 
 func cmd_restore_usage() {
 	fmt.Fprint(os.Stderr,
-`git-backup restore <commit-ish> <prefix1>:<dir1> <prefix2>:<dir2> ...
+`git-backup restore [options] <commit-ish> <prefix1>:<dir1> <prefix2>:<dir2> ...
 
 Restore Git repositories & just files from backup prefix1 into dir1,
 from backup prefix2 into dir2, etc...
 
+':' in prefix or dir has to be escaped as '\:', and '\' as '\\'.
+
 Backup state to restore is taken from <commit-ish>.
+
+File permissions, mtime and extended attributes are restored from metadata
+saved on pull. When restore is run as root, ownership is restored as well: by
+owner and group names, if they exist on this system, or by numeric ids.
+
+options:
+
+    --numeric-owner         restore ownership by saved numeric ids only.
+    --map-uid <from>:<to>   restore files owned by uid <from> as owned by <to>;
+                            can be given several times.
+    --map-gid <from>:<to>   same for gid.
+    --alternates <how>      what to do with objects/info/alternates of restored
+                            repositories: "rewrite" to point to restored pools
+                            (default), or "drop" to make repositories
+                            self-contained.
+    --by-name               select and restore repositories by their names
+                            saved on pull with --repo-names: prefixes are
+                            taken as paths by names, and named repositories
+                            are restored as <dir>/<name>.git.
 `)
 }
 
@@ -856,10 +1294,34 @@ type RestoreSpec struct {
 }
 
 func cmd_restore(ctx context.Context, gb *git.Repository, argv []string) {
+	opts := RestoreOptions{}
+	var uidmapv, gidmapv []string
 	flags := flag.FlagSet{Usage: cmd_restore_usage}
 	flags.Init("", flag.ExitOnError)
+	flags.BoolVar(&opts.numericOwner, "numeric-owner", false, "restore ownership by numeric ids only")
+	flags.Var((*StrList)(&uidmapv), "map-uid", "restore uid <from> as <to>")
+	flags.Var((*StrList)(&gidmapv), "map-gid", "restore gid <from> as <to>")
+	flags.StringVar(&opts.alternates, "alternates", "rewrite", "rewrite|drop alternates of restored repositories")
+	flags.BoolVar(&opts.byName, "by-name", false, "select and restore repositories by names")
 	flags.Parse(argv)
 
+	if opts.alternates != "rewrite" && opts.alternates != "drop" {
+		fmt.Fprintf(os.Stderr, "E: invalid --alternates %q\n", opts.alternates)
+		cmd_restore_usage()
+		os.Exit(1)
+	}
+
+	var err1, err2 error
+	opts.uidmap, err1 = parse_idmap(uidmapv)
+	opts.gidmap, err2 = parse_idmap(gidmapv)
+	for _, err := range []error{err1, err2} {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "E: %s\n", err)
+			cmd_restore_usage()
+			os.Exit(1)
+		}
+	}
+
 	argv = flags.Args()
 	if len(argv) < 2 {
 		cmd_restore_usage()
@@ -870,7 +1332,7 @@ func cmd_restore(ctx context.Context, gb *git.Repository, argv []string) {
 
 	restorespecv := []RestoreSpec{}
 	for _, arg := range argv[1:] {
-		prefix, dir, err := xstrings.Split2(arg, ":")
+		prefix, dir, err := spec_split(arg, false)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "E: invalid restorespec %q\n", arg)
 			cmd_restore_usage()
@@ -880,20 +1342,62 @@ func cmd_restore(ctx context.Context, gb *git.Repository, argv []string) {
 		restorespecv = append(restorespecv, RestoreSpec{prefix, dir})
 	}
 
-	cmd_restore_(ctx, gb, HEAD, restorespecv)
+	cmd_restore_(ctx, gb, HEAD, restorespecv, opts)
 }
 
+// kirr/wendelin.core.git:heads/master -> kirr/wendelin.core.git, heads/master
+// gitea/wiki:heads/master -> gitea/wiki, heads/master
+// tiwariayush/Discussion%20Forum%20.git:... -> tiwariayush/Discussion Forum .git, ...
+//
+// ':' is escaped in repository path and is not allowed in ref names, so it
+// unambiguously delimits them. Backups prepared by older git-backup have '/'
+// instead, and there repository path is taken to end with first .git:
+//
 // kirr/wendelin.core.git/heads/master -> kirr/wendelin.core.git, heads/master
-// tiwariayush/Discussion%20Forum%20.git/... -> tiwariayush/Discussion Forum .git, ...
 func reporef_split(reporef string) (repo, ref string) {
-	dotgit := strings.Index(reporef, ".git/")
-	if dotgit == -1 {
+	return reporef_splitx(reporef, nil)
+}
+
+// reporef_splitx is like reporef_split, but for entries in old format uses
+// hasrepo to tell which .git ends repository path, if there are several, e.g.
+// for nested group/project.git/wiki.git/heads/master. The innermost
+// repository hasrepo reports to be present is taken.
+func reporef_splitx(reporef string, hasrepo func(repo string) bool) (repo, ref string) {
+	if colon := strings.Index(reporef, ":"); colon != -1 {
+		repo, err := path_refunescape(reporef[:colon])
+		exc.Raiseif(err)
+		return repo, reporef[colon+1:]
+	}
+
+	// where repository path could end
+	// NOTE .git of non-bare repository is escaped as %2Egit
+	endv := []int{}
+	for i := 0; i < len(reporef); i++ {
+		switch {
+		case strings.HasPrefix(reporef[i:], ".git/"):
+			endv = append(endv, i+len(".git"))
+		case strings.HasPrefix(reporef[i:], "%2Egit/") && (i == 0 || reporef[i-1] == '/'):
+			endv = append(endv, i+len("%2Egit"))
+		}
+	}
+	if len(endv) == 0 {
 		exc.Raisef("E: %s is not a ref for a git repo", reporef)
 	}
-	repo, ref = reporef[:dotgit+4], reporef[dotgit+4+1:]
-	repo, err := path_refunescape(repo) // unescape repo name we originally escaped when making backup
-	exc.Raiseif(err)
-	return repo, ref
+
+	split := func(end int) (repo, ref string) {
+		repo, err := path_refunescape(reporef[:end]) // unescape repo name we originally escaped when making backup
+		exc.Raiseif(err)
+		return repo, reporef[end+1:]
+	}
+	if hasrepo != nil && len(endv) > 1 {
+		for i := len(endv) - 1; i >= 0; i-- {
+			repo, ref := split(endv[i])
+			if hasrepo(repo) {
+				return repo, ref
+			}
+		}
+	}
+	return split(endv[0])
 }
 
 // sha1 value(s) for a ref in 'backup.refs'
@@ -901,6 +1405,8 @@ type BackupRefSha1 struct {
 	sha1  Sha1 // original sha1 this ref was pointing to in original repo
 	sha1_ Sha1 // sha1 actually used to represent sha1's object in backup repo
 	           // (for tag/tree/blob - they are converted to commits)
+
+	symref string // for symbolic refs: full name of ref it points to; sha1 and sha1_ are null
 }
 
 // BackupRef represents 1 reference entry in 'backup.refs'   (repo prefix stripped)
@@ -938,6 +1444,9 @@ func (br ByRefname) Less(i, j int) bool { return strings.Compare(br[i].name, br[
 func (m RefMap) Sha1Heads() []Sha1 {
 	hs := Sha1Set{}
 	for _, refsha1 := range m {
+		if refsha1.symref != "" {
+			continue
+		}
 		hs.Add(refsha1.sha1)
 	}
 	headv := hs.Elements()
@@ -968,6 +1477,12 @@ func (br ByRepoPath) Search(prefix string) int {
 	})
 }
 
+// Contains returns whether there is repository with repopath.
+func (br ByRepoPath) Contains(repopath string) bool {
+	i := br.Search(repopath)
+	return i < len(br) && br[i].repopath == repopath
+}
+
 // request to extract a pack
 type PackExtractReq struct {
 	refs     RefMap // extract pack with objects from this heads
@@ -977,11 +1492,11 @@ type PackExtractReq struct {
 	prefix string
 }
 
-func cmd_restore_(ctx context.Context, gb *git.Repository, HEAD_ string, restorespecv []RestoreSpec) {
+func cmd_restore_(ctx context.Context, gb *git.Repository, HEAD_ string, restorespecv []RestoreSpec, opts RestoreOptions) {
 	HEAD := xgitSha1(ctx, "rev-parse", "--verify", HEAD_)
 
 	// read backup refs index
-	repotab, err := loadBackupRefs(ctx, fmt.Sprintf("%s:backup.refs", HEAD))
+	repotab, err := loadBackupRefs(ctx, HEAD)
 	exc.Raiseif(err)
 
 	// flattened & sorted repotab
@@ -995,7 +1510,22 @@ func cmd_restore_(ctx context.Context, gb *git.Repository, HEAD_ string, restore
 	// repotab no longer needed
 	repotab = nil
 
+	// objects of LFS stores
+	lfstab := lfs_loadstores(ctx, HEAD)
+
+	// with --by-name prefixes and restored paths are by names of repositories
+	var names *NameView
+	if opts.byName {
+		names, err = loadNameView(ctx, HEAD)
+		exc.Raiseif(err)
+	}
+
 	packxq := make(chan PackExtractReq, 2*njobs) // requests to extract packs
+	worktreev := []string{}                      // restored worktrees of non-bare repositories
+	repopathv := []string{}                      // restored repositories
+	repoheadtab := map[string][]Sha1{}           // restored repository -> heads of its restored refs
+	restoredtab := map[string]string{}           // repopath in backup -> restored repository
+	alternatesv := []RestoredAlternates{}        // alternates of restored repositories
 	wg := xsync.NewWorkGroup(ctx)
 
 	// main worker: walk over specified prefixes restoring files and
@@ -1016,8 +1546,14 @@ func cmd_restore_(ctx context.Context, gb *git.Repository, HEAD_ string, restore
 			exc.Raiseif(err)
 
 			// files
-			lstree := xgit(ctx, "ls-tree", "--full-tree", "-r", "-z", "--", HEAD, prefix, RunWith{raw: true})
-			repos_seen := StrSet{} // dirs of *.git seen while restoring files
+			lsargv := []interface{}{"ls-tree", "--full-tree", "-r", "-z", "--", HEAD}
+			for _, pathspec := range names.pathspecv(prefix) {
+				lsargv = append(lsargv, pathspec)
+			}
+			lstree := xgit(ctx, append(lsargv, RunWith{raw: true})...)
+			repos_seen := StrSet{} // dirs of repositories seen while restoring files
+			heads_seen := StrSet{} // dirs with HEAD seen while restoring files
+			chunked := ""          // chunks of this file are being skipped
 			for _, __ := range xstrings.SplitLines(lstree, "\x00") {
 				mode, type_, sha1, filename, err := parse_lstree_entry(__)
 				// NOTE
@@ -1030,6 +1566,32 @@ func cmd_restore_(ctx context.Context, gb *git.Repository, HEAD_ string, restore
 
 				exc.Raiseif(ctx.Err())
 
+				// chunked file -> reassemble it from chunks when seeing its
+				// manifest, which goes first, and skip the chunks themselves.
+				if chunked != "" && strings.HasPrefix(filename, chunked+"/") {
+					continue
+				}
+				if is_chunk_manifest(filename) && is_chunk_manifest_blob(gb, sha1) {
+					chunked = pathpkg.Dir(filename)
+					path := names.path(path_dotgitunescape(chunked))
+					if !path_isunder(prefix, path) {
+						continue
+					}
+					tree := xgitSha1(ctx, "rev-parse", fmt.Sprintf("%s:%s", HEAD, chunked))
+					path = reprefix(prefix, dir, path)
+					infof("# file %s\t-> %s\t(chunked)", prefix, path)
+					err := os.MkdirAll(pathpkg.Dir(path), 0777)
+					exc.Raiseif(err)
+					err = chunks_to_file(ctx, gb, tree, path)
+					exc.Raiseif(err)
+					continue
+				}
+
+				filename = path_dotgitunescape(filename)
+				if !path_isunder(prefix, names.path(filename)) {
+					continue // pulled under prefix, but named outside of it
+				}
+
 				// skip *.git/refs/... & co on restore
 				//
 				// pre-2025 git-backup used to save both backup.refs and .git/refs/* as regular files
@@ -1051,31 +1613,74 @@ func cmd_restore_(ctx context.Context, gb *git.Repository, HEAD_ string, restore
 					}
 				}
 
-				filename = reprefix(prefix, dir, filename)
+				// alternates are put in place after all repositories are restored
+				if repo, ok := alternates_repo(filename); ok && ByRepoPath(repov).Contains(repo) {
+					data := xgit(ctx, "cat-file", "blob", sha1, RunWith{raw: true})
+					alternatesv = append(alternatesv, RestoredAlternates{
+						repopath: reprefix(prefix, dir, names.path(repo)),
+						entryv:   xstrings.SplitLines(strings.TrimSuffix(data, "\n"), "\n")})
+					continue
+				}
+
+				backup_filename := filename
+				filename = reprefix(prefix, dir, names.path(filename))
 				infof("# file %s\t-> %s", prefix, filename)
-				blob_to_file(gb, sha1, mode, filename)
+				blob_to_file(ctx, gb, sha1, mode, filename)
 
-				// make sure git will recognize *.git as repo:
+				if isGitlink(filename) && mode&syscall.S_IFMT == syscall.S_IFREG {
+					worktree, err := gitlink_restored(filename)
+					exc.Raiseif(err)
+					if worktree != "" {
+						worktreev = append(worktreev, worktree)
+					}
+				}
+
+				// make sure git will recognize restored repo as repo:
 				//   - it should have refs/{heads,tags}/ and objects/pack/ inside.
 				//
+				// Repositories are those with refs in backup.refs, *.git with HEAD,
+				// and, as empty repositories can be named without .git as well,
+				// directories with both HEAD and config.
+				//
 				// NOTE doing it while restoring files, because a repo could be
 				//   empty - without refs at all, and thus next "git packs restore"
 				//   step will not be run for it.
 				filedir := pathpkg.Dir(filename)
-				if strings.HasSuffix(filename, ".git/HEAD") && !repos_seen.Contains(filedir) {
+				isrepo := false
+				switch pathpkg.Base(filename) {
+				case "HEAD":
+					heads_seen.Add(filedir)
+					backup_dir := pathpkg.Dir(backup_filename)
+					isrepo = strings.HasSuffix(backup_dir, ".git") || ByRepoPath(repov).Contains(backup_dir)
+				case "config":
+					isrepo = heads_seen.Contains(filedir)
+				}
+				if isrepo && !repos_seen.Contains(filedir) {
 					infof("# repo %s\t-> %s", prefix, filedir)
 					for _, __ := range []string{"refs/heads", "refs/tags", "objects/pack"} {
 						err := os.MkdirAll(filedir+"/"+__, 0777)
 						exc.Raiseif(err)
 					}
 					repos_seen.Add(filedir)
+
+					if pathpkg.Base(filedir) == ".git" {
+						worktreev = append(worktreev, pathpkg.Dir(filedir))
+					}
 				}
 			}
 
 			// git packs
-			for i := ByRepoPath(repov).Search(prefix); i < len(repov); i++ {
+			// (with names view repositories are not sorted by paths by names)
+			i0 := ByRepoPath(repov).Search(prefix)
+			if names != nil {
+				i0 = 0
+			}
+			for i := i0; i < len(repov); i++ {
 				repo := repov[i]
-				if !strings.HasPrefix(repo.repopath, prefix) {
+				if !strings.HasPrefix(names.path(repo.repopath), prefix) {
+					if names != nil {
+						continue
+					}
 					break // repov is sorted - end of repositories with prefix
 				}
 
@@ -1089,9 +1694,14 @@ func cmd_restore_(ctx context.Context, gb *git.Repository, HEAD_ string, restore
 					}
 				}
 
+				repopath := reprefix(prefix, dir, names.path(repo.repopath))
+				repopathv = append(repopathv, repopath)
+				repoheadtab[repopath] = repo.refs.Sha1Heads()
+				restoredtab[repo.repopath] = repopath
+
 				select {
 				case packxq <- PackExtractReq{refs: repo.refs,
-					repopath: reprefix(prefix, dir, repo.repopath),
+					repopath: repopath,
 					prefix:   prefix}:
 
 				case <-ctx.Done():
@@ -1123,6 +1733,12 @@ func cmd_restore_(ctx context.Context, gb *git.Repository, HEAD_ string, restore
 					}
 					infof("# git  %s\t-> %s", p.prefix, p.repopath)
 
+					// make sure objects/pack/ is there even if repository HEAD
+					// file was not restored, e.g. when backup was prepared by
+					// older git-backup.
+					err := os.MkdirAll(p.repopath+"/objects/pack", 0777)
+					exc.Raiseif(err)
+
 					// extract pack for that repo from big backup pack + decoded tags
 					pack_argv := []string{
 						"-c", "pack.threads=1", // occupy only 1 CPU + it packs better
@@ -1137,25 +1753,70 @@ func cmd_restore_(ctx context.Context, gb *git.Repository, HEAD_ string, restore
 					if verbose <= 0 {
 						pack_argv = append(pack_argv, "-q")
 					}
+
+					// partial clone - objects omitted by its filter are
+					// missing in backup as well (see shallow.go)
+					_, partial, err := repo_partial(ctx, p.repopath)
+					exc.Raiseif(err)
+					if partial {
+						pack_argv = append(pack_argv, "--missing=allow-promisor")
+					}
 					pack_argv = append(pack_argv, p.repopath+"/objects/pack/pack")
 
-					xgit2(ctx, pack_argv, RunWith{stdin: p.refs.Sha1HeadsStr(), stderr: gitprogress()})
+					// shallow repository - history behind its shallow commits is not packed
+					// (backup might have it, e.g. pulled from a full clone)
+					pack_stdin := p.refs.Sha1HeadsStr()
+					shallow, err := ioutil.ReadFile(p.repopath + "/shallow")
+					if err != nil && !os.IsNotExist(err) {
+						exc.Raise(err)
+					}
+					for _, commit := range xstrings.SplitLines(string(shallow), "\n") {
+						pack_stdin += "--shallow " + commit + "\n"
+					}
+
+					packname := xgit2(ctx, pack_argv, RunWith{stdin: pack_stdin, stderr: gitprogress()})
+
+					// objects of partial clone are promisor objects
+					if partial {
+						err = ioutil.WriteFile(fmt.Sprintf("%s/objects/pack/pack-%s.promisor", p.repopath, packname), nil, 0666)
+						exc.Raiseif(err)
+					}
 
 					// extract refs for that repo from backup.refs entries
 					repo_refs := p.refs.Values()
 					sort.Sort(ByRefname(repo_refs))
 					repo_ref_createv := make([]string, 0, len(repo_refs))
+					repo_symrefv := []BackupRef{}
 					for _, ref := range repo_refs {
+						if isPseudoRef(ref.name) {
+							continue // e.g. detached HEAD - restored as file
+						}
+						if ref.symref != "" {
+							repo_symrefv = append(repo_symrefv, ref)
+							continue
+						}
 						repo_ref_createv = append(repo_ref_createv, fmt.Sprintf("create refs/%s\x00%s", ref.name, ref.sha1))
 					}
 					repo_ref_create := strings.Join(repo_ref_createv, "\x00")
 					xgit(ctx, "--git-dir="+p.repopath, "update-ref", "--no-deref", "--stdin", "-z", RunWith{stdin: repo_ref_create})
 
+					// symbolic refs - after refs they point to are there
+					for _, ref := range repo_symrefv {
+						xgit(ctx, "--git-dir="+p.repopath, "symbolic-ref", "refs/"+ref.name, ref.symref)
+					}
+
 					// verify that extracted repo refs match backup.refs index after extraction
-					x_ref_list := xgit(ctx, "--git-dir="+p.repopath,
-						"for-each-ref", "--format=%(objectname) %(refname)")
+					x_ref_list := xgit(ctx, "--git-dir="+p.repopath, "for-each-ref",
+						"--format=%(if)%(symref)%(then)ref:%(symref)%(else)%(objectname)%(end) %(refname)")
 					repo_ref_listv := make([]string, 0, len(repo_refs))
 					for _, ref := range repo_refs {
+						if isPseudoRef(ref.name) {
+							continue
+						}
+						if ref.symref != "" {
+							repo_ref_listv = append(repo_ref_listv, fmt.Sprintf("ref:%s refs/%s", ref.symref, ref.name))
+							continue
+						}
 						repo_ref_listv = append(repo_ref_listv, fmt.Sprintf("%s refs/%s", ref.sha1, ref.name))
 					}
 					repo_ref_list := strings.Join(repo_ref_listv, "\n")
@@ -1172,8 +1833,12 @@ func cmd_restore_(ctx context.Context, gb *git.Repository, HEAD_ string, restore
 					//
 					// Compared to fsck we do not re-compute sha1 sum of objects which
 					// is significantly faster.
+					missing := "--missing=error"
+					if partial {
+						missing = "--missing=allow-promisor"
+					}
 					gerr, _, _ := ggit(ctx, "--git-dir="+p.repopath,
-						"rev-list", "--objects", "--stdin", "--quiet", RunWith{stdin: p.refs.Sha1HeadsStr()})
+						"rev-list", "--objects", missing, "--stdin", "--quiet", RunWith{stdin: p.refs.Sha1HeadsStr()})
 					if gerr != nil {
 						fmt.Fprintln(os.Stderr, "E: Problem while checking connectivity of extracted repo:")
 						exc.Raise(gerr)
@@ -1195,12 +1860,52 @@ func cmd_restore_(ctx context.Context, gb *git.Repository, HEAD_ string, restore
 	// wait for workers to finish & collect/reraise first error, if any
 	err = wg.Wait()
 	exc.Raiseif(err)
+
+	// all repositories are restored - put LFS objects they need in place
+	// NOTE not in pack workers, as gb cannot be used from several threads simultaneously
+	if len(lfstab) != 0 {
+		lfsdirs := StrSet{}
+		for _, __ := range restorespecv {
+			for lfsdir := range lfs_dirs(ctx, HEAD, __.prefix, __.dir, names) {
+				lfsdirs.Add(lfsdir)
+			}
+		}
+		for _, repopath := range repopathv {
+			if !lfsdirs.Contains(repopath + "/lfs") {
+				continue // repository did not use LFS
+			}
+			lfs_restore(ctx, gb, repopath, repoheadtab[repopath], lfstab)
+		}
+	}
+
+	// point repositories to restored pools they borrow objects from
+	if opts.alternates == "rewrite" {
+		for _, a := range alternatesv {
+			err := alternates_restore(ctx, a, restoredtab)
+			exc.Raiseif(err)
+		}
+	}
+
+	// bring checkouts of non-bare repositories in order
+	for _, worktree := range worktreev {
+		infof("# worktree %s", worktree)
+		err := worktree_refresh(ctx, worktree)
+		exc.Raiseif(err)
+	}
+
+	// everything is in place - restore metadata
+	// (do it last, because restoring files changes mtime of directories)
+	for _, __ := range restorespecv {
+		infof("# metadata %s\t-> %s", __.prefix, __.dir)
+		metas_restore(ctx, HEAD, __.prefix, __.dir, names, &opts)
+	}
 }
 
-// loadBackupRefs loads 'backup.ref' content from a git object.
+// loadBackupRefs loads 'backup.refs' content from backup state HEAD.
 //
 // an example of object is e.g. "HEAD:backup.ref".
-func loadBackupRefs(ctx context.Context, object string) (repotab map[string]*BackupRepo, err error) {
+func loadBackupRefs(ctx context.Context, HEAD Sha1) (repotab map[string]*BackupRepo, err error) {
+	object := fmt.Sprintf("%s:backup.refs", HEAD)
 	defer xerr.Contextf(&err, "load backup.refs %q", object)
 
 	gerr, backup_refs, _ := ggit(ctx, "cat-file", "blob", object)
@@ -1208,24 +1913,44 @@ func loadBackupRefs(ctx context.Context, object string) (repotab map[string]*Bac
 		return nil, gerr
 	}
 
+	// hasrepo tells whether there is repository at repopath in backup tree.
+	// It is used to resolve ambiguity of nested repositories in backup.refs
+	// prepared by older git-backup.
+	hasrepo, err := backup_hasrepo(ctx, HEAD, xstrings.SplitLines(backup_refs, "\n"))
+	if err != nil {
+		return nil, err
+	}
+
 	repotab = make(map[string]*BackupRepo)
 	for _, refentry := range xstrings.SplitLines(backup_refs, "\n") {
 		// sha1 prefix+refname (sha1_)
+		// ref:target prefix+refname
 		badentry := func() error { return fmt.Errorf("invalid entry: %q", refentry) }
 		refentryv := strings.Fields(refentry)
 		if !(2 <= len(refentryv) && len(refentryv) <= 3) {
 			return nil, badentry()
 		}
-		sha1, err := Sha1Parse(refentryv[0])
-		sha1_, err_ := sha1, err
-		if len(refentryv) == 3 {
-			sha1_, err_ = Sha1Parse(refentryv[2])
-		}
-		if err != nil || err_ != nil {
-			return nil, badentry()
+		var refsha1 BackupRefSha1
+		if strings.HasPrefix(refentryv[0], "ref:") {
+			refsha1.symref = strings.TrimPrefix(refentryv[0], "ref:")
+			if len(refentryv) != 2 || !strings.HasPrefix(refsha1.symref, "refs/") {
+				return nil, badentry()
+			}
+		} else {
+			sha1, err := Sha1Parse(refentryv[0])
+			sha1_, err_ := sha1, err
+			if len(refentryv) == 3 {
+				sha1_, err_ = Sha1Parse(refentryv[2])
+			}
+			if err != nil || err_ != nil {
+				return nil, badentry()
+			}
+			refsha1.sha1, refsha1.sha1_ = sha1, sha1_
 		}
 		reporef := refentryv[1]
-		repopath, ref := reporef_split(reporef)
+		repopath, ref := reporef_splitx(reporef, func(repopath string) bool {
+			return hasrepo.Contains(repopath)
+		})
 
 		repo := repotab[repopath]
 		if repo == nil {
@@ -1236,15 +1961,65 @@ func loadBackupRefs(ctx context.Context, object string) (repotab map[string]*Bac
 		if _, alreadyin := repo.refs[ref]; alreadyin {
 			return nil, fmt.Errorf("duplicate ref %q", ref)
 		}
-		repo.refs[ref] = BackupRefSha1{sha1, sha1_}
+		repo.refs[ref] = refsha1
 	}
 
 	return repotab, nil
 }
 
+// backup_hasrepo returns which repositories, that entries of old-format
+// backup.refs could be attributed to, are present in backup state HEAD.
+//
+// All candidates are checked with only one `git cat-file --batch-check` run.
+func backup_hasrepo(ctx context.Context, HEAD Sha1, refentryv []string) (hasrepo StrSet, err error) {
+	defer xerr.Context(&err, "find nested repositories")
+
+	hasrepo = StrSet{}
+	candidatev := []string{}
+	seen := StrSet{}
+	for _, refentry := range refentryv {
+		fieldv := strings.Fields(refentry)
+		if len(fieldv) < 2 {
+			continue // reported by caller
+		}
+		reporef_splitx(fieldv[1], func(repopath string) bool {
+			if !seen.Contains(repopath) {
+				seen.Add(repopath)
+				candidatev = append(candidatev, repopath)
+			}
+			return false
+		})
+	}
+	if len(candidatev) == 0 {
+		return hasrepo, nil
+	}
+
+	query := strings.Builder{}
+	for _, repopath := range candidatev {
+		fmt.Fprintf(&query, "%s:%s/HEAD\n", HEAD, path_dotgitescape(repopath))
+	}
+	// <type> LF, or <object> SP missing LF
+	gerr, stdout, _ := ggit(ctx, "cat-file", "--batch-check=%(objecttype)", RunWith{stdin: query.String()})
+	if gerr != nil {
+		return nil, gerr
+	}
+	linev := xstrings.SplitLines(stdout, "\n")
+	if len(linev) != len(candidatev) {
+		return nil, fmt.Errorf("cat-file --batch-check: strange output")
+	}
+	for i, line := range linev {
+		if !strings.HasSuffix(line, " missing") {
+			hasrepo.Add(candidatev[i])
+		}
+	}
+	return hasrepo, nil
+}
+
 var commands = map[string]func(context.Context, *git.Repository, []string){
 	"pull":    cmd_pull,
 	"restore": cmd_restore,
+	"lock":    cmd_lock,
+	"recover": cmd_recover,
 }
 
 func usage() {
@@ -1253,6 +2028,8 @@ func usage() {
 
     pull        pull git-repositories and files to backup
     restore     restore git-repositories and files from backup
+    lock        show or break backup repository lock
+    recover     recover from interrupted pull
 
   common options:
 
@@ -1313,8 +2090,9 @@ func main() {
 	}()
 
 	// backup repository
-	gb, err := git.OpenRepository(".")
+	gb, err := backup_open(ctx, ".")
 	exc.Raiseif(err)
+	defer backup_close(gb)
 
 	cmd(ctx, gb, argv[1:])
 }
@@ -1,4 +1,4 @@
-// Copyright (C) 2015-2025  Nexedi SA and Contributors.
+// Copyright (C) 2015-2026  Nexedi SA and Contributors.
 //                          Kirill Smelkov <kirr@nexedi.com>
 //
 // This program is free software: you can Use, Study, Modify and Redistribute
@@ -20,17 +20,21 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"runtime"
 	"strings"
 	"syscall"
 	"testing"
+	"time"
 
 	"lab.nexedi.com/kirr/go123/exc"
 	"lab.nexedi.com/kirr/go123/my"
@@ -106,6 +110,74 @@ func xprepareTestdata(t *testing.T, testdataDir string) {
 }
 
 
+// xworkdir creates temporary working directory for a test and chdirs into it.
+//
+// git-backup is made quiet for the test. When the test completes, current
+// directory and verbosity are restored, and the workdir is removed.
+func xworkdir(t *testing.T) string {
+	workdir, err := ioutil.TempDir("", "t-git-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(workdir)
+	})
+
+	mydir := xgetcwd(t)
+	xchdir(t, workdir)
+	verbose0 := verbose
+	t.Cleanup(func() {
+		verbose = verbose0
+		xchdir(t, mydir)
+	})
+	verbose = 0
+
+	return workdir
+}
+
+// xbackupInit initializes bare backup repository at path, chdirs into it and opens it.
+//
+// argv are additional arguments to `git init`, e.g. "--object-format=sha256".
+func xbackupInit(ctx context.Context, t *testing.T, path string, argv ...interface{}) *git.Repository {
+	argv = append([]interface{}{"init", "-q", "--bare"}, argv...)
+	xgit(ctx, append(argv, path)...)
+	xchdir(t, path)
+	gb, err := backup_open(ctx, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backup_close(gb) })
+	return gb
+}
+
+// xrgit returns function to run git on repository r with committer identity set.
+func xrgit(ctx context.Context, r string) func(argv ...interface{}) string {
+	return func(argv ...interface{}) string {
+		return xgit(ctx, append([]interface{}{"--git-dir=" + r, "-c", "user.name=a", "-c", "user.email=a@b"}, argv...)...)
+	}
+}
+
+// xcommit makes commit with file f=data on top of parentv in repository r,
+// and points its master branch to it.
+//
+// Empty parents are ignored, so that xcommit(ctx, r, data, master) starts
+// new history when there is no master yet.
+func xcommit(ctx context.Context, r, data string, parentv ...string) string {
+	rgit := xrgit(ctx, r)
+	blob := rgit("hash-object", "-w", "--stdin", RunWith{stdin: data})
+	tree := rgit("mktree", RunWith{stdin: "100644 blob " + blob + "\tf\n"})
+	argv := []interface{}{"commit-tree", tree, "-m", data}
+	for _, p := range parentv {
+		if p != "" {
+			argv = append(argv, "-p", p)
+		}
+	}
+	commit := rgit(argv...)
+	rgit("update-ref", "refs/heads/master", commit)
+	return commit
+}
+
+
 // verify end-to-end pull-restore
 func TestPullRestore(t *testing.T) {
 	ctx := context.Background()
@@ -315,6 +387,15 @@ func TestPullRestore(t *testing.T) {
 	}
 
 
+	// pull another prefix - refs of b1 repositories must be preserved
+	cmd_pull(ctx, gb, []string{my0 + ":b0"})
+	afterPull()
+	h4 := xgitSha1(ctx, "rev-parse", "HEAD")
+	δ34 := xgit(ctx, "diff", h3, h4)
+	if δ34 != "" {
+		t.Fatalf("pull b0: refs of b1 not preserved: δ:\n%s", δ34)
+	}
+
 	// restore backup
 	work1 := workdir + "/1"
 	cmd_restore(ctx, gb, []string{"HEAD", "b1:" + work1})
@@ -391,6 +472,11 @@ func TestPullRestore(t *testing.T) {
 
 			// git-backup should not leave backup repo locked on error
 			xnoref("backup.locked")
+
+			// nor leftovers, that would make next pull refuse to run
+			if l, err := leftovers_find(ctx, "."); l != nil || err != nil {
+				t.Fatalf("pull corrupt.git: leftovers: %v, %v", l, err)
+			}
 		})
 
 		cmd_pull(ctx, gb, []string{my2 + ":b2"})
@@ -454,6 +540,588 @@ func TestPullRestore(t *testing.T) {
 	cmd_pull(ctx, gb, []string{my3 + ":b3"})
 }
 
+// verify that pull results in the same backup state regardless of how many
+// fetch workers are used and in which order they complete.
+func TestPullJobs(t *testing.T) {
+	ctx := context.Background()
+
+	mydir := xgetcwd(t)
+	workdir := xworkdir(t)
+
+	defer func(njobs0 int) { njobs = njobs0 }(njobs)
+	defer func() { tfetchPostHook = nil }()
+
+	xprepareTestdata(t, mydir+"/testdata")
+	my1 := mydir + "/testdata/1"
+
+	// pull my1 with n fetch workers into backup-<n>.git -> HEAD^{tree}, HEAD^@ without HEAD^1
+	pull := func(n int) (tree Sha1, parents string) {
+		njobs = n
+		gb := xbackupInit(ctx, t, fmt.Sprintf("%s/backup-%d.git", workdir, n))
+		defer xchdir(t, workdir)
+
+		cmd_pull(ctx, gb, []string{my1 + ":b1"})
+		tree = xgitSha1(ctx, "rev-parse", "HEAD^{tree}")
+		parentv := strings.Fields(xgit(ctx, "rev-parse", "HEAD^@"))
+		return tree, strings.Join(parentv[1:], " ") // HEAD^1 is root commit created with current time
+	}
+
+	tree1, parents1 := pull(1)
+
+	// make fetches of repositories with shorter names complete later
+	tfetchPostHook = func(repo string) {
+		time.Sleep(time.Duration(100-len(repo)%100) * time.Millisecond)
+	}
+	tree4, parents4 := pull(4)
+
+	if tree4 != tree1 {
+		t.Errorf("pull -j4: tree differs from pull -j1:\nhave: %s\nwant: %s", tree4, tree1)
+	}
+	if parents4 != parents1 {
+		t.Errorf("pull -j4: parents differ from pull -j1:\nhave: %s\nwant: %s", parents4, parents1)
+	}
+}
+
+// verify pull of Git repositories from URLs.
+func TestPullRemote(t *testing.T) {
+	ctx := context.Background()
+
+	workdir := xworkdir(t)
+
+	// source repositories: one with data and HEAD pointing not to master, one empty
+	src := workdir + "/src"
+	xgit(ctx, "init", "-q", src+"/r1")
+	xgit(ctx, "-C", src+"/r1", "-c", "user.name=a", "-c", "user.email=a@b",
+		"commit", "-q", "--allow-empty", "-m", "hello")
+	xgit(ctx, "-C", src+"/r1", "-c", "user.name=a", "-c", "user.email=a@b",
+		"tag", "-a", "-m", "v1", "v1")
+	xgit(ctx, "-C", src+"/r1", "checkout", "-q", "-b", "dev")
+	xgit(ctx, "init", "-q", "--bare", src+"/r2.git")
+
+	err := ioutil.WriteFile(workdir+"/urls", []byte(
+		"# list of repositories\n"+
+		"file://"+src+"/r1\n"+
+		"\n"+
+		"file://"+src+"/r2.git  empty\n"+
+		"file://"+src+"/r1  r1.git\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gb := xbackupInit(ctx, t, "backup.git")
+
+	cmd_pull(ctx, gb, []string{"git+url:file://" + src + "/r1:x/one.git", "git+url:file://" + src + "/r1:x/wiki",
+		"git+urls:" + workdir + "/urls:y"})
+
+	// restore and verify restored repositories are the same as original ones
+	cmd_restore(ctx, gb, []string{"HEAD", "x:" + workdir + "/x", "y:" + workdir + "/y"})
+
+	refs1 := xgit(ctx, "-C", src+"/r1", "for-each-ref")
+	head1 := xgit(ctx, "-C", src+"/r1", "symbolic-ref", "HEAD")
+	// names are kept as given - with or without .git
+	for _, repo := range []string{"x/one.git", "x/wiki", "y/r1", "y/r1.git"} {
+		refs := xgit(ctx, "--git-dir="+workdir+"/"+repo, "for-each-ref")
+		if refs != refs1 {
+			t.Errorf("%s: refs differ:\nhave: %s\nwant: %s", repo, refs, refs1)
+		}
+		head := xgit(ctx, "--git-dir="+workdir+"/"+repo, "symbolic-ref", "HEAD")
+		if head != head1 {
+			t.Errorf("%s: HEAD differs:\nhave: %s\nwant: %s", repo, head, head1)
+		}
+		xgit(ctx, "--git-dir="+workdir+"/"+repo, "fsck")
+	}
+	refs := xgit(ctx, "--git-dir="+workdir+"/y/empty", "for-each-ref")
+	if refs != "" {
+		t.Errorf("y/empty: refs not empty: %s", refs)
+	}
+
+	// pulling again from git daemon must give the same backup state
+	port := xfreeport(t)
+	daemon := exec.Command("git", "daemon", "--export-all", "--reuseaddr", "--base-path="+src,
+		"--listen=127.0.0.1", fmt.Sprintf("--port=%d", port))
+	err = daemon.Start()
+	if err != nil {
+		t.Skipf("git daemon: %s", err)
+	}
+	defer func() {
+		daemon.Process.Kill()
+		daemon.Wait()
+	}()
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i > 100 {
+			t.Skipf("git daemon did not start: %s", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	tree := xgit(ctx, "rev-parse", "HEAD^{tree}")
+	cmd_pull(ctx, gb, []string{fmt.Sprintf("git+url:git://127.0.0.1:%d/r1:x/one.git", port)})
+	if tree2 := xgit(ctx, "rev-parse", "HEAD^{tree}"); tree2 != tree {
+		t.Errorf("pull via git daemon: backup state changed:\n%s", xgit(ctx, "diff", "HEAD^", "HEAD"))
+	}
+}
+
+// xfreeport returns TCP port on localhost that is currently not used.
+func xfreeport(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestParsePullSpec(t *testing.T) {
+	var tests = []struct {
+		arg  string
+		spec PullSpec
+		ok   bool
+	}{
+		{"/a/b:c", PullSpec{dir: "/a/b", prefix: "c"}, true},
+		{"/a/b", PullSpec{}, false},
+		{"git+url:ssh://host:22/a/b.git:c/b.git",
+			PullSpec{prefix: "c/b.git", remotev: []RemoteRepo{{"ssh://host:22/a/b.git", ""}}}, true},
+		{"git+url:host:a/b.git:c/b.git",
+			PullSpec{prefix: "c/b.git", remotev: []RemoteRepo{{"host:a/b.git", ""}}}, true},
+		{"git+url:https://host/a/wiki:c/wiki", // no .git
+			PullSpec{prefix: "c/wiki", remotev: []RemoteRepo{{"https://host/a/wiki", ""}}}, true},
+		{"git+url:https//host/a/b", PullSpec{}, false},
+		{`/a\:b/c\\:d\:e`, PullSpec{dir: `/a:b/c\`, prefix: "d:e"}, true},
+		{`git+url:/a/b\:c.git:d\:e.git`,
+			PullSpec{prefix: "d:e.git", remotev: []RemoteRepo{{"/a/b:c.git", ""}}}, true},
+		{`/a\:b`, PullSpec{}, false},
+	}
+
+	for _, tt := range tests {
+		spec, err := parse_pullspec(tt.arg)
+		if (err == nil) != tt.ok || !reflect.DeepEqual(spec, tt.spec) {
+			t.Errorf("parse_pullspec(%q) -> %#v, %v  ; want %#v, ok=%v", tt.arg, spec, err, tt.spec, tt.ok)
+		}
+	}
+}
+
+// verify pull/restore of symbolic refs.
+func TestPullRestoreSymref(t *testing.T) {
+	ctx := context.Background()
+
+	workdir := xworkdir(t)
+
+	r := "--git-dir=src/r.git"
+	xgit(ctx, "init", "-q", "--bare", "src/r.git")
+	tree := xgit(ctx, r, "mktree", RunWith{stdin: ""})
+	commit := xgit(ctx, r, "-c", "user.name=a", "-c", "user.email=a@b", "commit-tree", tree, "-m", "x")
+	xgit(ctx, r, "update-ref", "refs/heads/main", commit)
+	xgit(ctx, r, "update-ref", "refs/remotes/origin/main", commit)
+	xgit(ctx, r, "symbolic-ref", "refs/heads/default", "refs/heads/main")
+	xgit(ctx, r, "symbolic-ref", "refs/remotes/origin/HEAD", "refs/remotes/origin/main")
+
+	gb := xbackupInit(ctx, t, "backup.git")
+
+	cmd_pull(ctx, gb, []string{workdir + "/src:b"})
+
+	backup_refs := xgit(ctx, "cat-file", "blob", "HEAD:backup.refs")
+	for _, want := range []string{
+		"ref:refs/heads/main b/r.git:heads/default",
+		"ref:refs/remotes/origin/main b/r.git:remotes/origin/HEAD",
+		commit + " b/r.git:heads/main",
+	} {
+		if !strings.Contains(backup_refs, want+"\n") && !strings.HasSuffix(backup_refs, want) {
+			t.Errorf("backup.refs: no %q:\n%s", want, backup_refs)
+		}
+	}
+
+	cmd_restore(ctx, gb, []string{"HEAD", "b:" + workdir + "/dst"})
+	r = "--git-dir=" + workdir + "/dst/r.git"
+	for ref, target := range map[string]string{
+		"refs/heads/default":       "refs/heads/main",
+		"refs/remotes/origin/HEAD": "refs/remotes/origin/main",
+	} {
+		if have := xgit(ctx, r, "symbolic-ref", ref); have != target {
+			t.Errorf("restore: %s -> %q  ; want %q", ref, have, target)
+		}
+	}
+}
+
+// verify that pull --reflog keeps objects referenced from reflogs.
+func TestPullReflog(t *testing.T) {
+	ctx := context.Background()
+
+	workdir := xworkdir(t)
+
+	rgit := xrgit(ctx, "src/r.git")
+	xgit(ctx, "init", "-q", "--bare", "src/r.git")
+	tree := rgit("mktree", RunWith{stdin: ""})
+	commit1 := rgit("commit-tree", tree, "-m", "1")
+	commit1b := rgit("commit-tree", tree, "-p", commit1, "-m", "1b")
+	commit2 := rgit("commit-tree", tree, "-m", "2")
+	commit3 := rgit("commit-tree", tree, "-p", commit2, "-m", "3")
+	rgit("update-ref", "--create-reflog", "-m", "one", "refs/heads/main", commit1)
+	rgit("update-ref", "-m", "one b", "refs/heads/main", commit1b)
+	rgit("update-ref", "-m", "two", "refs/heads/main", commit2)
+	rgit("update-ref", "-m", "three", "refs/heads/main", commit3)
+
+	gb := xbackupInit(ctx, t, "backup.git")
+
+	// commit1 is referenced only from reflog
+	cmd_pull(ctx, gb, []string{workdir + "/src:b"})
+	if gerr, _, _ := ggit(ctx, "cat-file", "-e", commit1); gerr == nil {
+		t.Fatalf("pull: %s pulled without --reflog", commit1)
+	}
+	cmd_pull(ctx, gb, []string{"--reflog", workdir + "/src:b"})
+	// only reflog tips not reachable from refs and from each other are
+	// anchored: commit1 is reachable from commit1b, and commit2 from main.
+	backup_refs := xgit(ctx, "cat-file", "blob", "HEAD:backup.refs")
+	if want := commit1b + " b/r.git:../reflog/" + commit1b; !strings.Contains(backup_refs, want) {
+		t.Fatalf("backup.refs: no %q:\n%s", want, backup_refs)
+	}
+	if n := strings.Count(backup_refs, "../reflog/"); n != 1 {
+		t.Fatalf("backup.refs: %d reflog entries  ; want 1:\n%s", n, backup_refs)
+	}
+
+	cmd_restore(ctx, gb, []string{"HEAD", "b:" + workdir + "/dst"})
+	r := "--git-dir=" + workdir + "/dst/r.git"
+	if reflog := xgit(ctx, r, "reflog", "show", "--format=%H", "main"); !strings.Contains(reflog, commit1) {
+		t.Errorf("restore: main reflog has no %s:\n%s", commit1, reflog)
+	}
+	xgit(ctx, r, "cat-file", "-e", commit1)
+}
+
+func TestSha1Parse(t *testing.T) {
+	for _, tt := range []struct {
+		s      string
+		format ObjectFormat
+		ok     bool
+	}{
+		{"0123456789abcdef0123456789abcdef01234567", ObjectFormatSHA1, true},
+		{"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", ObjectFormatSHA256, true},
+		{"0123456789abcdef0123456789abcdef012345", 0, false},
+		{"0123456789abcdef0123456789abcdef0123456x", 0, false},
+	} {
+		sha1, err := Sha1Parse(tt.s)
+		if (err == nil) != tt.ok {
+			t.Errorf("parse %q -> %v  ; want ok=%v", tt.s, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if sha1.Format() != tt.format || sha1.String() != tt.s {
+			t.Errorf("parse %q -> %s %s  ; want %s", tt.s, sha1.Format(), sha1, tt.format)
+		}
+	}
+
+	null, err := Sha1Parse(strings.Repeat("0", 40))
+	if err != nil || null != (Sha1{}) || !null.IsNull() {
+		t.Errorf("parse null sha1 -> %s, %v  ; want Sha1{}", null, err)
+	}
+}
+
+// verify pull/restore of SHA256 repositories into SHA256 backup, and that pull
+// refuses repositories with object format different from backup.
+func TestPullObjectFormat(t *testing.T) {
+	ctx := context.Background()
+
+	workdir := xworkdir(t)
+
+	gerr, _, _ := ggit(ctx, "init", "-q", "--bare", "--object-format=sha256", "src/r.git")
+	if gerr != nil {
+		t.Skipf("git without sha256 support: %s", gerr)
+	}
+	if f, err := repo_objectformat(ctx, "src/r.git"); err != nil || f != ObjectFormatSHA256 {
+		t.Fatalf("repo_objectformat: %s, %v  ; want sha256", f, err)
+	}
+	r := xrgit(ctx, "src/r.git")
+	blob := r("hash-object", "-w", "--stdin", RunWith{stdin: "hello"})
+	tree := r("mktree", RunWith{stdin: "100644 blob " + blob + "\thello\n"})
+	commit := r("commit-tree", tree, "-m", "c1")
+	r("update-ref", "refs/heads/master", commit)
+	r("update-ref", "refs/tags/blob", blob)
+	r("tag", "-a", "-m", "v1", "v1", commit)
+	r("tag", "-a", "-m", "v1 again", "v1again", "v1")
+	err := ioutil.WriteFile("src/file", []byte("data"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sha256 repository cannot be pulled into sha1 backup
+	gb := xbackupInit(ctx, t, "backup1.git")
+	func() {
+		defer exc.Catch(func(e *exc.Error) {
+			if !strings.Contains(e.Error(), "repository has sha256 object format, while backup repository has sha1") {
+				t.Fatalf("pull sha256 repository into sha1 backup: wrong error: %s", e)
+			}
+		})
+		cmd_pull(ctx, gb, []string{workdir + "/src:b"})
+		t.Fatal("pull sha256 repository into sha1 backup: did not complain")
+	}()
+	xchdir(t, workdir)
+
+	// sha256 backup works with sha256 repositories
+	gb = xbackupInit(ctx, t, "backup.git", "--object-format=sha256")
+	cmd_pull(ctx, gb, []string{workdir + "/src:b"})
+	cmd_pull(ctx, gb, []string{workdir + "/src:b"}) // 2nd pull over existing backup
+	if h := xgit(ctx, "rev-parse", "HEAD"); len(h) != 2*SHA256_RAWSIZE {
+		t.Fatalf("backup HEAD is not sha256: %s", h)
+	}
+	xgit(ctx, "fsck", "--no-progress")
+
+	cmd_restore(ctx, gb, []string{"HEAD", "b:" + workdir + "/dst"})
+	xchdir(t, workdir)
+
+	if f, err := repo_objectformat(ctx, "dst/r.git"); err != nil || f != ObjectFormatSHA256 {
+		t.Fatalf("restored repository: object format %s, %v  ; want sha256", f, err)
+	}
+	refs := xgit(ctx, "--git-dir=src/r.git", "show-ref", "--head")
+	refs2 := xgit(ctx, "--git-dir=dst/r.git", "show-ref", "--head")
+	if refs2 != refs {
+		t.Fatalf("restored refs differ:\n- want:\n%s\n- have:\n%s", refs, refs2)
+	}
+	xgit(ctx, "--git-dir=dst/r.git", "fsck", "--no-progress")
+	data, err := ioutil.ReadFile("dst/file")
+	if err != nil || string(data) != "data" {
+		t.Fatalf("restored file: %q, %v", data, err)
+	}
+
+	// objects of sha256 backup are read and written via long-lived git
+	// processes; they keep serving after failed request, and leave nothing
+	// behind when stopped.
+	missing, err := HashObject(ObjectFormatSHA256, strings.NewReader("missing"), 7, git.ObjectBlob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadObject2(gb, missing); err == nil {
+		t.Fatalf("read missing object %s: no error", missing)
+	}
+	written, err := WriteObject(gb, []byte("blob"), git.ObjectBlob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj, err := ReadObject(gb, written, git.ObjectBlob); err != nil || string(obj.Data()) != "blob" {
+		t.Fatalf("read written blob: %v, %v", obj, err)
+	}
+	backup_close(gb)
+	if tmpv, _ := filepath.Glob("backup.git/objects/tmp_obj_backup_*"); len(tmpv) != 0 {
+		t.Fatalf("left after close: %v", tmpv)
+	}
+}
+
+// verify pull/restore of non-bare repository with linked worktrees.
+func TestPullWorktree(t *testing.T) {
+	ctx := context.Background()
+
+	workdir := xworkdir(t)
+
+	// src/project - checkout of branch dev with uncommitted changes
+	// src/wt      - linked worktree with detached HEAD not reachable from any ref
+	src := workdir + "/src"
+	project := src + "/project"
+	xgit(ctx, "init", "-q", project)
+	gitc := func(dir string, argv ...interface{}) string {
+		return xgit(ctx, append([]interface{}{"-C", dir, "-c", "user.name=a", "-c", "user.email=a@b"}, argv...)...)
+	}
+	xwrite := func(path, data string) {
+		err := ioutil.WriteFile(path, []byte(data), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	xwrite(project+"/hello.txt", "hello\n")
+	gitc(project, "add", "hello.txt")
+	gitc(project, "commit", "-q", "-m", "hello")
+	gitc(project, "checkout", "-q", "-b", "dev")
+	xwrite(project+"/hello.txt", "hello world\n")
+	xwrite(project+"/new.txt", "new\n")
+
+	wt := src + "/wt"
+	gitc(project, "worktree", "add", "-q", "--detach", wt)
+	xwrite(wt+"/detached.txt", "detached\n")
+	gitc(wt, "add", "detached.txt")
+	gitc(wt, "commit", "-q", "-m", "detached")
+
+	gb := xbackupInit(ctx, t, "backup.git")
+
+	cmd_pull(ctx, gb, []string{src + ":b"})
+
+	// restored checkouts must be on the same branch/commit with the same status
+	dst := workdir + "/dst"
+	cmd_restore(ctx, gb, []string{"HEAD", "b:" + dst})
+
+	for _, tt := range []struct{ src, dst string }{
+		{project, dst + "/project"},
+		{wt, dst + "/wt"},
+	} {
+		for _, argv := range [][]interface{}{
+			{"rev-parse", "HEAD"},
+			{"rev-parse", "--symbolic-full-name", "HEAD"},
+			{"status", "--porcelain"},
+			{"worktree", "list", "--porcelain"},
+		} {
+			want := strings.ReplaceAll(gitc(tt.src, argv...), src, dst)
+			have := gitc(tt.dst, argv...)
+			if have != want {
+				t.Errorf("%s: git %v:\nhave: %s\nwant: %s", tt.dst, argv, have, want)
+			}
+		}
+	}
+	gitc(dst+"/project", "fsck")
+}
+
+// verify pull/restore of bare repositories named without .git suffix.
+func TestPullRestoreNoDotGit(t *testing.T) {
+	ctx := context.Background()
+
+	workdir := xworkdir(t)
+
+	// src/project - bare repository with a commit; src/empty - empty bare repository
+	src := workdir + "/src"
+	project := src + "/project"
+	xgit(ctx, "init", "-q", "--bare", project)
+	xgit(ctx, "init", "-q", "--bare", src+"/empty")
+	rgit := xrgit(ctx, project)
+	tree := rgit("mktree", RunWith{stdin: ""})
+	commit := rgit("commit-tree", tree, "-m", "hello")
+	rgit("update-ref", "refs/heads/master", commit)
+	rgit("gc", "-q") // objects in pack, refs in packed-refs
+
+	gb := xbackupInit(ctx, t, "backup.git")
+
+	cmd_pull(ctx, gb, []string{src + ":b"})
+
+	backup_refs := xgit(ctx, "cat-file", "blob", "HEAD:backup.refs")
+	if want := commit + " b/project:heads/master"; backup_refs != want {
+		t.Errorf("backup.refs:\nhave: %s\nwant: %s", backup_refs, want)
+	}
+	lstree := xgit(ctx, "ls-tree", "-r", "--name-only", "HEAD", "b")
+	for _, path := range strings.Split(lstree, "\n") {
+		if strings.Contains(path, "/objects/") || strings.HasSuffix(path, "/packed-refs") {
+			t.Errorf("pull: repository internals saved as file: %s", path)
+		}
+	}
+
+	dst := workdir + "/dst"
+	cmd_restore(ctx, gb, []string{"HEAD", "b:" + dst})
+	if head := xgit(ctx, "--git-dir="+dst+"/project", "rev-parse", "HEAD"); head != commit {
+		t.Errorf("restore: project: HEAD = %s  ; want %s", head, commit)
+	}
+	if !isrepo(dst + "/empty") {
+		t.Errorf("restore: empty: not a git repository")
+	}
+}
+
+// verify pull/restore of repositories nested in directories of other
+// repositories, and in directories named *.git.
+func TestPullRestoreNested(t *testing.T) {
+	ctx := context.Background()
+
+	workdir := xworkdir(t)
+
+	src := workdir + "/src"
+	commitv := map[string]string{} // repo -> its master
+	for _, repo := range []string{"group/project.git", "group/project.git/wiki.git", "old.git/a.git"} {
+		r := src + "/" + repo
+		xgit(ctx, "init", "-q", "--bare", r)
+		rgit := xrgit(ctx, r)
+		tree := rgit("mktree", RunWith{stdin: ""})
+		commitv[repo] = rgit("commit-tree", tree, "-m", repo)
+		rgit("update-ref", "refs/heads/master", commitv[repo])
+	}
+
+	gb := xbackupInit(ctx, t, "backup.git")
+
+	cmd_pull(ctx, gb, []string{src + ":b"})
+
+	backup_refs := xgit(ctx, "cat-file", "blob", "HEAD:backup.refs")
+	for repo, commit := range commitv {
+		if want := commit + " b/" + repo + ":heads/master"; !strings.Contains(backup_refs+"\n", want+"\n") {
+			t.Errorf("backup.refs: no %q:\n%s", want, backup_refs)
+		}
+	}
+
+	restore := func(HEAD, dst string) {
+		cmd_restore(ctx, gb, []string{HEAD, "b:" + dst})
+		for repo, commit := range commitv {
+			if head := xgit(ctx, "--git-dir="+dst+"/"+repo, "rev-parse", "HEAD"); head != commit {
+				t.Errorf("restore %s: %s: HEAD = %s  ; want %s", HEAD, repo, head, commit)
+			}
+		}
+	}
+	restore("HEAD", workdir+"/dst")
+
+	// backup.refs prepared by older git-backup: '/' in between repository and ref
+	old_refs := regexp.MustCompile(`(?m)^(\S+ [^:]*):`).ReplaceAllString(backup_refs, "$1/")
+	old_refs_sha1 := xgit(ctx, "hash-object", "-w", "--stdin", RunWith{stdin: old_refs})
+	lstree := strings.Replace(xgit(ctx, "ls-tree", "HEAD"),
+		xgit(ctx, "rev-parse", "HEAD:backup.refs"), old_refs_sha1, 1)
+	tree := xgit(ctx, "mktree", RunWith{stdin: lstree})
+	old := xgit(ctx, "-c", "user.name=a", "-c", "user.email=a@b", "commit-tree", tree, "-p", "HEAD", "-m", "old backup.refs")
+	restore(old, workdir+"/dst-old")
+}
+
+// verify that big files are pulled and restored via streaming.
+func TestPullRestoreStream(t *testing.T) {
+	ctx := context.Background()
+
+	workdir := xworkdir(t)
+
+	defer func(threshold0 int64) { blobStreamThreshold = threshold0 }(blobStreamThreshold)
+	blobStreamThreshold = 1000
+
+	src := workdir + "/src"
+	err := os.Mkdir(src, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := make([]byte, 1<<20)
+	for i := range big {
+		big[i] = byte(i * 7 / 3)
+	}
+	filev := map[string][]byte{
+		"small": []byte("hello"),
+		"big":   big,
+	}
+	for name, data := range filev {
+		err = ioutil.WriteFile(src+"/"+name, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gb := xbackupInit(ctx, t, "backup.git")
+
+	cmd_pull(ctx, gb, []string{src + ":b"})
+
+	for name := range filev {
+		have := xgit(ctx, "rev-parse", "HEAD:b/"+name)
+		want := xgit(ctx, "hash-object", src+"/"+name)
+		if have != want {
+			t.Errorf("pull: %s: blob %s  ; want %s", name, have, want)
+		}
+	}
+
+	// restore from loose objects, and from packed objects, which libgit2 cannot stream
+	for _, kind := range []string{"loose", "packed"} {
+		if kind == "packed" {
+			xgit(ctx, "repack", "-adq")
+		}
+		dst := workdir + "/dst-" + kind
+		cmd_restore(ctx, gb, []string{"HEAD", "b:" + dst})
+		for name, want := range filev {
+			have, err := ioutil.ReadFile(dst + "/" + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(have, want) {
+				t.Errorf("restore from %s objects: %s: content differs", kind, name)
+			}
+		}
+	}
+}
+
 func TestRepoRefSplit(t *testing.T) {
 	var tests = []struct{ reporef, repo, ref string }{
 		{"kirr/wendelin.core.git/heads/master", "kirr/wendelin.core.git", "heads/master"},
@@ -461,6 +1129,17 @@ func TestRepoRefSplit(t *testing.T) {
 		{"tiwariayush/Discussion%20Forum%20.git/...", "tiwariayush/Discussion Forum .git", "..."},
 		{"tiwariayush/Discussion%20Forum+.git/...", "tiwariayush/Discussion Forum+.git", "..."},
 		{"tiwariayush/Discussion%2BForum+.git/...", "tiwariayush/Discussion+Forum+.git", "..."},
+		{"b/project/%2Egit/heads/master", "b/project/.git", "heads/master"},
+		{"%2Egit/../HEAD", ".git", "../HEAD"},
+		{"b/x%2Egit/y.git/heads/master", "b/x.git/y.git", "heads/master"},
+		{"b/p/%2Egit/../worktrees/w/HEAD", "b/p/.git", "../worktrees/w/HEAD"},
+
+		// explicit delimiter
+		{"kirr/wendelin.core.git:heads/master", "kirr/wendelin.core.git", "heads/master"},
+		{"gitea/wiki:heads/master", "gitea/wiki", "heads/master"},
+		{"gitea/my%3Arepo:tags/v1", "gitea/my:repo", "tags/v1"},
+		{"b/x.git/y.git:heads/master", "b/x.git/y.git", "heads/master"},
+		{"b/p/%2Egit:../HEAD", "b/p/.git", "../HEAD"},
 	}
 
 	for _, tt := range tests {
@@ -469,6 +1148,28 @@ func TestRepoRefSplit(t *testing.T) {
 			t.Errorf("reporef_split(%q) -> %q %q  ; want %q %q", tt.reporef, repo, ref, tt.repo, tt.ref)
 		}
 	}
+
+	// nested repositories in old format
+	hasrepo := func(repo string) bool {
+		switch repo {
+		case "g/p.git", "g/p.git/wiki.git", "old.git/a.git":
+			return true
+		}
+		return false
+	}
+	var testx = []struct{ reporef, repo, ref string }{
+		{"g/p.git/heads/master", "g/p.git", "heads/master"},
+		{"g/p.git/wiki.git/heads/master", "g/p.git/wiki.git", "heads/master"},
+		{"g/p.git/heads/x.git/y", "g/p.git", "heads/x.git/y"},
+		{"old.git/a.git/heads/master", "old.git/a.git", "heads/master"},
+		{"old.git/b.git/heads/master", "old.git", "b.git/heads/master"},
+	}
+	for _, tt := range testx {
+		repo, ref := reporef_splitx(tt.reporef, hasrepo)
+		if repo != tt.repo || ref != tt.ref {
+			t.Errorf("reporef_splitx(%q) -> %q %q  ; want %q %q", tt.reporef, repo, ref, tt.repo, tt.ref)
+		}
+	}
 }
 
 
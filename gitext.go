@@ -0,0 +1,179 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+package main
+// Git-backup | Long-lived git processes for external repositories
+//
+// Objects of repositories libgit2 cannot work with, e.g. SHA256 ones, are
+// read and written via git command. Running git for every object would cost a
+// process per pulled or restored file. Instead every external repository has
+// long-lived
+//
+//   git cat-file --batch                               reading objects,
+//   git cat-file --batch-check                         reading object headers,
+//   git hash-object -w --literally -t <type> --stdin-paths   writing objects,
+//
+// started on first use and serving requests one by one. Content of objects to
+// write is put into objects/tmp_obj_backup_* file hash-object is pointed to.
+// backup_close stops the processes.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"lab.nexedi.com/kirr/git-backup/internal/git"
+)
+
+// gitextProc is long-lived `git *argv` process on external repository.
+type gitextProc struct {
+	g    *git.Repository
+	argv []string
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	tmp    *os.File // file with content for hash-object; nil for cat-file
+}
+
+// gitextProcs is registry of started processes: g -> argv -> process.
+var gitextProcs = struct {
+	sync.Mutex
+	tab map[*git.Repository]map[string]*gitextProc
+}{tab: map[*git.Repository]map[string]*gitextProc{}}
+
+// gitext_proc returns long-lived `git *argv` process on external repository g.
+func gitext_proc(g *git.Repository, argv ...string) *gitextProc {
+	gitextProcs.Lock()
+	defer gitextProcs.Unlock()
+
+	key := strings.Join(argv, " ")
+	procs := gitextProcs.tab[g]
+	if procs == nil {
+		procs = map[string]*gitextProc{}
+		gitextProcs.tab[g] = procs
+	}
+	p := procs[key]
+	if p == nil {
+		p = &gitextProc{g: g, argv: argv}
+		procs[key] = p
+	}
+	return p
+}
+
+// backup_close stops git processes started for external repository g.
+func backup_close(g *git.Repository) {
+	gitextProcs.Lock()
+	procs := gitextProcs.tab[g]
+	delete(gitextProcs.tab, g)
+	gitextProcs.Unlock()
+
+	for _, p := range procs {
+		p.mu.Lock()
+		p.stop(false)
+		p.mu.Unlock()
+	}
+}
+
+// do makes request to the process with f, which writes the request to
+// process stdin and reads the reply from its stdout.
+//
+// The process is started, if it was not yet. After an error the process is
+// stopped, so that next request starts with a fresh one.
+func (p *gitextProc) do(f func(tmp *os.File, stdin io.Writer, stdout *bufio.Reader) error) (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	defer func() {
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF // process exited
+			}
+			err = fmt.Errorf("git %s: %s", strings.Join(p.argv, " "), err)
+			p.stop(true)
+		}
+	}()
+
+	if p.cmd == nil {
+		err = p.start()
+		if err != nil {
+			return err
+		}
+	}
+	return f(p.tmp, p.stdin, p.stdout)
+}
+
+// start starts the process. Must be called under p.mu.
+func (p *gitextProc) start() (err error) {
+	if p.argv[0] == "hash-object" {
+		p.tmp, err = ioutil.TempFile(p.g.Path()+"objects", "tmp_obj_backup_")
+		if err != nil {
+			return err
+		}
+	}
+
+	cmd := exec.Command("git", append([]string{"--git-dir=" + p.g.Path()}, p.argv...)...)
+	cmd.Env = append(os.Environ(), "GIT_FLUSH=1") // reply to every request right away
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err == nil {
+		var stdout io.Reader
+		stdout, err = cmd.StdoutPipe()
+		p.stdout = bufio.NewReader(stdout)
+	}
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		p.removeTmp()
+		return err
+	}
+	p.cmd, p.stdin = cmd, stdin
+	return nil
+}
+
+// stop stops the process, if it is running. Must be called under p.mu.
+//
+// With kill the process is killed, instead of being asked to exit: after an
+// error it might be not reading its input, or blocked writing its output.
+func (p *gitextProc) stop(kill bool) {
+	if p.cmd != nil {
+		p.stdin.Close()
+		if kill {
+			p.cmd.Process.Kill()
+		}
+		p.cmd.Wait() // error is of no interest - requests were served or failed already
+		p.cmd, p.stdin, p.stdout = nil, nil, nil
+	}
+	p.removeTmp()
+}
+
+func (p *gitextProc) removeTmp() {
+	if p.tmp != nil {
+		p.tmp.Close()
+		os.Remove(p.tmp.Name())
+		p.tmp = nil
+	}
+}
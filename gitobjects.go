@@ -1,4 +1,4 @@
-// Copyright (C) 2015-2025  Nexedi SA and Contributors.
+// Copyright (C) 2015-2026  Nexedi SA and Contributors.
 //                          Kirill Smelkov <kirr@nexedi.com>
 //
 // This program is free software: you can Use, Study, Modify and Redistribute
@@ -21,11 +21,20 @@ package main
 // Git-backup | Git object: Blob Tree Commit Tag
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha1"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"os"
+	"os/exec"
 	"os/user"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -37,7 +46,21 @@ import (
 )
 
 // read/write raw objects
-func ReadObject(g *git.Repository, sha1 Sha1, objtype git.ObjectType) (*git.OdbObject, error) {
+//
+// Objects of repositories libgit2 cannot work with, e.g. SHA256 ones, are
+// read and written via long-lived git processes - see gitext_proc.
+
+// Object is git object read into memory.
+type Object struct {
+	sha1    Sha1
+	objtype git.ObjectType
+	data    []byte
+}
+
+func (o *Object) Type() git.ObjectType { return o.objtype }
+func (o *Object) Data() []byte         { return o.data }
+
+func ReadObject(g *git.Repository, sha1 Sha1, objtype git.ObjectType) (*Object, error) {
 	obj, err := ReadObject2(g, sha1)
 	if err != nil {
 		return nil, err
@@ -48,19 +71,46 @@ func ReadObject(g *git.Repository, sha1 Sha1, objtype git.ObjectType) (*git.OdbO
 	return obj, nil
 }
 
-func ReadObject2(g *git.Repository, sha1 Sha1) (*git.OdbObject, error) {
+func ReadObject2(g *git.Repository, sha1 Sha1) (*Object, error) {
+	if g.External() {
+		var obj *Object
+		err := gitext_proc(g, "cat-file", "--batch").do(func(_ *os.File, stdin io.Writer, stdout *bufio.Reader) error {
+			// <sha1> SP <type> SP <size> LF <content> LF
+			objtype, size, err := catfile_request(stdin, stdout, sha1)
+			if err != nil {
+				return err
+			}
+			data := make([]byte, size+1)
+			_, err = io.ReadFull(stdout, data)
+			if err != nil {
+				return err
+			}
+			obj = &Object{sha1, objtype, data[:size]}
+			return nil
+		})
+		return obj, err
+	}
+
 	odb, err := g.Odb()
 	if err != nil {
 		return nil, &OdbNotReady{g, err}
 	}
-	obj, err := odb.Read(sha1.AsOid())
+	oid, err := sha1.AsOid()
 	if err != nil {
 		return nil, err
 	}
-	return obj, nil
+	obj, err := odb.Read(oid)
+	if err != nil {
+		return nil, err
+	}
+	return &Object{sha1, obj.Type(), obj.Data()}, nil
 }
 
 func WriteObject(g *git.Repository, content []byte, objtype git.ObjectType) (Sha1, error) {
+	if g.External() {
+		return writeObjectExt(g, bytes.NewReader(content), objtype)
+	}
+
 	odb, err := g.Odb()
 	if err != nil {
 		return Sha1{}, &OdbNotReady{g, err}
@@ -73,6 +123,221 @@ func WriteObject(g *git.Repository, content []byte, objtype git.ObjectType) (Sha
 	return Sha1FromOid(oid), nil
 }
 
+// WriteObjectStream writes object with content of size bytes read from r.
+//
+// Contrary to WriteObject the content is never loaded into memory as a whole.
+func WriteObjectStream(g *git.Repository, r io.Reader, size int64, objtype git.ObjectType) (_ Sha1, err error) {
+	if g.External() {
+		cr := &countingReader{r: io.LimitReader(r, size)}
+		sha1, err := writeObjectExt(g, cr, objtype)
+		if err == nil && cr.n != size {
+			err = io.ErrUnexpectedEOF
+		}
+		return sha1, err
+	}
+
+	odb, err := g.Odb()
+	if err != nil {
+		return Sha1{}, &OdbNotReady{g, err}
+	}
+	w, err := odb.NewWriteStream(size, objtype)
+	if err != nil {
+		return Sha1{}, err
+	}
+	defer w.Free()
+
+	_, err = io.CopyN(w, r, size)
+	if err != nil {
+		return Sha1{}, err
+	}
+	oid, err := w.Close()
+	if err != nil {
+		return Sha1{}, err
+	}
+	return Sha1FromOid(oid), nil
+}
+
+// writeObjectExt writes object with content read from r into external repository g.
+func writeObjectExt(g *git.Repository, r io.Reader, objtype git.ObjectType) (sha1 Sha1, err error) {
+	// --literally: store content as is, the same way libgit2 does
+	p := gitext_proc(g, "hash-object", "-w", "--literally", "-t", gittypestr(objtype), "--no-filters", "--stdin-paths")
+	err = p.do(func(tmp *os.File, stdin io.Writer, stdout *bufio.Reader) error {
+		err := tmp.Truncate(0)
+		if err == nil {
+			_, err = tmp.Seek(0, io.SeekStart)
+		}
+		if err == nil {
+			_, err = io.Copy(tmp, r)
+		}
+		if err == nil {
+			_, err = io.WriteString(stdin, tmp.Name()+"\n")
+		}
+		if err != nil {
+			return err
+		}
+		line, err := stdout.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		sha1, err = Sha1Parse(strings.TrimSuffix(line, "\n"))
+		return err
+	})
+	return sha1, err
+}
+
+// HashObject computes object id in format f of object with content of size
+// bytes read from r.
+//
+// The object is not written anywhere.
+func HashObject(f ObjectFormat, r io.Reader, size int64, objtype git.ObjectType) (Sha1, error) {
+	var h hash.Hash
+	switch f {
+	case ObjectFormatSHA1:
+		h = sha1.New()
+	case ObjectFormatSHA256:
+		h = sha256.New()
+	default:
+		return Sha1{}, fmt.Errorf("hash object: object format %s unknown", f)
+	}
+	fmt.Fprintf(h, "%s %d\x00", gittypestr(objtype), size)
+	_, err := io.CopyN(h, r, size)
+	if err != nil {
+		return Sha1{}, err
+	}
+	return Sha1FromRaw(f, h.Sum(nil)), nil
+}
+
+// ReadObjectHeader returns size and type of an object without reading its content.
+func ReadObjectHeader(g *git.Repository, sha1 Sha1) (size int64, objtype git.ObjectType, err error) {
+	if g.External() {
+		err = gitext_proc(g, "cat-file", "--batch-check").do(func(_ *os.File, stdin io.Writer, stdout *bufio.Reader) error {
+			objtype, size, err = catfile_request(stdin, stdout, sha1)
+			return err
+		})
+		return size, objtype, err
+	}
+
+	odb, err := g.Odb()
+	if err != nil {
+		return 0, git.ObjectInvalid, &OdbNotReady{g, err}
+	}
+	oid, err := sha1.AsOid()
+	if err != nil {
+		return 0, git.ObjectInvalid, err
+	}
+	usize, objtype, err := odb.ReadHeader(oid)
+	if err != nil {
+		return 0, git.ObjectInvalid, err
+	}
+	return int64(usize), objtype, nil
+}
+
+// ReadObjectStream opens object for reading its content without loading it
+// into memory as a whole.
+//
+// libgit2 can stream only loose objects. For objects in packs the content is
+// streamed from `git cat-file` instead.
+func ReadObjectStream(ctx context.Context, g *git.Repository, sha1 Sha1, objtype git.ObjectType) (io.ReadCloser, error) {
+	if !g.External() {
+		odb, err := g.Odb()
+		if err != nil {
+			return nil, &OdbNotReady{g, err}
+		}
+		oid, err := sha1.AsOid()
+		if err != nil {
+			return nil, err
+		}
+		stream, err := odb.NewReadStream(oid)
+		if err == nil {
+			if stream.Type() != objtype {
+				stream.Close()
+				return nil, fmt.Errorf("%s: type is %s; expected %s", sha1, gittypestr(stream.Type()), gittypestr(objtype))
+			}
+			return stream, nil
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, "git", "--git-dir="+g.Path(), "cat-file", gittypestr(objtype), sha1.String())
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return &cmdReadCloser{stdout, cmd}, nil
+}
+
+// gitext runs `git *argv` on external repository g with stdin read from r.
+func gitext(g *git.Repository, r io.Reader, argv ...string) (stdout []byte, err error) {
+	cmd := exec.Command("git", append([]string{"--git-dir=" + g.Path()}, argv...)...)
+	stderr := bytes.Buffer{}
+	cmd.Stdin = r
+	cmd.Stderr = &stderr
+	stdout, err = cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %s: %s", strings.Join(argv, " "), err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return stdout, nil
+}
+
+// catfile_request requests object sha1 from `git cat-file --batch` or
+// `--batch-check` process and reads header of the reply.
+func catfile_request(stdin io.Writer, stdout *bufio.Reader, sha1 Sha1) (objtype git.ObjectType, size int64, err error) {
+	_, err = io.WriteString(stdin, sha1.String()+"\n")
+	if err != nil {
+		return git.ObjectInvalid, 0, err
+	}
+	header, err := stdout.ReadString('\n')
+	if err != nil {
+		return git.ObjectInvalid, 0, err
+	}
+	return parse_batchcheck(sha1, strings.TrimSuffix(header, "\n"))
+}
+
+// parse_batchcheck parses "<sha1> <type> <size>" header `git cat-file --batch` outputs for sha1.
+func parse_batchcheck(sha1 Sha1, header string) (objtype git.ObjectType, size int64, err error) {
+	if header == sha1.String()+" missing" {
+		return git.ObjectInvalid, 0, fmt.Errorf("object %s not found", sha1)
+	}
+	sha1_, type_ := Sha1{}, ""
+	_, err = fmt.Sscanf(header, "%s %s %d\n", &sha1_, &type_, &size)
+	objtype, ok := gittype(type_)
+	if err != nil || sha1_ != sha1 || !ok {
+		return git.ObjectInvalid, 0, fmt.Errorf("cat-file --batch: strange header %q", header)
+	}
+	return objtype, size, nil
+}
+
+// countingReader counts how many bytes were read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// cmdReadCloser reads output of a command and waits for it to finish on Close.
+type cmdReadCloser struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (r *cmdReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	err2 := r.cmd.Wait()
+	if err2 != nil {
+		err = err2
+	}
+	return err
+}
+
 type OdbNotReady struct {
 	g   *git.Repository
 	err error
@@ -83,12 +348,12 @@ func (e *OdbNotReady) Error() string {
 }
 
 type UnexpectedObjType struct {
-	obj      *git.OdbObject
+	obj      *Object
 	wantType git.ObjectType
 }
 
 func (e *UnexpectedObjType) Error() string {
-	return fmt.Sprintf("%s: type is %s  (expected %s)", e.obj.Id(), e.obj.Type(), e.wantType)
+	return fmt.Sprintf("%s: type is %s  (expected %s)", e.obj.sha1, e.obj.Type(), e.wantType)
 }
 
 
@@ -105,7 +370,7 @@ type Tag struct {
 //    (libgit2 drops raw data after parsing object)
 //  - we need to have tag_parse() -- a way to parse object from a buffer
 //    (libgit2 does not provide such functionality at all)
-func xload_tag(g *git.Repository, tag_sha1 Sha1) (tag *Tag, tag_obj *git.OdbObject) {
+func xload_tag(g *git.Repository, tag_sha1 Sha1) (tag *Tag, tag_obj *Object) {
 	tag_obj, err := ReadObject(g, tag_sha1, git.ObjectTag)
 	exc.Raiseif(err)
 
@@ -140,6 +405,28 @@ func tag_parse(tag_raw string) (*Tag, error) {
 	return &t, nil
 }
 
+// commit_parse parses parents and message of raw commit.
+//
+// We parse commits ourselves instead of g.LookupCommit() to be able to work
+// with repositories libgit2 cannot handle.
+func commit_parse(commit_raw string) (parentv []Sha1, msg string, err error) {
+	header, msg, err := xstrings.HeadTail(commit_raw, "\n\n")
+	if err != nil {
+		return nil, "", errors.New("invalid commit: no message")
+	}
+	for _, line := range xstrings.SplitLines(header, "\n") {
+		if !strings.HasPrefix(line, "parent ") {
+			continue
+		}
+		parent, err := Sha1Parse(strings.TrimPrefix(line, "parent "))
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid commit: %s", err)
+		}
+		parentv = append(parentv, parent)
+	}
+	return parentv, msg, nil
+}
+
 // parse lstree entry
 func parse_lstree_entry(lsentry string) (mode uint32, type_ string, sha1 Sha1, filename string, err error) {
 	// <mode> SP <type> SP <object> TAB <file>      # NOTE file can contain spaces
@@ -162,15 +449,125 @@ func (e *InvalidLstreeEntry) Error() string {
 	return fmt.Sprintf("invalid ls-tree entry %q", e.lsentry)
 }
 
-// create empty git tree -> tree sha1
-var tree_empty Sha1
-func mktree_empty(ctx context.Context) Sha1 {
-	if tree_empty.IsNull() {
+// xgittypes returns types of specified objects.
+//
+// The types are retrieved with only one `git cat-file` run.
+// All objects must be present in the repository.
+func xgittypes(ctx context.Context, sha1v []Sha1) map[Sha1]git.ObjectType {
+	typetab := make(map[Sha1]git.ObjectType, len(sha1v))
+	if len(sha1v) == 0 {
+		return typetab
+	}
+
+	stdin := ""
+	for _, sha1 := range sha1v {
+		stdin += sha1.String() + "\n"
+	}
+
+	// <sha1> SP <type> SP <size>
+	batch := xgit(ctx, "cat-file", "--batch-check", RunWith{stdin: stdin})
+	for _, __ := range xstrings.SplitLines(batch, "\n") {
+		sha1, type_, size := Sha1{}, "", 0
+		_, err := fmt.Sscanf(__, "%s %s %d\n", &sha1, &type_, &size)
+		if err != nil {
+			exc.Raisef("cat-file --batch-check: strange entry %q", __)
+		}
+		obj_type, ok := gittype(type_)
+		if !ok {
+			exc.Raisef("cat-file --batch-check: invalid git type in entry %q", __)
+		}
+		typetab[sha1] = obj_type
+	}
+
+	if len(typetab) != len(sha1v) {
+		exc.Raisef("cat-file --batch-check: got %d types for %d objects", len(typetab), len(sha1v))
+	}
+	return typetab
+}
+
+// catfile_batch reads objects listed in query, one per line, from repository
+// at gitdir with only one `git cat-file --batch` run.
+//
+// f is called for every object in query order. All objects must be present in
+// the repository.
+func catfile_batch(ctx context.Context, gitdir, query string, f func(sha1, type_, content string) error) error {
+	// <sha1> SP <type> SP <size> LF <content> LF
+	gerr, stdout, _ := ggit(ctx, "--git-dir="+gitdir, "cat-file", "--batch", RunWith{stdin: query, raw: true})
+	if gerr != nil {
+		return gerr
+	}
+	for len(stdout) > 0 {
+		nl := strings.IndexByte(stdout, '\n')
+		if nl == -1 {
+			return fmt.Errorf("cat-file --batch: strange output")
+		}
+		fieldv := strings.Fields(stdout[:nl])
+		if len(fieldv) != 3 {
+			return fmt.Errorf("cat-file --batch: strange header %q", stdout[:nl])
+		}
+		size, err := strconv.Atoi(fieldv[2])
+		if err != nil || size < 0 || len(stdout) < nl+1+size+1 {
+			return fmt.Errorf("cat-file --batch: strange header %q", stdout[:nl])
+		}
+		content := stdout[nl+1 : nl+1+size]
+		stdout = stdout[nl+1+size+1:]
+
+		err = f(fieldv[0], fieldv[1], content)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// create empty git tree in object format f -> tree sha1
+var tree_emptytab = map[ObjectFormat]Sha1{}
+func mktree_empty(ctx context.Context, f ObjectFormat) Sha1 {
+	tree_empty, ok := tree_emptytab[f]
+	if !ok {
 		tree_empty = xgitSha1(ctx, "mktree", RunWith{stdin: ""})
+		tree_emptytab[f] = tree_empty
 	}
 	return tree_empty
 }
 
+// gformat returns object format of repository g.
+func gformat(g *git.Repository) ObjectFormat {
+	f, err := ObjectFormatParse(g.ObjectFormat())
+	if err != nil {
+		panic(err) // g was opened for format we know
+	}
+	return f
+}
+
+// backup_open opens backup repository at gitdir.
+//
+// Repositories with object format libgit2 does not support are opened as
+// external - see gitext_proc.
+func backup_open(ctx context.Context, gitdir string) (*git.Repository, error) {
+	f, err := repo_objectformat(ctx, gitdir)
+	if err != nil {
+		return nil, err
+	}
+	if f != ObjectFormatSHA1 {
+		return git.OpenRepositoryExternal(gitdir, f.String())
+	}
+	return git.OpenRepository(gitdir)
+}
+
+// repo_objectformat returns object format of repository at gitdir.
+func repo_objectformat(ctx context.Context, gitdir string) (ObjectFormat, error) {
+	// NOTE not `rev-parse --show-object-format` to work with git < 2.29 as well
+	gerr, stdout, _ := ggit(ctx, "--git-dir="+gitdir, "config", "extensions.objectformat")
+	if gerr != nil {
+		if gerr.ExitCode() == 1 { // not set
+			return ObjectFormatSHA1, nil
+		}
+		return 0, gerr
+	}
+	return ObjectFormatParse(stdout)
+}
+
 // commit tree
 //
 // Reason why not use g.CreateCommit():
@@ -190,9 +587,20 @@ var (
 )
 
 func getDefaultIdent(g *git.Repository) AuthorInfo {
-	sig, err := g.DefaultSignature()
-	if err == nil {
-		return AuthorInfo(*sig)
+	if g.External() {
+		// Name <email> SP <timestamp> SP <tz>
+		out, err := gitext(g, nil, "var", "GIT_COMMITTER_IDENT")
+		if i := bytes.LastIndexByte(out, '>'); err == nil && i != -1 {
+			name, email, err := xstrings.HeadTail(mem.String(out[:i]), "<")
+			if err == nil {
+				return AuthorInfo{Name: strings.TrimSpace(name), Email: email, When: time.Now()}
+			}
+		}
+	} else {
+		sig, err := g.DefaultSignature()
+		if err == nil {
+			return AuthorInfo(*sig)
+		}
 	}
 
 	// libgit2 failed for some reason (i.e. user.name config not set). Let's cook ident ourselves
@@ -222,14 +630,6 @@ func getDefaultIdent(g *git.Repository) AuthorInfo {
 	return ident
 }
 
-// mkref creates a git reference.
-//
-// it is an error if the reference already exists.
-func mkref(g *git.Repository, name string, sha1 Sha1) error {
-	_, err := g.References.Create(name, sha1.AsOid(), false, "")
-	return err
-}
-
 // `git commit-tree` -> commit_sha1,   raise on error
 func xcommit_tree2(g *git.Repository, tree Sha1, parents []Sha1, msg string, author AuthorInfo, committer AuthorInfo) Sha1 {
 	ident := getDefaultIdent(g)
@@ -1,5 +1,5 @@
-// Copyright (C) 2025  Nexedi SA and Contributors.
-//                     Kirill Smelkov <kirr@nexedi.com>
+// Copyright (C) 2025-2026  Nexedi SA and Contributors.
+//                          Kirill Smelkov <kirr@nexedi.com>
 //
 // This program is free software: you can Use, Study, Modify and Redistribute
 // it under the terms of the GNU General Public License version 3, or (at your
@@ -50,6 +50,7 @@
 package git
 
 import (
+	"path/filepath"
 	"runtime"
 
 	git2go "github.com/libgit2/git2go/v31"
@@ -78,9 +79,18 @@ type (
 // types that we wrap to provide safety.
 
 // Repository provides safe wrapper over git2go.Repository .
+//
+// Repositories that libgit2 cannot work with, e.g. repositories with SHA256
+// object format, are opened via OpenRepositoryExternal. For such repositories
+// only Path, External and ObjectFormat are available, and their objects have
+// to be accessed via git command.
 type Repository struct {
 	repo       *git2go.Repository
 	References *ReferenceCollection
+
+	// for external repositories
+	path      string
+	objformat string
 }
 
 // ReferenceCollection provides safe wrapper over git2go.ReferenceCollection .
@@ -113,6 +123,16 @@ type OdbObject struct {
 	obj *git2go.OdbObject
 }
 
+// OdbWriteStream provides safe wrapper over git2go.OdbWriteStream .
+type OdbWriteStream struct {
+	stream *git2go.OdbWriteStream
+}
+
+// OdbReadStream provides safe wrapper over git2go.OdbReadStream .
+type OdbReadStream struct {
+	stream *git2go.OdbReadStream
+}
+
 
 // function and methods to navigate object hierarchy from Repository to e.g. OdbObject or Commit.
 
@@ -126,6 +146,30 @@ func OpenRepository(path string) (*Repository, error) {
 	return r, nil
 }
 
+// OpenRepositoryExternal returns handle for repository at path, that is not
+// opened with libgit2, because libgit2 cannot work with repositories of its
+// object format.
+func OpenRepositoryExternal(path, objformat string) (*Repository, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Repository{path: path + "/", objformat: objformat}, nil
+}
+
+// External returns whether r was opened via OpenRepositoryExternal.
+func (r *Repository) External() bool {
+	return r.repo == nil
+}
+
+// ObjectFormat returns name of r's object format, e.g. "sha1" or "sha256".
+func (r *Repository) ObjectFormat() string {
+	if r.External() {
+		return r.objformat
+	}
+	return "sha1" // libgit2 we are built with supports only SHA1
+}
+
 func (rdb *ReferenceCollection) Create(name string, id *Oid, force bool, msg string) (*Reference, error) {
 	ref, err := rdb.r.repo.References.Create(name, id, force, msg)
 	if err != nil {
@@ -166,16 +210,51 @@ func (o *Odb) Read(oid *Oid) (*OdbObject, error) {
 	return &OdbObject{obj}, nil
 }
 
+func (o *Odb) NewWriteStream(size int64, otype ObjectType) (*OdbWriteStream, error) {
+	stream, err := o.odb.NewWriteStream(size, otype)
+	if err != nil {
+		return nil, err
+	}
+	return &OdbWriteStream{stream}, nil
+}
+
+// NewReadStream opens object for streaming read.
+//
+// NOTE not all odb backends support streaming - in particular objects in packs cannot be streamed.
+func (o *Odb) NewReadStream(oid *Oid) (*OdbReadStream, error) {
+	stream, err := o.odb.NewReadStream(oid)
+	if err != nil {
+		return nil, err
+	}
+	return &OdbReadStream{stream}, nil
+}
+
 
 // wrappers over safe methods
 
 func (c *Commit) ParentCount() uint	{ return c.commit.ParentCount() }
 func (o *OdbObject) Type() ObjectType	{ return o.obj.Type() }
 
+func (o *Odb) ReadHeader(oid *Oid) (uint64, ObjectType, error)	{ return o.odb.ReadHeader(oid) }
+
+func (s *OdbReadStream) Size() uint64		{ return s.stream.Size }
+func (s *OdbReadStream) Type() ObjectType	{ return s.stream.Type }
+func (s *OdbWriteStream) Free()			{ s.stream.Free() }
+
+// Close closes the stream and frees associated resources.
+func (s *OdbReadStream) Close() error {
+	err := s.stream.Close()
+	s.stream.Free()
+	return err
+}
+
 
 // wrappers over unsafe, or potentially unsafe methods
 
 func (r *Repository) Path() string {
+	if r.External() {
+		return r.path
+	}
 	path := stringsClone( r.repo.Path() )
 	runtime.KeepAlive(r)
 	return path
@@ -230,6 +309,35 @@ func (o *Odb) Write(data []byte, otype ObjectType) (*Oid, error) {
 }
 
 
+// data is copied by libgit2 into the stream - it is safe to reuse it after Write returns.
+func (s *OdbWriteStream) Write(data []byte) (int, error) {
+	n, err := s.stream.Write(data)
+	runtime.KeepAlive(s)
+	return n, err
+}
+
+// Close finalizes the write and returns id of written object.
+//
+// The stream still has to be freed with Free.
+func (s *OdbWriteStream) Close() (*Oid, error) {
+	err := s.stream.Close()
+	if err != nil {
+		return nil, err
+	}
+	oid := oidClone(&s.stream.Id)
+	runtime.KeepAlive(s)
+	return oid, nil
+}
+
+// data is filled by libgit2 directly; its whole capacity, not only length, is
+// used by git2go, so we limit capacity to length not to overwrite data beyond it.
+func (s *OdbReadStream) Read(data []byte) (int, error) {
+	n, err := s.stream.Read(data[:len(data):len(data)])
+	runtime.KeepAlive(s)
+	return n, err
+}
+
+
 func (o *OdbObject) Id() *Oid {
 	id := oidClone( o.obj.Id() )
 	runtime.KeepAlive(o)
@@ -0,0 +1,281 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+package main
+// Git-backup | Git LFS objects
+//
+// Repositories using Git LFS keep large files out of Git - in
+// <repo>.git/lfs/objects/<xx>/<yy>/<oid> files, where oid is sha256 of file
+// content, and Git trees have only small pointer files referring to them by oid.
+//
+// Pull does not save those objects as just files of every repository.
+// Instead, every LFS object is saved once, after its sha256 is verified, into
+// LFS store of pulled prefix in backup tree
+//
+//   backup.lfs/<prefix>.lfs/<xx>/<yy>/<oid>
+//
+// even if several repositories, e.g. forks, have it. Restore puts into
+// lfs/objects/ of every restored repository only objects, that pointers in
+// the restored repository refer to.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"lab.nexedi.com/kirr/go123/exc"
+	"lab.nexedi.com/kirr/go123/xerr"
+	"lab.nexedi.com/kirr/go123/xstrings"
+
+	"lab.nexedi.com/kirr/git-backup/internal/git"
+)
+
+const (
+	lfsDir = "backup.lfs"
+
+	// pointer files are smaller than this
+	lfsPointerMaxSize = 1024
+	lfsPointerVersion = "version https://git-lfs.github.com/spec/v1\n"
+)
+
+// lfs_path returns path of LFS store for prefix in backup tree.
+func lfs_path(prefix string) string {
+	return fmt.Sprintf("%s/%s.lfs", lfsDir, prefix)
+}
+
+// lfs_objpath returns path of LFS object relative to lfs/objects/ or to LFS store.
+func lfs_objpath(oid string) string {
+	return oid[0:2] + "/" + oid[2:4] + "/" + oid
+}
+
+// isLfsOid returns whether s is LFS object id.
+func isLfsOid(s string) bool {
+	if len(s) != 2*sha256.Size {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !('0' <= s[i] && s[i] <= '9' || 'a' <= s[i] && s[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// lfs_walk calls f for every object in lfs/objects/ directory objdir.
+//
+// Files, that are not laid out as LFS objects, are skipped with a warning.
+func lfs_walk(objdir string, f func(oid, path string) error) error {
+	return filepath.Walk(objdir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil // removed in parallel to us, e.g. by `git lfs prune`
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		oid := pathpkg.Base(path)
+		if !(info.Mode().IsRegular() && isLfsOid(oid) && strip_prefix(objdir, path) == lfs_objpath(oid)) {
+			infof("Warning: Skipping %s: not an LFS object", path)
+			return nil
+		}
+		return f(oid, path)
+	})
+}
+
+// lfs_to_blob converts LFS object file at path to blob verifying that the
+// file content matches its oid.
+//
+// If sc != nil it is consulted and updated as in file_to_blob.
+func lfs_to_blob(g *git.Repository, path, oid string, sc *StatCache) Sha1 {
+	var st syscall.Stat_t
+	err := syscall.Lstat(path, &st)
+	if err != nil {
+		exc.Raise(&os.PathError{Op: "lstat", Path: path, Err: err})
+	}
+
+	if sc != nil {
+		blob_sha1, ok := sc.Lookup(path, &st, false)
+		if ok {
+			return blob_sha1
+		}
+	}
+
+	f, err := os.Open(path)
+	exc.Raiseif(err)
+	defer f.Close()
+
+	h := sha256.New()
+	blob_sha1, err := WriteObjectStream(g, io.TeeReader(f, h), st.Size, git.ObjectBlob)
+	exc.Raiseif(err)
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != oid {
+		exc.Raisef("%s: LFS object corrupt: sha256 is %s", path, sum)
+	}
+
+	if sc != nil {
+		sc.Update(path, &st, blob_sha1, false)
+	}
+	return blob_sha1
+}
+
+// lfs_loadstores loads what LFS stores in backup state HEAD have.
+//
+// It returns oid -> blob for all objects in all stores.
+func lfs_loadstores(ctx context.Context, HEAD Sha1) map[string]Sha1 {
+	lfstab := map[string]Sha1{}
+	lstree := xgit(ctx, "ls-tree", "--full-tree", "-r", "-z", "--", HEAD, lfsDir, RunWith{raw: true})
+	for _, __ := range xstrings.SplitLines(lstree, "\x00") {
+		_, _, sha1, path, err := parse_lstree_entry(__)
+		exc.Raiseif(err)
+		lfstab[pathpkg.Base(path)] = sha1
+	}
+	return lfstab
+}
+
+// lfs_dirs returns restored paths of lfs/ directories, that repositories
+// restored from prefix into dir had, as recorded in metadata manifests.
+//
+// Only those repositories might need objects from LFS stores.
+func lfs_dirs(ctx context.Context, HEAD Sha1, prefix, dir string, names *NameView) StrSet {
+	lfsdirs := StrSet{}
+	metas_foreach(ctx, HEAD, prefix, dir, names, func(metav []FileMeta, restored func(string) string) {
+		for i := range metav {
+			m := &metav[i]
+			if !(pathpkg.Base(m.path) == "lfs" && m.mode&syscall.S_IFMT == syscall.S_IFDIR) {
+				continue
+			}
+			if path := restored(m.path); path != "" {
+				lfsdirs.Add(path)
+			}
+		}
+	})
+	return lfsdirs
+}
+
+// lfs_pointers returns oids of LFS objects pointer files in repository at
+// gitdir refer to. Only pointer files reachable from headv are considered.
+//
+// Blobs of lfsPointerMaxSize and bigger are filtered out by git itself, so
+// that ids of large files are not even listed.
+func lfs_pointers(ctx context.Context, gitdir string, headv []Sha1) (oidv []string, err error) {
+	defer xerr.Contextf(&err, "%s: find LFS pointers", gitdir)
+	if len(headv) == 0 {
+		return nil, nil
+	}
+
+	// objects reachable from heads, except blobs too big to be pointers
+	query := strings.Builder{}
+	for _, sha1 := range headv {
+		query.WriteString(sha1.String() + "\n")
+	}
+	gerr, stdout, _ := ggit(ctx, "--git-dir="+gitdir, "rev-list", "--objects",
+		fmt.Sprintf("--filter=blob:limit=%d", lfsPointerMaxSize), "--stdin", RunWith{stdin: query.String()})
+	if gerr != nil {
+		return nil, gerr
+	}
+	query.Reset()
+	for _, __ := range xstrings.SplitLines(stdout, "\n") {
+		// <sha1> [SP <path>]
+		sha1 := __
+		if sp := strings.IndexByte(__, ' '); sp != -1 {
+			sha1 = __[:sp]
+		}
+		query.WriteString(sha1 + "\n")
+	}
+
+	// of them - blobs
+	gerr, stdout, _ = ggit(ctx, "--git-dir="+gitdir, "cat-file",
+		"--batch-check=%(objecttype) %(objectname)", RunWith{stdin: query.String()})
+	if gerr != nil {
+		return nil, gerr
+	}
+	query.Reset()
+	for _, __ := range xstrings.SplitLines(stdout, "\n") {
+		fieldv := strings.Fields(__)
+		if len(fieldv) != 2 {
+			return nil, fmt.Errorf("cat-file: strange output entry: %q", __)
+		}
+		if fieldv[0] == "blob" {
+			query.WriteString(fieldv[1] + "\n")
+		}
+	}
+	if query.Len() == 0 {
+		return nil, nil
+	}
+
+	seen := StrSet{}
+	err = catfile_batch(ctx, gitdir, query.String(), func(_, _, content string) error {
+		oid := lfs_pointer_oid(content)
+		if oid != "" && !seen.Contains(oid) {
+			seen.Add(oid)
+			oidv = append(oidv, oid)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return oidv, nil
+}
+
+// lfs_pointer_oid returns oid content of pointer file refers to, or "" if
+// content is not LFS pointer.
+func lfs_pointer_oid(content string) string {
+	if !strings.HasPrefix(content, lfsPointerVersion) {
+		return ""
+	}
+	for _, line := range xstrings.SplitLines(content, "\n") {
+		oid := strings.TrimPrefix(line, "oid sha256:")
+		if oid != line && isLfsOid(oid) {
+			return oid
+		}
+	}
+	return ""
+}
+
+// lfs_restore puts into lfs/objects/ of just restored repository at gitdir
+// objects, that its pointers reachable from restored headv refer to, from LFS
+// stores lfstab.
+func lfs_restore(ctx context.Context, g *git.Repository, gitdir string, headv []Sha1, lfstab map[string]Sha1) {
+	oidv, err := lfs_pointers(ctx, gitdir, headv)
+	exc.Raiseif(err)
+
+	for _, oid := range oidv {
+		blob, ok := lfstab[oid]
+		if !ok {
+			infof("Warning: %s: LFS object %s is not in backup", gitdir, oid)
+			continue
+		}
+		path := gitdir + "/lfs/objects/" + lfs_objpath(oid)
+		if _, err := os.Lstat(path); err == nil {
+			continue // restored as file from backup made by older git-backup
+		}
+		infof("# lfs  %s", path)
+		blob_to_file(ctx, g, blob, 0100644, path)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"lab.nexedi.com/kirr/go123/exc"
+)
+
+// verify pull/restore of Git LFS objects.
+func TestPullRestoreLFS(t *testing.T) {
+	ctx := context.Background()
+
+	workdir := xworkdir(t)
+
+	// lfsobj puts LFS object with content data into repository r and returns its oid.
+	lfsobj := func(r, data string) string {
+		sum := sha256.Sum256([]byte(data))
+		oid := hex.EncodeToString(sum[:])
+		path := r + "/lfs/objects/" + lfs_objpath(oid)
+		err := os.MkdirAll(path[:strings.LastIndex(path, "/")], 0777)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte(data), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return oid
+	}
+	// pointer commits pointer to LFS object oid into repository r as its main branch.
+	pointer := func(r, oid string, size int) {
+		rgit := xrgit(ctx, r)
+		blob := rgit("hash-object", "-w", "--stdin",
+			RunWith{stdin: fmt.Sprintf("%soid sha256:%s\nsize %d\n", lfsPointerVersion, oid, size)})
+		tree := rgit("mktree", RunWith{stdin: fmt.Sprintf("100644 blob %s\tbig.dat\n", blob)})
+		commit := rgit("commit-tree", tree, "-m", "x")
+		rgit("update-ref", "refs/heads/main", commit)
+	}
+
+	// r and its fork have the same object; stray object is not referenced
+	src := workdir + "/src"
+	for _, r := range []string{"r.git", "fork.git"} {
+		xgit(ctx, "init", "-q", "--bare", src+"/"+r)
+	}
+	oid := lfsobj(src+"/r.git", "large data")
+	lfsobj(src+"/fork.git", "large data")
+	stray := lfsobj(src+"/r.git", "stray data")
+	pointer(src+"/r.git", oid, 10)
+	pointer(src+"/fork.git", oid, 10)
+
+	gb := xbackupInit(ctx, t, "backup.git")
+
+	cmd_pull(ctx, gb, []string{src + ":b"})
+
+	lstree := xgit(ctx, "ls-tree", "-r", "--name-only", "HEAD")
+	for _, path := range strings.Split(lstree, "\n") {
+		if strings.Contains(path, "/lfs/objects/") {
+			t.Errorf("pull: LFS object saved as file: %s", path)
+		}
+	}
+	for _, o := range []string{oid, stray} {
+		if path := lfs_path("b") + "/" + lfs_objpath(o); !strings.Contains(lstree, path) {
+			t.Errorf("pull: %s not in LFS store", path)
+		}
+	}
+
+	dst := workdir + "/dst"
+	cmd_restore(ctx, gb, []string{"HEAD", "b:" + dst})
+	for _, r := range []string{"r.git", "fork.git"} {
+		data, err := ioutil.ReadFile(dst + "/" + r + "/lfs/objects/" + lfs_objpath(oid))
+		if err != nil || string(data) != "large data" {
+			t.Errorf("restore: %s: LFS object: %q, %v", r, data, err)
+		}
+	}
+	if _, err := os.Stat(dst + "/r.git/lfs/objects/" + lfs_objpath(stray)); !os.IsNotExist(err) {
+		t.Errorf("restore: not referenced LFS object restored: %v", err)
+	}
+
+	// corrupt LFS objects are not pulled
+	for _, r := range []string{"r.git", "fork.git"} {
+		err := ioutil.WriteFile(src+"/"+r+"/lfs/objects/"+lfs_objpath(oid), []byte("LARGE DATA"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	func() {
+		defer exc.Catch(func(e *exc.Error) {
+			if !strings.Contains(e.Error(), "LFS object corrupt") {
+				t.Fatalf("pull corrupt LFS object: wrong error: %s", e)
+			}
+		})
+		cmd_pull(ctx, gb, []string{"--no-stat-cache", src + ":b"})
+		t.Fatal("pull corrupt LFS object: did not complain")
+	}()
+}
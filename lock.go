@@ -0,0 +1,289 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+package main
+// Git-backup | Backup repository lock
+//
+// Pull locks backup repository, so that several pulls do not run
+// simultaneously. The lock is
+//
+//   refs/backup.locked
+//
+// ref, created atomically with git update-ref, pointing to blob with info
+// about who holds it:
+//
+//   host <hostname>
+//   pid <pid>
+//   started <time in RFC3339>
+//   command <command line>
+//
+// If the lock is held, pull fails, or, with --wait, waits for it to be released.
+// Lock held by a process, that was running on the same host, but is no longer
+// there - e.g. pull killed with SIGKILL - is stale and is broken automatically.
+// Locks held from other hosts cannot be checked and are broken only by hand
+// with `git-backup lock break`.
+//
+// Older git-backup used to point the lock ref to empty tree. Such locks are
+// reported as held by unknown owner.
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"lab.nexedi.com/kirr/go123/exc"
+	"lab.nexedi.com/kirr/go123/xerr"
+	"lab.nexedi.com/kirr/go123/xstrings"
+
+	"lab.nexedi.com/kirr/git-backup/internal/git"
+)
+
+const backupLock = "refs/backup.locked"
+
+// lockPollInterval is how often a held lock is rechecked while waiting for it.
+var lockPollInterval = 1 * time.Second
+
+// LockInfo is information about holder of backup repository lock.
+type LockInfo struct {
+	host    string
+	pid     int
+	started time.Time
+	command string
+}
+
+// lockinfo_self returns lock information about current process.
+func lockinfo_self() LockInfo {
+	host, err := os.Hostname()
+	exc.Raiseif(err)
+	return LockInfo{
+		host:    host,
+		pid:     os.Getpid(),
+		started: time.Now().Truncate(time.Second),
+		command: strings.Join(os.Args, " "),
+	}
+}
+
+// content returns lock blob content for l.
+func (l *LockInfo) content() string {
+	return fmt.Sprintf("host %s\npid %d\nstarted %s\ncommand %s\n",
+		l.host, l.pid, l.started.Format(time.RFC3339), l.command)
+}
+
+func (l *LockInfo) String() string {
+	if l.host == "" {
+		return "unknown owner"
+	}
+	return fmt.Sprintf("pid %d on %s since %s (%s)",
+		l.pid, l.host, l.started.Format(time.RFC3339), l.command)
+}
+
+// parseLockInfo parses lock information from lock blob content.
+func parseLockInfo(data string) (l LockInfo, err error) {
+	defer xerr.Context(&err, "invalid lock info")
+
+	for _, line := range xstrings.SplitLines(strings.TrimSuffix(data, "\n"), "\n") {
+		key, value := line, ""
+		if sp := strings.Index(line, " "); sp != -1 {
+			key, value = line[:sp], line[sp+1:]
+		}
+		switch key {
+		case "host":
+			l.host = value
+		case "pid":
+			l.pid, err = strconv.Atoi(value)
+		case "started":
+			l.started, err = time.Parse(time.RFC3339, value)
+		case "command":
+			l.command = value
+		}
+		if err != nil {
+			return l, err
+		}
+	}
+	if l.host == "" || l.pid <= 0 {
+		return l, fmt.Errorf("no host or pid")
+	}
+	return l, nil
+}
+
+// lock_read reads information about backup repository lock.
+//
+// If the lock is not held, nil is returned. sha1 is what lock ref points to.
+func lock_read(ctx context.Context) (info *LockInfo, sha1 Sha1, err error) {
+	defer xerr.Context(&err, "read backup lock")
+
+	gerr, __, _ := ggit(ctx, "rev-parse", "-q", "--verify", backupLock)
+	if gerr != nil {
+		return nil, sha1, nil // not locked
+	}
+	sha1, err = Sha1Parse(__)
+	if err != nil {
+		return nil, sha1, err
+	}
+
+	info = &LockInfo{}
+	if xgit(ctx, "cat-file", "-t", sha1) != "blob" {
+		return info, sha1, nil // empty tree - lock made by older git-backup
+	}
+	*info, err = parseLockInfo(xgit(ctx, "cat-file", "blob", sha1, RunWith{raw: true}))
+	if err != nil {
+		return nil, sha1, err
+	}
+	return info, sha1, nil
+}
+
+// isstale returns whether lock is held by process, that is no longer running.
+//
+// Only locks taken on this host can be checked.
+func (l *LockInfo) isstale() bool {
+	host, err := os.Hostname()
+	if err != nil || l.host == "" || l.host != host {
+		return false
+	}
+	err = syscall.Kill(l.pid, 0)
+	return err == syscall.ESRCH
+}
+
+// backup_lock locks backup repository.
+//
+// If the lock is held, backup_lock waits for it to be released for up to wait.
+// Stale locks are broken. The returned unlock releases the lock.
+func backup_lock(ctx context.Context, wait time.Duration) (unlock func(), err error) {
+	defer xerr.Context(&err, "lock backup repository")
+
+	self := lockinfo_self()
+	lock_sha1 := xgitSha1(ctx, "hash-object", "-w", "--stdin", RunWith{stdin: self.content()})
+
+	deadline := time.Now().Add(wait)
+	retry := false
+	for {
+		// create the lock only if it is not there
+		// (empty old value, not null sha1, to work with any object format)
+		gerr, _, _ := ggit(ctx, "update-ref", backupLock, lock_sha1, "")
+		if gerr == nil {
+			break
+		}
+
+		info, sha1, err := lock_read(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if info == nil {
+			if retry {
+				return nil, gerr
+			}
+			retry = true
+			continue // released in between
+		}
+		retry = false
+
+		if info.isstale() {
+			infof("# breaking stale lock held by %s", info)
+			// only if it was not changed in between
+			gerr, _, _ := ggit(ctx, "update-ref", "-d", backupLock, sha1)
+			if gerr != nil {
+				_, sha1_, err := lock_read(ctx)
+				if err != nil || sha1_ == sha1 {
+					return nil, gerr
+				}
+			}
+			continue
+		}
+
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("backup repository is locked by %s; see `git-backup lock`", info)
+		}
+		infof("# backup repository is locked by %s; waiting ...", info)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+
+	unlock = func() {
+		// only our lock - it could be broken by hand and taken by another pull
+		ggit(context.Background(), "update-ref", "-d", backupLock, lock_sha1)
+	}
+	return unlock, nil
+}
+
+// -------- git-backup lock --------
+
+func cmd_lock_usage() {
+	fmt.Fprint(os.Stderr,
+`git-backup lock status
+git-backup lock break
+
+Show who holds backup repository lock, or break the lock.
+
+The lock is held by pull while it runs. Lock of pull killed without
+cleanup is broken automatically by the next pull on the same host. Break
+it by hand only if it is held from another host, and you are sure the pull
+there is not running.
+`)
+}
+
+func cmd_lock(ctx context.Context, gb *git.Repository, argv []string) {
+	flags := flag.FlagSet{Usage: cmd_lock_usage}
+	flags.Init("", flag.ExitOnError)
+	flags.Parse(argv)
+
+	argv = flags.Args()
+	if len(argv) != 1 {
+		cmd_lock_usage()
+		os.Exit(1)
+	}
+
+	switch argv[0] {
+	case "status":
+		info, _, err := lock_read(ctx)
+		exc.Raiseif(err)
+		switch {
+		case info == nil:
+			fmt.Println("not locked")
+		case info.isstale():
+			fmt.Printf("locked by %s (stale)\n", info)
+		default:
+			fmt.Printf("locked by %s\n", info)
+		}
+
+	case "break":
+		info, sha1, err := lock_read(ctx)
+		exc.Raiseif(err)
+		if info == nil {
+			fmt.Println("not locked")
+			return
+		}
+		gerr, _, _ := ggit(ctx, "update-ref", "-d", backupLock, sha1)
+		if gerr != nil {
+			exc.Raisef("break lock held by %s: %s", info, gerr)
+		}
+		fmt.Printf("broke lock held by %s\n", info)
+
+	default:
+		cmd_lock_usage()
+		os.Exit(1)
+	}
+}
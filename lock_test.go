@@ -0,0 +1,130 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+
+package main
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupLock(t *testing.T) {
+	ctx := context.Background()
+
+	xworkdir(t)
+
+	defer func(interval time.Duration) {
+		lockPollInterval = interval
+	}(lockPollInterval)
+	lockPollInterval = 10 * time.Millisecond
+
+	xbackupInit(ctx, t, "backup.git")
+
+	// xlock locks backup repository on behalf of l.
+	xlock := func(l LockInfo) {
+		sha1 := xgitSha1(ctx, "hash-object", "-w", "--stdin", RunWith{stdin: l.content()})
+		xgit(ctx, "update-ref", backupLock, sha1, Sha1{})
+	}
+	// xlocked checks who holds the lock.
+	xlocked := func(want *LockInfo) {
+		t.Helper()
+		info, _, err := lock_read(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !(info == nil && want == nil || info != nil && want != nil && *info == *want) {
+			t.Fatalf("lock: %v  ; want %v", info, want)
+		}
+	}
+
+	// lock / unlock
+	unlock, err := backup_lock(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	self := lockinfo_self()
+	info, _, err := lock_read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info == nil || info.host != self.host || info.pid != self.pid || info.command != self.command {
+		t.Fatalf("lock: %v  ; want %v", info, self)
+	}
+	_, err = backup_lock(ctx, 0)
+	if err == nil || !strings.Contains(err.Error(), "locked by "+info.String()) {
+		t.Fatalf("lock while locked: err = %v", err)
+	}
+	unlock()
+	xlocked(nil)
+
+	// --wait: lock is released while we wait
+	unlock, err = backup_lock(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		unlock()
+	}()
+	unlock2, err := backup_lock(ctx, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock2()
+
+	// --wait: lock is not released in time
+	xlock(LockInfo{host: "otherhost", pid: 1, started: time.Unix(1, 0).UTC(), command: "git-backup pull"})
+	_, err = backup_lock(ctx, 50*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "locked by pid 1 on otherhost") {
+		t.Fatalf("lock from other host: err = %v", err)
+	}
+	cmd_lock(ctx, nil, []string{"break"})
+	xlocked(nil)
+
+	// stale lock from this host is broken automatically
+	dead := exec.Command("true")
+	if err := dead.Run(); err != nil {
+		t.Fatal(err)
+	}
+	stale := LockInfo{host: self.host, pid: dead.Process.Pid, started: time.Unix(1, 0).UTC(), command: "git-backup pull"}
+	xlock(stale)
+	if !stale.isstale() {
+		t.Fatalf("lock by dead pid %d is not stale", stale.pid)
+	}
+	unlock, err = backup_lock(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	xlocked(nil)
+
+	// lock made by older git-backup
+	xgit(ctx, "update-ref", backupLock, mktree_empty(ctx, ObjectFormatSHA1), Sha1{})
+	xlocked(&LockInfo{})
+	_, err = backup_lock(ctx, 0)
+	if err == nil || !strings.Contains(err.Error(), "locked by unknown owner") {
+		t.Fatalf("lock by older git-backup: err = %v", err)
+	}
+	cmd_lock(ctx, nil, []string{"break"})
+	xlocked(nil)
+}
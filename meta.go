@@ -0,0 +1,590 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+package main
+// Git-backup | File metadata
+//
+// Git trees keep only file type and executable bit. Full metadata of pulled
+// files and directories - permissions, owner and group, mtime and extended
+// attributes - is saved to sidecar manifest blob in backup tree
+//
+//   backup.meta/<prefix>.meta
+//
+// one manifest per pulled prefix. Manifest format is
+//
+//   # git-backup metadata 1
+//   <mode> <uid> <gid> <owner> <group> <mtime> <path> [@<key>=<value>]... [<xattr>=<value>]...
+//
+// with
+//
+//   - mode in octal as in struct stat, i.e. including file type,
+//   - owner and group names, or "-" if they were unknown on pull,
+//   - mtime as <sec>.<nsec> since epoch,
+//   - path relative to prefix; "." for pulled directory itself,
+//   - @rdev=<n> for device nodes,
+//   - @link=<path> for hardlinks: files, that are the same as file with path
+//     met earlier in the manifest,
+//   - xattr values in base64. Xattr names always have namespace, e.g. "user.",
+//     and so never start with "@".
+//
+// Every pulled directory, FIFO and device node is present in the manifest, and
+// restore recreates those of them, that are not there after restoring files -
+// e.g. empty directories. Contents of hardlinked files is pulled for every
+// link, and restore links the files back together.
+//
+// Names and path are %-escaped. POSIX ACLs are represented by Linux as
+// system.posix_acl_access and system.posix_acl_default extended attributes and
+// are saved as such.
+//
+// Restore applies saved metadata after all files and repositories are
+// restored. Backups made before metadata was saved are restored as before.
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"lab.nexedi.com/kirr/go123/exc"
+	"lab.nexedi.com/kirr/go123/mem"
+	"lab.nexedi.com/kirr/go123/xerr"
+	"lab.nexedi.com/kirr/go123/xstrings"
+)
+
+const (
+	metaDir   = "backup.meta"
+	metaMagic = "# git-backup metadata 1"
+)
+
+// meta_path returns path of metadata manifest for prefix in backup tree.
+func meta_path(prefix string) string {
+	return fmt.Sprintf("%s/%s.meta", metaDir, prefix)
+}
+
+// FileMeta represents metadata of one file.
+type FileMeta struct {
+	path         string // relative to prefix
+	mode         uint32 // native mode
+	uid, gid     uint32
+	owner, group string // "" if unknown
+	mtime        syscall.Timespec
+	rdev         uint64  // for device nodes
+	link         string  // for hardlinks: path of first link
+	xattrv       []Xattr // sorted by name
+}
+
+// Xattr represents one extended attribute.
+type Xattr struct {
+	name  string
+	value []byte
+}
+
+// names caches uid/gid -> owner/group name lookups.
+type names struct {
+	usertab  map[uint32]string
+	grouptab map[uint32]string
+}
+
+func newNames() *names {
+	return &names{usertab: map[uint32]string{}, grouptab: map[uint32]string{}}
+}
+
+func (n *names) user(uid uint32) string {
+	name, ok := n.usertab[uid]
+	if !ok {
+		u, err := user.LookupId(fmt.Sprint(uid))
+		if err == nil {
+			name = u.Username
+		}
+		n.usertab[uid] = name
+	}
+	return name
+}
+
+func (n *names) group(gid uint32) string {
+	name, ok := n.grouptab[gid]
+	if !ok {
+		g, err := user.LookupGroupId(fmt.Sprint(gid))
+		if err == nil {
+			name = g.Name
+		}
+		n.grouptab[gid] = name
+	}
+	return name
+}
+
+// file_meta gets metadata of file at path with stat information st.
+func file_meta(path, relpath string, st *syscall.Stat_t, n *names) (m FileMeta, err error) {
+	m = FileMeta{
+		path:  relpath,
+		mode:  st.Mode,
+		uid:   st.Uid,
+		gid:   st.Gid,
+		owner: n.user(st.Uid),
+		group: n.group(st.Gid),
+		mtime: st.Mtim,
+	}
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFCHR, syscall.S_IFBLK:
+		m.rdev = st.Rdev
+	}
+
+	// NOTE syscall has no l*xattr; xattrs of symlinks are not saved
+	if st.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+		m.xattrv, err = listxattrs(path)
+	}
+	return m, err
+}
+
+// listxattrs reads all extended attributes of file at path.
+func listxattrs(path string) (xattrv []Xattr, err error) {
+	defer xerr.Contextf(&err, "%s: xattrs", path)
+
+	// xget calls get with buffer large enough for result.
+	xget := func(get func(buf []byte) (int, error)) ([]byte, error) {
+		for {
+			size, err := get(nil)
+			if err != nil || size == 0 {
+				return nil, err
+			}
+			buf := make([]byte, size)
+			size, err = get(buf)
+			if err == syscall.ERANGE {
+				continue // changed in between the calls
+			}
+			if err != nil {
+				return nil, err
+			}
+			return buf[:size], nil
+		}
+	}
+
+	namev, err := xget(func(buf []byte) (int, error) {
+		return syscall.Listxattr(path, buf)
+	})
+	if err == syscall.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range strings.Split(mem.String(namev), "\x00") {
+		if name == "" {
+			continue
+		}
+		value, err := xget(func(buf []byte) (int, error) {
+			return syscall.Getxattr(path, name, buf)
+		})
+		if err == syscall.ENODATA {
+			continue // removed in between the calls
+		}
+		if err != nil {
+			return nil, err
+		}
+		xattrv = append(xattrv, Xattr{name, value})
+	}
+	sort.Slice(xattrv, func(i, j int) bool {
+		return xattrv[i].name < xattrv[j].name
+	})
+	return xattrv, nil
+}
+
+// path_metaescape escapes s so that it does not contain spaces and the like.
+// The result can be decoded with path_refunescape.
+func path_metaescape(s string) string {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c == '%' || c == '=' || c >= 0x7f {
+			out = append(out, fmt.Sprintf("%%%02X", c)...)
+		} else {
+			out = append(out, c)
+		}
+	}
+	return mem.String(out)
+}
+
+func (m *FileMeta) String() string {
+	name := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return path_metaescape(s)
+	}
+	s := fmt.Sprintf("%o %d %d %s %s %d.%09d %s", m.mode, m.uid, m.gid,
+		name(m.owner), name(m.group), m.mtime.Sec, m.mtime.Nsec, path_metaescape(m.path))
+	if m.rdev != 0 {
+		s += fmt.Sprintf(" @rdev=%d", m.rdev)
+	}
+	if m.link != "" {
+		s += fmt.Sprintf(" @link=%s", path_metaescape(m.link))
+	}
+	for _, x := range m.xattrv {
+		s += fmt.Sprintf(" %s=%s", path_metaescape(x.name), base64.StdEncoding.EncodeToString(x.value))
+	}
+	return s
+}
+
+// parseFileMeta parses one manifest line.
+func parseFileMeta(line string) (m FileMeta, err error) {
+	defer xerr.Contextf(&err, "invalid metadata entry %q", line)
+
+	fieldv := strings.Split(line, " ")
+	if len(fieldv) < 7 {
+		return m, fmt.Errorf("too few fields")
+	}
+
+	mode, err := strconv.ParseUint(fieldv[0], 8, 32)
+	if err != nil {
+		return m, err
+	}
+	uid, err := strconv.ParseUint(fieldv[1], 10, 32)
+	if err != nil {
+		return m, err
+	}
+	gid, err := strconv.ParseUint(fieldv[2], 10, 32)
+	if err != nil {
+		return m, err
+	}
+	m.mode, m.uid, m.gid = uint32(mode), uint32(uid), uint32(gid)
+
+	name := func(s string) (string, error) {
+		if s == "-" {
+			return "", nil
+		}
+		return path_refunescape(s)
+	}
+	m.owner, err = name(fieldv[3])
+	if err != nil {
+		return m, err
+	}
+	m.group, err = name(fieldv[4])
+	if err != nil {
+		return m, err
+	}
+
+	sec, nsec, err := xstrings.Split2(fieldv[5], ".")
+	if err == nil {
+		m.mtime.Sec, err = strconv.ParseInt(sec, 10, 64)
+	}
+	if err == nil {
+		m.mtime.Nsec, err = strconv.ParseInt(nsec, 10, 64)
+	}
+	if err != nil {
+		return m, fmt.Errorf("invalid mtime")
+	}
+
+	m.path, err = path_refunescape(fieldv[6])
+	if err != nil {
+		return m, err
+	}
+
+	for _, __ := range fieldv[7:] {
+		eq := strings.Index(__, "=") // NOTE base64 value can have "=" itself
+		if eq == -1 {
+			return m, fmt.Errorf("invalid attribute %q", __)
+		}
+
+		switch key, value := __[:eq], __[eq+1:]; key {
+		case "@rdev":
+			m.rdev, err = strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return m, err
+			}
+			continue
+		case "@link":
+			m.link, err = path_refunescape(value)
+			if err != nil {
+				return m, err
+			}
+			continue
+		default:
+			if strings.HasPrefix(key, "@") {
+				return m, fmt.Errorf("unknown attribute %q", key)
+			}
+		}
+
+		var x Xattr
+		x.name, err = path_refunescape(__[:eq])
+		if err != nil {
+			return m, err
+		}
+		x.value, err = base64.StdEncoding.DecodeString(__[eq+1:])
+		if err != nil {
+			return m, err
+		}
+		m.xattrv = append(m.xattrv, x)
+	}
+
+	return m, nil
+}
+
+// loadFileMeta loads metadata manifest from a git object.
+//
+// an example of object is e.g. "HEAD:backup.meta/prefix.meta".
+func loadFileMeta(ctx context.Context, object string) (metav []FileMeta, err error) {
+	defer xerr.Contextf(&err, "load metadata %q", object)
+
+	gerr, data, _ := ggit(ctx, "cat-file", "blob", object)
+	if gerr != nil {
+		return nil, gerr
+	}
+
+	for _, line := range xstrings.SplitLines(data, "\n") {
+		if line == metaMagic {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			return nil, fmt.Errorf("unsupported format %q", line)
+		}
+		m, err := parseFileMeta(line)
+		if err != nil {
+			return nil, err
+		}
+		metav = append(metav, m)
+	}
+	return metav, nil
+}
+
+// RestoreOptions represents options for restore.
+type RestoreOptions struct {
+	numericOwner bool              // ignore saved owner/group names
+	uidmap       map[uint32]uint32 // saved uid -> uid to restore
+	gidmap       map[uint32]uint32 // saved gid -> gid to restore
+	alternates   string            // "rewrite" | "drop" (see alternates.go)
+	byName       bool              // select and lay out repositories by names (see names.go)
+}
+
+// owner returns uid and gid to restore file with metadata m.
+//
+// Explicit mapping wins. Then, unless numericOwner, ids are looked up by
+// saved names. Saved ids are used if there is no user or group with such names.
+func (opts *RestoreOptions) owner(m *FileMeta) (uid, gid uint32) {
+	uid, ok := opts.uidmap[m.uid]
+	if !ok {
+		uid = m.uid
+		if m.owner != "" && !opts.numericOwner {
+			if u, err := user.Lookup(m.owner); err == nil {
+				if id, err := strconv.ParseUint(u.Uid, 10, 32); err == nil {
+					uid = uint32(id)
+				}
+			}
+		}
+	}
+
+	gid, ok = opts.gidmap[m.gid]
+	if !ok {
+		gid = m.gid
+		if m.group != "" && !opts.numericOwner {
+			if g, err := user.LookupGroup(m.group); err == nil {
+				if id, err := strconv.ParseUint(g.Gid, 10, 32); err == nil {
+					gid = uint32(id)
+				}
+			}
+		}
+	}
+
+	return uid, gid
+}
+
+// meta_create creates file at path, that has metadata m, if restoring files
+// did not create it - e.g. an empty directory or a FIFO. For hardlinks, link
+// is path of restored file to link to, or "" if it is outside of restore.
+func meta_create(path string, m *FileMeta, link string) (err error) {
+	defer xerr.Contextf(&err, "%s: restore", path)
+
+	if link != "" {
+		infof("# link %s\t-> %s", link, path)
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Link(link, path)
+	}
+
+	_, err = os.Lstat(path)
+	if err == nil || !os.IsNotExist(err) {
+		return err
+	}
+
+	switch m.mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		infof("# dir\t-> %s", path)
+		return os.MkdirAll(path, 0777)
+
+	case syscall.S_IFIFO, syscall.S_IFCHR, syscall.S_IFBLK:
+		infof("# special\t-> %s", path)
+		err = syscall.Mknod(path, m.mode, int(m.rdev))
+		if err == syscall.EPERM && m.mode&syscall.S_IFMT != syscall.S_IFIFO {
+			infof("Warning: %s: cannot create device node: %s", path, err)
+			return nil
+		}
+		if err != nil {
+			return &os.PathError{Op: "mknod", Path: path, Err: err}
+		}
+	}
+	return nil
+}
+
+// meta_restore applies metadata m to just restored file at path.
+//
+// Ownership is restored only if restore runs as root, similarly to tar.
+func meta_restore(path string, m *FileMeta, opts *RestoreOptions) (err error) {
+	defer xerr.Contextf(&err, "%s: restore metadata", path)
+
+	var st syscall.Stat_t
+	err = syscall.Lstat(path, &st)
+	if err != nil {
+		if err == syscall.ENOENT {
+			return nil // not restored, e.g. .git/refs/ of a repository
+		}
+		return err
+	}
+	if st.Mode&syscall.S_IFMT != m.mode&syscall.S_IFMT {
+		return nil // restored as something else
+	}
+
+	if os.Geteuid() == 0 {
+		uid, gid := opts.owner(m)
+		err = syscall.Lchown(path, int(uid), int(gid))
+		if err != nil {
+			return err
+		}
+	}
+
+	// NOTE syscall cannot change mode, xattrs and times of symlink itself
+	if m.mode&syscall.S_IFMT == syscall.S_IFLNK {
+		return nil
+	}
+
+	// chmod after chown, as chown could clear setuid/setgid bits
+	err = syscall.Chmod(path, m.mode&07777)
+	if err != nil {
+		return err
+	}
+
+	// xattrs after chmod, as chmod changes ACL mask
+	for _, x := range m.xattrv {
+		err := syscall.Setxattr(path, x.name, x.value, 0)
+		if err != nil {
+			infof("Warning: %s: cannot restore xattr %s: %s", path, x.name, err)
+		}
+	}
+
+	return syscall.UtimesNano(path, []syscall.Timespec{m.mtime, m.mtime})
+}
+
+// metas_foreach calls f for every metadata manifest related to prefix - pulled
+// to prefix itself, to its parents, or to its subdirectories.
+//
+// restored maps path of manifest entry to its path when restored from prefix
+// into dir, or to "" if the entry is outside of restore. With names view,
+// prefix and dir are by names.
+func metas_foreach(ctx context.Context, HEAD Sha1, prefix, dir string, names *NameView, f func(metav []FileMeta, restored func(relpath string) string)) {
+	lstree := xgit(ctx, "ls-tree", "--full-tree", "-r", "-z", "--name-only", "--", HEAD, metaDir, RunWith{raw: true})
+
+	for _, metafile := range xstrings.SplitLines(lstree, "\x00") {
+		metaprefix := strings.TrimSuffix(strings.TrimPrefix(metafile, metaDir+"/"), ".meta")
+		if !(path_isunder(prefix, metaprefix) || path_isunder(metaprefix, prefix)) {
+			continue
+		}
+
+		metav, err := loadFileMeta(ctx, fmt.Sprintf("%s:%s", HEAD, metafile))
+		exc.Raiseif(err)
+
+		// prefix/relpath in backup -> path in restored dir, or "" if outside of restore
+		restored := func(relpath string) string {
+			path := metaprefix
+			if relpath != "." {
+				path += "/" + relpath
+			}
+			backup_path := path
+			path = names.path(path)
+			if !path_isunder(prefix, path) {
+				return ""
+			}
+			path = strings.TrimSuffix(reprefix(prefix, dir, path), "/")
+			if names.isparent(backup_path) {
+				if _, err := os.Lstat(path); err != nil {
+					return ""
+				}
+			}
+			return path
+		}
+
+		f(metav, restored)
+	}
+}
+
+// metas_restore restores metadata of files restored from prefix into dir.
+//
+// It uses manifests of all prefixes related to prefix - see metas_foreach.
+func metas_restore(ctx context.Context, HEAD Sha1, prefix, dir string, names *NameView, opts *RestoreOptions) {
+	metas_foreach(ctx, HEAD, prefix, dir, names, func(metav []FileMeta, restored func(string) string) {
+		// first create everything, and only then restore metadata, because
+		// creating a file changes mtime of its directory.
+		for i := range metav {
+			m := &metav[i]
+			path := restored(m.path)
+			if path == "" {
+				continue
+			}
+			link := ""
+			if m.link != "" {
+				link = restored(m.link)
+			}
+			err := meta_create(path, m, link)
+			exc.Raiseif(err)
+		}
+
+		for i := range metav {
+			m := &metav[i]
+			path := restored(m.path)
+			if path == "" {
+				continue
+			}
+			err := meta_restore(path, m, opts)
+			exc.Raiseif(err)
+		}
+	})
+}
+
+// parse_idmap parses "from:to" id mappings.
+func parse_idmap(mapv []string) (map[uint32]uint32, error) {
+	idmap := map[uint32]uint32{}
+	for _, __ := range mapv {
+		from, to, err := xstrings.Split2(__, ":")
+		if err != nil {
+			return nil, fmt.Errorf("invalid id mapping %q", __)
+		}
+		idfrom, err1 := strconv.ParseUint(from, 10, 32)
+		idto, err2 := strconv.ParseUint(to, 10, 32)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid id mapping %q", __)
+		}
+		idmap[uint32(idfrom)] = uint32(idto)
+	}
+	return idmap, nil
+}
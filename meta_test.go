@@ -0,0 +1,240 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFileMetaString(t *testing.T) {
+	m := FileMeta{
+		path:   "a b/c=d%",
+		mode:   0104750,
+		uid:    1000,
+		gid:    100,
+		owner:  "joe",
+		group:  "",
+		mtime:  syscall.Timespec{Sec: 1700000000, Nsec: 5},
+		xattrv: []Xattr{{"system.posix_acl_access", []byte{2, 0, 0, 0}}, {"user.x y", []byte("hello")}},
+	}
+	line := m.String()
+	want := "104750 1000 100 joe - 1700000000.000000005 a%20b/c%3Dd%25 system.posix_acl_access=AgAAAA== user.x%20y=aGVsbG8="
+	if line != want {
+		t.Fatalf("String:\nhave: %q\nwant: %q", line, want)
+	}
+
+	m2, err := parseFileMeta(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m2, m) {
+		t.Fatalf("parse(String) -> %#v  ; want %#v", m2, m)
+	}
+
+	for _, bad := range []string{"", "100644 0 0 - - 1.0", "1x0644 0 0 - - 1.0 a", "100644 0 0 - - 1 a", "100644 0 0 - - 1.0 a x"} {
+		_, err := parseFileMeta(bad)
+		if err == nil {
+			t.Errorf("parse(%q) -> ok  ; want error", bad)
+		}
+	}
+}
+
+// verify that pull/restore preserve file metadata.
+func TestPullRestoreMeta(t *testing.T) {
+	ctx := context.Background()
+
+	workdir := xworkdir(t)
+
+	src := workdir + "/src"
+	for _, dir := range []string{src, src + "/d"} {
+		err := os.Mkdir(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{src + "/d/f", src + "/g"} {
+		err := ioutil.WriteFile(f, []byte("data"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.Symlink("g", src+"/l")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 6000, time.UTC)
+	xattrOk := syscall.Setxattr(src+"/g", "user.test", []byte("hello"), 0) == nil
+	for path, mode := range map[string]os.FileMode{src + "/d/f": 0640, src + "/g": 0604, src + "/d": 0750} {
+		err = os.Chmod(path, mode)
+		if err == nil {
+			err = os.Chtimes(path, mtime, mtime)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := os.Geteuid() == 0
+	if root {
+		err = os.Lchown(src+"/d/f", 1234, 5678)
+		if err == nil {
+			err = os.Lchown(src+"/l", 1234, 5678)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gb := xbackupInit(ctx, t, "backup.git")
+
+	cmd_pull(ctx, gb, []string{src + ":b"})
+
+	// restore whole prefix, and only part of it
+	dst := workdir + "/dst"
+	dstd := workdir + "/dstd"
+	cmd_restore(ctx, gb, []string{"--map-uid=1234:4321", "HEAD", "b:" + dst, "b/d:" + dstd})
+
+	xlstat := func(path string) *syscall.Stat_t {
+		var st syscall.Stat_t
+		err := syscall.Lstat(path, &st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &st
+	}
+	for _, tt := range []struct {
+		path     string
+		mode     uint32
+		uid, gid uint32
+	}{
+		{dst + "/d/f", 0100640, 4321, 5678},
+		{dst + "/g", 0100604, 0, 0},
+		{dst + "/d", 040750, 0, 0},
+		{dstd + "/f", 0100640, 4321, 5678},
+		{dstd, 040750, 0, 0},
+	} {
+		st := xlstat(tt.path)
+		if st.Mode != tt.mode {
+			t.Errorf("%s: mode %o  ; want %o", tt.path, st.Mode, tt.mode)
+		}
+		if !time.Unix(st.Mtim.Unix()).Equal(mtime) {
+			t.Errorf("%s: mtime %s  ; want %s", tt.path, time.Unix(st.Mtim.Unix()), mtime)
+		}
+		if root && (st.Uid != tt.uid || st.Gid != tt.gid) {
+			t.Errorf("%s: owner %d:%d  ; want %d:%d", tt.path, st.Uid, st.Gid, tt.uid, tt.gid)
+		}
+	}
+	if root {
+		if st := xlstat(dst + "/l"); st.Uid != 4321 || st.Gid != 5678 {
+			t.Errorf("%s: owner %d:%d  ; want 4321:5678", dst+"/l", st.Uid, st.Gid)
+		}
+	}
+	if xattrOk {
+		buf := make([]byte, 100)
+		n, err := syscall.Getxattr(dst+"/g", "user.test", buf)
+		if err != nil || string(buf[:n]) != "hello" {
+			t.Errorf("g: xattr user.test: %q, %v  ; want \"hello\"", buf[:n], err)
+		}
+	}
+
+	// backups without metadata are still restored
+	xgit(ctx, "rm", "--cached", "-r", "-q", metaDir)
+	tree := xgitSha1(ctx, "write-tree")
+	commit := xcommit_tree(gb, tree, []Sha1{}, "without metadata")
+	cmd_restore(ctx, gb, []string{commit.String(), "b:" + workdir + "/dst2"})
+	if st := xlstat(workdir + "/dst2/d/f"); st.Mode != 0100644 {
+		t.Errorf("restore without metadata: d/f: mode %o  ; want %o", st.Mode, 0100644)
+	}
+}
+
+// verify that pull/restore recreate FIFOs, device nodes, empty directories and hardlinks.
+func TestPullRestoreSpecial(t *testing.T) {
+	ctx := context.Background()
+
+	workdir := xworkdir(t)
+
+	src := workdir + "/src"
+	xrun := func(err error) {
+		if err != nil {
+			t.Helper()
+			t.Fatal(err)
+		}
+	}
+	xrun(os.MkdirAll(src+"/empty/deeper", 0777))
+	xrun(os.MkdirAll(src+"/d", 0777))
+	xrun(syscall.Mkfifo(src+"/fifo", 0644))
+	xrun(ioutil.WriteFile(src+"/f", []byte("data"), 0644))
+	xrun(os.Link(src+"/f", src+"/d/f2"))
+	xrun(os.Link(src+"/f", src+"/f3"))
+	root := os.Geteuid() == 0
+	if root {
+		xrun(syscall.Mknod(src+"/null", syscall.S_IFCHR|0666, 1<<8|3))
+	}
+
+	gb := xbackupInit(ctx, t, "backup.git")
+
+	cmd_pull(ctx, gb, []string{src + ":b"})
+
+	dst := workdir + "/dst"
+	cmd_restore(ctx, gb, []string{"HEAD", "b:" + dst})
+
+	xlstat := func(path string) *syscall.Stat_t {
+		var st syscall.Stat_t
+		err := syscall.Lstat(path, &st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &st
+	}
+	if st := xlstat(dst + "/empty/deeper"); st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		t.Errorf("empty/deeper: mode %o  ; want directory", st.Mode)
+	}
+	if st, want := xlstat(dst+"/fifo"), xlstat(src+"/fifo"); st.Mode != want.Mode {
+		t.Errorf("fifo: mode %o  ; want %o", st.Mode, want.Mode)
+	}
+	if root {
+		st, want := xlstat(dst+"/null"), xlstat(src+"/null")
+		if st.Mode != want.Mode || st.Rdev != want.Rdev {
+			t.Errorf("null: mode %o rdev %x  ; want %o %x", st.Mode, st.Rdev, want.Mode, want.Rdev)
+		}
+	}
+	st := xlstat(dst + "/f")
+	if st.Nlink != 3 {
+		t.Errorf("f: nlink %d  ; want 3", st.Nlink)
+	}
+	for _, link := range []string{"/d/f2", "/f3"} {
+		if st2 := xlstat(dst + link); st2.Ino != st.Ino {
+			t.Errorf("%s: not hardlinked to f", link)
+		}
+	}
+
+	// restoring part of a hardlink group gives independent copy
+	cmd_restore(ctx, gb, []string{"HEAD", "b/d:" + workdir + "/dstd"})
+	data, err := ioutil.ReadFile(workdir + "/dstd/f2")
+	if err != nil || string(data) != "data" {
+		t.Errorf("partial restore: f2: %q, %v  ; want \"data\"", data, err)
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+package main
+// Git-backup | Names of repositories
+//
+// Some Git hostings keep repositories on disk under opaque names. For example
+// GitLab with hashed storage keeps repository of a project as
+//
+//   @hashed/<xx>/<yy>/<sha256 of project id>.git
+//
+// its wiki as @hashed/<xx>/<yy>/<sha256 of project id>.wiki.git, and object
+// pools under @pools/. With `pull --repo-names <file>` human-readable names of
+// such repositories are taken from file, that maps paths of repositories on
+// disk to project paths, and are saved to sidecar manifest in backup tree
+//
+//   backup.names/<prefix>.names
+//
+// one manifest per pulled prefix. Manifest format is
+//
+//   # git-backup names 1
+//   <repo> <name>
+//
+// with repo - path of repository relative to prefix as on disk, and name - its
+// project path, both %-escaped. Repositories not mentioned in the file are
+// not named.
+//
+// The file is either CSV with header line, or JSON array of objects, with
+// "disk_path" and "path" columns, or fields, e.g.
+//
+//   id,path,disk_path
+//   1,group/project,@hashed/6b/86/6b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4b
+//   1,group/project.wiki,@hashed/6b/86/6b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4b.wiki
+//
+// Paths are matched with or without .git suffix. contrib/gitlab-backup
+// prepares such file for pulled GitLab instance.
+//
+// `restore --by-name` uses saved names: prefixes of restorespecs are taken as
+// paths by names, and named repositories are restored as <prefix>/<name>.git.
+// Repositories without names, e.g. object pools, and files are restored by
+// their paths as usual. Directories, that had only named repositories, e.g.
+// @hashed/<xx>/<yy>/, are not recreated.
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	pathpkg "path"
+	"sort"
+	"strings"
+
+	"lab.nexedi.com/kirr/go123/xerr"
+	"lab.nexedi.com/kirr/go123/xstrings"
+)
+
+const (
+	namesDir   = "backup.names"
+	namesMagic = "# git-backup names 1"
+)
+
+// names_path returns path of names manifest for prefix in backup tree.
+func names_path(prefix string) string {
+	return fmt.Sprintf("%s/%s.names", namesDir, prefix)
+}
+
+// repo_name returns path of repository without .git suffix.
+func repo_name(path string) string {
+	return strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+}
+
+// loadNameMap loads disk path -> project path mapping from file.
+//
+// Both paths are returned without .git suffix.
+func loadNameMap(path string) (nametab map[string]string, err error) {
+	defer xerr.Contextf(&err, "%s: load repository names", path)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	type Entry struct {
+		Path     string `json:"path"`
+		DiskPath string `json:"disk_path"`
+	}
+	entryv := []Entry{}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		err = json.Unmarshal(data, &entryv)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		recordv, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		ipath, idisk := -1, -1
+		if len(recordv) != 0 {
+			for i, column := range recordv[0] {
+				switch strings.TrimSpace(column) {
+				case "path":
+					ipath = i
+				case "disk_path":
+					idisk = i
+				}
+			}
+		}
+		if ipath == -1 || idisk == -1 {
+			return nil, fmt.Errorf("no path and disk_path columns in header")
+		}
+		for _, record := range recordv[1:] {
+			entryv = append(entryv, Entry{Path: record[ipath], DiskPath: record[idisk]})
+		}
+	}
+
+	nametab = map[string]string{}
+	for _, e := range entryv {
+		disk, name := repo_name(e.DiskPath), repo_name(e.Path)
+		if disk == "" || name == "" {
+			continue // e.g. object pool without project
+		}
+		nametab[disk] = name
+	}
+	return nametab, nil
+}
+
+// RepoName represents one entry of names manifest.
+type RepoName struct {
+	repo string // path of repository relative to prefix
+	name string // its project path
+}
+
+func (n *RepoName) String() string {
+	return fmt.Sprintf("%s %s", path_metaescape(n.repo), path_metaescape(n.name))
+}
+
+// loadRepoNames loads names manifest from a git object.
+//
+// an example of object is e.g. "HEAD:backup.names/prefix.names".
+func loadRepoNames(ctx context.Context, object string) (namev []RepoName, err error) {
+	defer xerr.Contextf(&err, "load names %q", object)
+
+	gerr, data, _ := ggit(ctx, "cat-file", "blob", object)
+	if gerr != nil {
+		return nil, gerr
+	}
+
+	for _, line := range xstrings.SplitLines(data, "\n") {
+		if line == namesMagic {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			return nil, fmt.Errorf("unsupported format %q", line)
+		}
+		fieldv := strings.Split(line, " ")
+		if len(fieldv) != 2 {
+			return nil, fmt.Errorf("invalid entry %q", line)
+		}
+		repo, err := path_refunescape(fieldv[0])
+		if err != nil {
+			return nil, err
+		}
+		name, err := path_refunescape(fieldv[1])
+		if err != nil {
+			return nil, err
+		}
+		namev = append(namev, RepoName{repo, name})
+	}
+	return namev, nil
+}
+
+// NameView represents backup tree as seen with repositories laid out by names.
+type NameView struct {
+	nametab map[string]string // path of named repository in backup -> its path by name
+	parents StrSet            // directories in backup named repositories were in
+	prefixv []string          // prefixes with names manifests
+}
+
+// loadNameView loads names manifests of all prefixes from backup state HEAD.
+func loadNameView(ctx context.Context, HEAD Sha1) (v *NameView, err error) {
+	defer xerr.Contextf(&err, "%s: load names", HEAD)
+
+	lstree := xgit(ctx, "ls-tree", "--full-tree", "-r", "-z", "--name-only", "--", HEAD, namesDir, RunWith{raw: true})
+
+	v = &NameView{nametab: map[string]string{}, parents: StrSet{}}
+	namedtab := map[string]string{} // path by name -> path in backup
+	for _, namesfile := range xstrings.SplitLines(lstree, "\x00") {
+		prefix := strings.TrimSuffix(strings.TrimPrefix(namesfile, namesDir+"/"), ".names")
+		prefix = path_dotgitunescape(prefix)
+		v.prefixv = append(v.prefixv, prefix)
+
+		namev, err := loadRepoNames(ctx, fmt.Sprintf("%s:%s", HEAD, namesfile))
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range namev {
+			repopath := prefix + "/" + n.repo
+			namepath := prefix + "/" + n.name + ".git"
+			if other, dup := namedtab[namepath]; dup {
+				return nil, fmt.Errorf("%s and %s are both named %s", other, repopath, namepath)
+			}
+			namedtab[namepath] = repopath
+			v.nametab[repopath] = namepath
+			for dir := pathpkg.Dir(repopath); path_isunder(prefix, dir) && dir != prefix; dir = pathpkg.Dir(dir) {
+				v.parents.Add(dir)
+			}
+		}
+	}
+	sort.Strings(v.prefixv)
+	return v, nil
+}
+
+// path returns path by names for path in backup.
+//
+// Paths in named repositories are mapped to be under their names; all other
+// paths stay as they are. With nil view paths are not changed.
+func (v *NameView) path(path string) string {
+	if v == nil {
+		return path
+	}
+	for repo := path; ; {
+		if name, ok := v.nametab[repo]; ok {
+			return name + path[len(repo):]
+		}
+		slash := strings.LastIndex(repo, "/")
+		if slash == -1 {
+			return path
+		}
+		repo = repo[:slash]
+	}
+}
+
+// isparent returns whether path in backup is directory, that had named
+// repositories in it. By names such directories are left out, unless they
+// have anything else.
+func (v *NameView) isparent(path string) bool {
+	return v != nil && v.parents.Contains(path)
+}
+
+// pathspecv returns paths in backup, under which there are all paths, that
+// are under prefix by names.
+func (v *NameView) pathspecv(prefix string) []string {
+	specv := []string{prefix}
+	if v == nil {
+		return specv
+	}
+	// named repositories stay under prefix they were pulled into
+	for _, p := range v.prefixv {
+		if path_isunder(prefix, p) || path_isunder(p, prefix) {
+			specv = append(specv, p)
+		}
+	}
+	return specv
+}
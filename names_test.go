@@ -0,0 +1,193 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestLoadNameMap(t *testing.T) {
+	workdir := xworkdir(t)
+
+	want := map[string]string{
+		"@hashed/6b/86/6b86":      "group/project",
+		"@hashed/6b/86/6b86.wiki": "group/project.wiki",
+		"@hashed/d4/73/d473":      "my group/x,y",
+	}
+
+	var tests = []struct{ name, data string }{
+		{"csv", `id,path,disk_path
+1,group/project,@hashed/6b/86/6b86
+1,group/project.wiki,@hashed/6b/86/6b86.wiki.git
+2,"my group/x,y",@hashed/d4/73/d473
+,,@pools/4b/22/4b22
+`},
+		{"csv-reordered", `disk_path,path
+@hashed/6b/86/6b86.git,group/project.git
+@hashed/6b/86/6b86.wiki,group/project.wiki
+@hashed/d4/73/d473,"my group/x,y"
+`},
+		{"json", `[
+  {"id": 1, "path": "group/project", "disk_path": "@hashed/6b/86/6b86"},
+  {"id": 1, "path": "group/project.wiki", "disk_path": "@hashed/6b/86/6b86.wiki"},
+  {"id": 2, "path": "my group/x,y", "disk_path": "@hashed/d4/73/d473"},
+  {"disk_path": "@pools/4b/22/4b22"}
+]`},
+	}
+
+	for _, tt := range tests {
+		path := workdir + "/" + tt.name
+		err := ioutil.WriteFile(path, []byte(tt.data), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nametab, err := loadNameMap(path)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(nametab, want) {
+			t.Errorf("%s: got %v  ; want %v", tt.name, nametab, want)
+		}
+	}
+
+	path := workdir + "/bad"
+	err := ioutil.WriteFile(path, []byte("id,name\n1,group/project\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadNameMap(path); err == nil {
+		t.Errorf("bad: no error for file without path and disk_path columns")
+	}
+}
+
+// verify pull/restore of repositories with names.
+func TestPullRestoreByName(t *testing.T) {
+	ctx := context.Background()
+
+	workdir := xworkdir(t)
+
+	// GitLab-like hashed storage
+	src := workdir + "/src"
+	commitv := map[string]string{} // repo on disk -> its master
+	for _, repo := range []string{"@hashed/6b/86/6b86.git", "@hashed/6b/86/6b86.wiki.git", "@hashed/d4/73/d473.git", "@pools/4b/22/4b22.git"} {
+		r := src + "/" + repo
+		xgit(ctx, "init", "-q", "--bare", r)
+		rgit := xrgit(ctx, r)
+		tree := rgit("mktree", RunWith{stdin: ""})
+		commitv[repo] = rgit("commit-tree", tree, "-m", repo)
+		rgit("update-ref", "refs/heads/master", commitv[repo])
+	}
+	err := ioutil.WriteFile(src+"/file", []byte("data\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := workdir + "/names.csv"
+	err = ioutil.WriteFile(names, []byte(`id,path,disk_path
+1,group/project,@hashed/6b/86/6b86
+1,group/project.wiki,@hashed/6b/86/6b86.wiki
+2,other/x,@hashed/d4/73/d473
+3,gone/y,@hashed/4e/07/4e07
+`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gb := xbackupInit(ctx, t, "backup.git")
+
+	cmd_pull(ctx, gb, []string{"--repo-names", names, src + ":b"})
+
+	namev, err := loadRepoNames(ctx, "HEAD:"+names_path("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(namev, func(i, j int) bool { return namev[i].repo < namev[j].repo })
+	namesOk := []RepoName{
+		{"@hashed/6b/86/6b86.git", "group/project"},
+		{"@hashed/6b/86/6b86.wiki.git", "group/project.wiki"},
+		{"@hashed/d4/73/d473.git", "other/x"},
+	}
+	if !reflect.DeepEqual(namev, namesOk) {
+		t.Fatalf("names:\nhave: %v\nwant: %v", namev, namesOk)
+	}
+
+	// verify checks that dir has exactly repositories and files of pathtab.
+	verify := func(dir string, pathtab map[string]string) {
+		t.Helper()
+		for path, repo := range pathtab {
+			if repo == "" {
+				_, err := os.Stat(dir + "/" + path)
+				if err != nil {
+					t.Error(err)
+				}
+				continue
+			}
+			head := xgit(ctx, "--git-dir="+dir+"/"+path, "rev-parse", "HEAD")
+			if head != commitv[repo] {
+				t.Errorf("%s/%s: HEAD = %s  ; want %s", dir, path, head, commitv[repo])
+			}
+		}
+		for _, path := range []string{"@hashed", "group", "other", "@pools", "file"} {
+			in := false
+			for p := range pathtab {
+				if p == path || len(p) > len(path) && p[:len(path)+1] == path+"/" {
+					in = true
+				}
+			}
+			if _, err := os.Stat(dir + "/" + path); (err == nil) != in {
+				t.Errorf("%s/%s: exists = %v  ; want %v", dir, path, err == nil, in)
+			}
+		}
+	}
+
+	// by paths on disk
+	cmd_restore(ctx, gb, []string{"HEAD", "b:" + workdir + "/dst"})
+	verify(workdir+"/dst", map[string]string{
+		"@hashed/6b/86/6b86.git":      "@hashed/6b/86/6b86.git",
+		"@hashed/6b/86/6b86.wiki.git": "@hashed/6b/86/6b86.wiki.git",
+		"@hashed/d4/73/d473.git":      "@hashed/d4/73/d473.git",
+		"@pools/4b/22/4b22.git":       "@pools/4b/22/4b22.git",
+		"file":                        "",
+	})
+
+	// by names
+	cmd_restore(ctx, gb, []string{"--by-name", "HEAD", "b:" + workdir + "/dst-byname"})
+	verify(workdir+"/dst-byname", map[string]string{
+		"group/project.git":      "@hashed/6b/86/6b86.git",
+		"group/project.wiki.git": "@hashed/6b/86/6b86.wiki.git",
+		"other/x.git":            "@hashed/d4/73/d473.git",
+		"@pools/4b/22/4b22.git":  "@pools/4b/22/4b22.git",
+		"file":                   "",
+	})
+
+	// selected by names
+	cmd_restore(ctx, gb, []string{"--by-name", "HEAD", "b/group:" + workdir + "/dst-group"})
+	verify(workdir+"/dst-group", map[string]string{
+		"project.git":      "@hashed/6b/86/6b86.git",
+		"project.wiki.git": "@hashed/6b/86/6b86.wiki.git",
+	})
+}
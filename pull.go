@@ -0,0 +1,912 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+package main
+// Git-backup | Pull
+//
+// Pull is done by one main worker and njobs fetch workers. The main worker
+// walks over pulled directories, converts files to blobs itself and sends
+// found git repositories to fetch workers, which pull objects from them in
+// parallel. Once everything is pulled, backup.refs is prepared from refs of
+// all fetched repositories and backup commit is made.
+//
+// While fetch workers run, checkpoints of what was pulled so far are made
+// as requested by --checkpoint (see checkpoint.go).
+//
+// NOTE libgit2 repository should not be used from several threads
+// simultaneously. gb is used by the main worker and checkpoints under gbMu.
+// Fetch workers use git subprocesses.
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"lab.nexedi.com/kirr/go123/exc"
+	"lab.nexedi.com/kirr/go123/mem"
+	"lab.nexedi.com/kirr/go123/my"
+	"lab.nexedi.com/kirr/go123/xstrings"
+	"lab.nexedi.com/kirr/go123/xsync"
+
+	"lab.nexedi.com/kirr/git-backup/internal/git"
+)
+
+// Pull is state of one pull run.
+type Pull struct {
+	gb        *git.Repository
+	pullspecv []PullSpec
+	opts      PullOptions
+
+	backup_time      string       // %Y%m%d-%H%M
+	run              string       // 20150820-210905-1234
+	backup_refs_work string       // refs/backup/20150820-210905-1234/
+	gitdir           string       // of backup repository
+	objfmt           ObjectFormat // sources must have the same object format
+	HEAD             Sha1         // backup state pull started from
+
+	statcache       *StatCache
+	statcache_path  string
+	excludev_config []string // backup.exclude patterns of backup repository
+	chunkv_config   []string // backup.chunk patterns of backup repository
+	alreadyHave     *Sha1SetSync
+	repotab_prev    map[string]*BackupRepo // previous backup.refs
+	resumed         StrSet                 // repositories pulled before the last checkpoint of pull to resume
+	plan            *PullPlan              // what would be pulled, for dry-run
+
+	// main worker; blobbedv is shared with checkpoints under gbMu
+	gbMu       sync.Mutex
+	blobbedv   []string // info about file pulled to blob, and not yet added to index
+	ownernames *names   // uid/gid -> owner/group names for metadata
+
+	// shared in between main and fetch workers
+	pulledMu      sync.Mutex
+	pulledtab     map[string][]Ref    // {} repopath -> all refs of fetched repository
+	pulledv       []string            // repopath of fetched repositories in order they were fetched
+	remotetab     map[string][]string // {} repopath -> index entries of files synthesized for remote repository
+	alternatestab map[string][]string // {} repopath -> object directories of its pools
+	pooltab       map[string]string   // {} objects directory of pulled repository -> repopath
+	anchored      Sha1Set             // sha1 of refs created under backup_refs_work
+	fetchMu       sync.RWMutex        // held exclusively by fetches that change backup shallow/promisor state
+	deepenv       []Ref               // parents missing behind shallow commits of backup; under fetchMu
+	partialMu     sync.Mutex
+	partialTips   Sha1Set // tips fetched from partial clones (see shallow.go)
+
+	// checkpoints (see checkpoint.go)
+	pulledq          chan struct{}    // fetch workers notify checkpointer about pulled repositories
+	refs             *BackupRefsMaker // refs of repositories already in checkpoint
+	checkpoint_blobs int              // blobbedv entries already in checkpoint index
+	checkpointed     Sha1      // last checkpoint commit
+	checkpoint_time  time.Time // when it was made
+	checkpoint_repos int       // repositories pulled by then
+}
+
+func cmd_pull_(ctx context.Context, gb *git.Repository, pullspecv []PullSpec, opts PullOptions) {
+	// while pulling, we'll keep refs to fetched objects under temp unique
+	// work refs namespace, so that they stay referenced until backup commit is made.
+	run := pull_runid() // 20150820-210905-1234
+	p := &Pull{
+		gb:               gb,
+		pullspecv:        pullspecv,
+		opts:             opts,
+		backup_time:      time.Now().Format("20060102-1504"), // %Y%m%d-%H%M
+		run:              run,
+		backup_refs_work: fmt.Sprintf("%s%s/", workRefs, run), // refs/backup/20150820-210905-1234/
+		gitdir:           xgit(ctx, "rev-parse", "--git-dir"),
+		objfmt:           gformat(gb),
+
+		ownernames:    newNames(),
+		pulledtab:     map[string][]Ref{},
+		remotetab:     map[string][]string{},
+		alternatestab: map[string][]string{},
+		pooltab:       map[string]string{},
+		anchored:      Sha1Set{},
+
+		refs:            newBackupRefsMaker(gb),
+		checkpoint_time: time.Now(),
+	}
+
+	// prevent another `git-backup pull` from running simultaneously
+	// (dry-run does not write anything and so does not need the lock)
+	if !opts.dryRun {
+		unlock, err := backup_lock(ctx, opts.wait)
+		exc.Raiseif(err)
+		defer unlock()
+	}
+
+	p.checkLeftovers(ctx)
+	if !opts.dryRun {
+		// on error clean up after ourselves, as we release the lock
+		defer exc.Onunwind(func(e *exc.Error) *exc.Error {
+			p.cleanup(ctx)
+			return e
+		})
+	}
+	p.begin(ctx)
+	p.loadAlreadyHave(ctx)
+	p.loadShallow(ctx)
+	p.loadPartial(ctx)
+	p.loadResumed(ctx)
+
+	// walk over specified dirs, pulling objects from git and blobbing non-git-object files
+	//
+	// NOTE the order in which fetch workers complete does not matter: backup.refs
+	// entries are sorted, and commit parents are sorted as well.
+	fetchq := make(chan FetchReq, 2*njobs) // requests to fetch repositories
+	checkpoints := !opts.dryRun && (opts.checkpointN != 0 || opts.checkpointT != 0)
+	if checkpoints {
+		p.pulledq = make(chan struct{}, 1)
+		defer os.Remove(p.gitdir + "/" + checkpointIndex)
+	}
+	wg := xsync.NewWorkGroup(ctx)
+	wg.Go(func(ctx context.Context) error {
+		defer close(fetchq)
+		return p.walk(ctx, fetchq)
+	})
+	var fetching sync.WaitGroup
+	for i := 0; i < njobs; i++ {
+		fetching.Add(1)
+		wg.Go(func(ctx context.Context) error {
+			defer fetching.Done()
+			return p.fetchWorker(ctx, fetchq)
+		})
+	}
+
+	// checkpoints are made while fetches are in progress, including after the
+	// walk is over: pulling big repositories is what usually takes the longest.
+	if checkpoints {
+		go func() {
+			fetching.Wait()
+			close(p.pulledq)
+		}()
+		wg.Go(p.checkpointer)
+	}
+
+	// wait for workers to finish & collect/reraise first error, if any
+	err := wg.Wait()
+	exc.Raiseif(err)
+
+	if opts.dryRun {
+		p.plan.Finish()
+		err = p.plan.Print(os.Stdout, opts.json)
+		exc.Raiseif(err)
+		return
+	}
+
+	p.commit(ctx)
+	p.finish(ctx)
+}
+
+// begin makes sure there is root commit, and writes journal of the pull.
+func (p *Pull) begin(ctx context.Context) {
+	gerr, __, _ := ggit(ctx, "rev-parse", "--verify", "HEAD")
+	if gerr != nil && p.opts.dryRun {
+		// HEAD stays null - everything is new
+	} else if gerr != nil {
+		infof("# creating root commit")
+		// NOTE `git commit` does not work in bare repo - do commit by hand
+		p.HEAD = xcommit_tree(p.gb, mktree_empty(ctx, p.objfmt), []Sha1{}, "Initialize git-backup repository")
+		xgit(ctx, "update-ref", "-m", "git-backup pull init", "HEAD", p.HEAD)
+	} else {
+		var err error
+		p.HEAD, err = Sha1Parse(__)
+		exc.Raiseif(err)
+	}
+
+	if p.opts.dryRun {
+		p.plan = newPullPlan(p.HEAD, p.objfmt)
+	} else {
+		p.writeJournal()
+	}
+
+	// load stat cache to avoid re-reading files unchanged since previous pull
+	var err error
+	p.statcache_path = p.gitdir + "/backup.statcache"
+	p.statcache, err = loadStatCache(p.statcache_path, !p.opts.noStatCache)
+	if err != nil {
+		infof("Warning: %s; starting with empty stat cache", err)
+		p.statcache = newStatCache(!p.opts.noStatCache)
+	}
+
+	// exclude and chunk patterns configured for backup repository
+	xconfigv := func(key string) []string {
+		gerr, __, _ := ggit(ctx, "config", "--get-all", key)
+		if gerr == nil {
+			return xstrings.SplitLines(__, "\n")
+		} else if gerr.ExitCode() != 1 { // 1 = not set
+			exc.Raise(gerr)
+		}
+		return nil
+	}
+	p.excludev_config = xconfigv("backup.exclude")
+	p.chunkv_config = xconfigv("backup.chunk")
+}
+
+// loadAlreadyHave builds index of "already-have" objects: all commits +
+// tag/tree/blob that were at heads of already pulled repositories.
+//
+// Build it once and use in fetch workers to check ourselves whether a head
+// from a pulled repository needs to be actually fetched. If we don't, `git
+// fetch-pack` will do similar to "all commits" linear scan for every pulled
+// repository, which are many out there.
+func (p *Pull) loadAlreadyHave(ctx context.Context) {
+	p.alreadyHave = &Sha1SetSync{} // shared in between fetch workers
+	p.repotab_prev = map[string]*BackupRepo{}
+	infof("# building \"already-have\" index")
+	if p.HEAD.IsNull() {
+		return
+	}
+
+	// already have: all commits
+	//
+	// As of lab.nexedi.com/20180612 there are ~ 1.7·10⁷ objects total in backup.
+	// Of those there are ~ 1.9·10⁶ commit objects, i.e. ~10% of total.
+	// Since 1 sha1 is 2·10¹ bytes, the space needed for keeping sha1 of all
+	// commits is ~ 4·10⁷B = ~40MB. It is thus ok to keep this index in RAM for now.
+	for _, __ := range xstrings.SplitLines(xgit(ctx, "rev-list", p.HEAD), "\n") {
+		sha1, err := Sha1Parse(__)
+		exc.Raiseif(err)
+		p.alreadyHave.Add(sha1)
+	}
+
+	// already have: tag/tree/blob that were at heads of already pulled repositories
+	//
+	// As of lab.nexedi.com/20180612 there are ~ 8.4·10⁴ refs in total.
+	// Of those encoded tag/tree/blob are ~ 3.2·10⁴, i.e. ~40% of total.
+	// The number of tag/tree/blob objects in alreadyHave is thus negligible
+	// compared to the number of "all commits".
+	//
+	// Previous backup.refs is also used to preserve refs of repositories from
+	// prefixes not pulled this time (see commit).
+	gerr, _, _ := ggit(ctx, "cat-file", "-e", p.HEAD.String()+":backup.refs")
+	if gerr != nil {
+		return // no backup.refs
+	}
+	var err error
+	p.repotab_prev, err = loadBackupRefs(ctx, p.HEAD)
+	exc.Raiseif(err)
+
+	for _, repo := range p.repotab_prev {
+		for _, xref := range repo.refs {
+			if xref.sha1 != xref.sha1_ && !p.alreadyHave.Contains(xref.sha1) {
+				// make sure encoded tag/tree/blob objects represented as
+				// commits are present. We do so, because we promise to
+				// fetch that all objects in alreadyHave are present.
+				if !p.opts.dryRun {
+					obj_recreate_from_commit(p.gb, xref.sha1_)
+				}
+
+				p.alreadyHave.Add(xref.sha1)
+			}
+		}
+	}
+}
+
+// walk is the main worker: it walks over specified dirs blobbing files and
+// scheduling fetch requests for found *.git -> fetchq.
+func (p *Pull) walk(ctx context.Context, fetchq chan<- FetchReq) (err error) {
+	// raised err -> return
+	here := my.FuncName()
+	defer exc.Catch(func(e *exc.Error) {
+		err = exc.Addcallingcontext(here, e)
+	})
+
+	for _, spec := range p.pullspecv {
+		prefix := spec.prefix
+
+		// make sure index is empty for prefix (so that we start from clean
+		// prefix namespace and this way won't leave stale removed things)
+		if p.opts.dryRun {
+			p.plan.LoadHead(ctx, prefix)
+			p.plan.LoadHead(ctx, lfs_path(path_dotgitescape(prefix)))
+		} else {
+			xgit(ctx, "rm", "--cached", "-r", "--ignore-unmatch", "--", prefix)
+			xgit(ctx, "rm", "--cached", "-r", "--ignore-unmatch", "--",
+				meta_path(path_dotgitescape(prefix)), metaDir+"/"+path_dotgitescape(prefix),
+				lfs_path(path_dotgitescape(prefix)),
+				names_path(path_dotgitescape(prefix)))
+		}
+
+		// repositories from URLs - just queue fetch requests
+		for _, remote := range spec.remotev {
+			repopath := prefix
+			if remote.name != "" {
+				repopath += "/" + remote.name
+			}
+			select {
+			case fetchq <- FetchReq{repo: remote.url,
+				repopath: repopath,
+				prefix:   prefix,
+				remote:   true}:
+
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if spec.dir == "" {
+			continue
+		}
+
+		err := p.walkDir(ctx, spec, fetchq)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// walkDir pulls files from directory of spec, and sends git repositories
+// found there to fetchq.
+func (p *Pull) walkDir(ctx context.Context, spec PullSpec, fetchq chan<- FetchReq) (err error) {
+	// raised err -> return
+	here := my.FuncName()
+	defer exc.Catch(func(e *exc.Error) {
+		err = exc.Addcallingcontext(here, e)
+	})
+
+	dir, prefix := spec.dir, spec.prefix
+	gb, opts, plan, statcache := p.gb, p.opts, p.plan, p.statcache
+	sopts := spec.opts.merge(opts.SourceOptions)
+	excluder := newExcluder(p.excludev_config, sopts.excludev)
+	chunkx := newExcluder(p.chunkv_config, sopts.chunkv) // matches files to chunk
+	var rootdev uint64
+	if st, err := os.Stat(dir); err == nil {
+		rootdev = uint64(st.Sys().(*syscall.Stat_t).Dev)
+	}
+	metav := []string{metaMagic} // metadata manifest lines
+	linktab := map[[2]uint64]string{} // (dev, ino) -> relpath of first hardlink
+	lfsseen := StrSet{}               // oids of LFS objects already pulled
+	repodirs := StrSet{}              // git repositories found
+	namev := []string{namesMagic}     // names manifest lines
+	var nametab map[string]string     // disk path -> name of repositories
+	if sopts.reponames != "" {
+		nametab, err = loadNameMap(sopts.reponames)
+		exc.Raiseif(err)
+	}
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) (errout error) {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// a file or directory was removed in parallel to us scanning the tree.
+				infof("Warning: Skipping %s: %s", path, err)
+				return nil
+			}
+			// any other error -> stop
+			return err
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// propagate exceptions properly via filepath.Walk as errors with calling context
+		// (filepath is not our code)
+		defer exc.Catch(func(e *exc.Error) {
+			errout = exc.Addcallingcontext(here, e)
+		})
+
+		// gb is shared with checkpoints
+		p.gbMu.Lock()
+		defer p.gbMu.Unlock()
+
+		// skip entries user asked us not to pull
+		if skip := pull_skip(excluder, sopts, dir, path, info, rootdev); skip != "" {
+			infof("# file %s\t<- %s\t(skip: %s)", prefix, path, skip)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			err := excluder.LoadDir(path, strip_prefix(dir, path))
+			exc.Raiseif(err)
+
+			// git repositories are recognized by structure, not by name
+			if isrepo(path) {
+				repodirs.Add(path)
+
+				relpath := strip_prefix(dir, path)
+				if name, ok := nametab[repo_name(relpath)]; ok {
+					namev = append(namev, (&RepoName{relpath, name}).String())
+				}
+			}
+		}
+
+		// ingit returns whether path is <repo>/sub of a found repository.
+		ingit := func(sub string) bool {
+			return strings.HasSuffix(path, "/"+sub) &&
+				repodirs.Contains(strings.TrimSuffix(path, "/"+sub))
+		}
+
+		// metadata of everything pulled, except <repo>/packed-refs &
+		// co, which are not pulled as files
+		if !(ingit("packed-refs") ||
+		     ingit("objects") ||
+		     ingit("lfs/objects") ||
+		     ingit("refs") ||
+		     ingit("reftable")) {
+			relpath := strip_prefix(dir, path)
+			if relpath == "" {
+				relpath = "."
+			}
+			st := info.Sys().(*syscall.Stat_t)
+			meta, err := file_meta(path, relpath, st, p.ownernames)
+			exc.Raiseif(err)
+			if info.Mode().IsRegular() && st.Nlink > 1 {
+				ino := [2]uint64{uint64(st.Dev), st.Ino}
+				meta.link = linktab[ino]
+				if meta.link == "" {
+					linktab[ino] = relpath
+				}
+			}
+			metav = append(metav, meta.String())
+		}
+
+		// files -> blobs + queue info for adding blobs to index
+		if !info.IsDir() {
+			// everything related to <repo>/refs is ignored
+			// (see below comment about <repo>/refs for details)
+			if ingit("packed-refs") {
+				return nil
+			}
+
+			// FIFOs and device nodes are only recorded in metadata
+			if !(info.Mode().IsRegular() || info.Mode()&os.ModeSymlink != 0) {
+				infof("# file %s\t<- %s\t(special)", prefix, path)
+				return nil
+			}
+
+			// NOTE .git of non-bare repository is stored as %2Egit
+			backup_path := path_dotgitescape(reprefix(dir, prefix, path))
+
+			// big files selected by user -> tree of chunks
+			chunked := false
+			if info.Mode().IsRegular() && info.Size() > int64(chunkMax) {
+				chunked, _ = chunkx.Excluded(strip_prefix(dir, path), false)
+			}
+
+			if opts.dryRun {
+				plan.File(dir, path, backup_path, chunked, statcache)
+				return nil
+			}
+
+			if chunked {
+				infof("# file %s\t<- %s\t(chunked)", prefix, path)
+				tree := file_to_chunks(gb, p.objfmt, path, statcache)
+				p.blobbedv = append(p.blobbedv, chunks_indexinfo(gb, tree, backup_path)...)
+				return nil
+			}
+
+			infof("# file %s\t<- %s", prefix, path)
+			var blob Sha1
+			var mode uint32
+			if isGitlink(path) {
+				blob, mode = gitlink_to_blob(gb, dir, path)
+			} else {
+				blob, mode = file_to_blob(gb, path, statcache)
+			}
+			p.blobbedv = append(p.blobbedv, fmt.Sprintf("%o %s\t%s", mode, blob, backup_path))
+			return nil
+		}
+
+		// directories -> look for git repositories and handle git object specially.
+
+		// do not recurse into <repo>/objects/  - we'll save them specially
+		if ingit("objects") {
+			return filepath.SkipDir
+		}
+
+		// LFS objects are saved once per oid into LFS store of the prefix
+		if ingit("lfs/objects") {
+			store := lfs_path(path_dotgitescape(prefix))
+			err := lfs_walk(path, func(oid, objpath string) error {
+				if lfsseen.Contains(oid) {
+					return nil // e.g. the same object in a fork
+				}
+				lfsseen.Add(oid)
+				backup_path := store + "/" + lfs_objpath(oid)
+				if opts.dryRun {
+					plan.File(dir, objpath, backup_path, false, statcache)
+					return nil
+				}
+				infof("# lfs  %s\t<- %s", prefix, objpath)
+				blob := lfs_to_blob(gb, objpath, oid, statcache)
+				p.blobbedv = append(p.blobbedv, fmt.Sprintf("%o %s\t%s", 0100644, blob, backup_path))
+				return nil
+			})
+			exc.Raiseif(err)
+			return filepath.SkipDir
+		}
+
+		// neither we do not recurse into <repo>/refs & co  - we'll save refs via backup.refs blob
+		if ingit("refs") || ingit("reftable") {
+			return filepath.SkipDir
+		}
+
+		// else we recurse, but handle git repositories specially - via fetching objects from them
+		if !repodirs.Contains(path) {
+			return nil
+		}
+
+		// git repo - let's pull all refs from it to our backup refs namespace
+		// (gb is released while we wait for fetch workers, so that
+		// checkpoints are not delayed by the walk)
+		p.gbMu.Unlock()
+		defer p.gbMu.Lock()
+		select {
+		case fetchq <- FetchReq{repo: path,
+			repopath: reprefix(dir, prefix, path),
+			prefix:   prefix,
+			reflog:   sopts.reflog}:
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		return nil
+	})
+
+	// re-raise / raise error after Walk
+	if err != nil {
+		e := exc.Aserror(err)
+		e = exc.Addcontext(e, "pulling from "+dir)
+		exc.Raise(e)
+	}
+
+	if opts.dryRun {
+		return nil
+	}
+	p.gbMu.Lock()
+	defer p.gbMu.Unlock()
+	meta_sha1, err := WriteObject(gb, mem.Bytes(strings.Join(metav, "\n")+"\n"), git.ObjectBlob)
+	exc.Raiseif(err)
+	p.blobbedv = append(p.blobbedv, fmt.Sprintf("%o %s\t%s", 0100644, meta_sha1, meta_path(path_dotgitescape(prefix))))
+
+	if len(namev) > 1 {
+		names_sha1, err := WriteObject(gb, mem.Bytes(strings.Join(namev, "\n")+"\n"), git.ObjectBlob)
+		exc.Raiseif(err)
+		p.blobbedv = append(p.blobbedv, fmt.Sprintf("%o %s\t%s", 0100644, names_sha1, names_path(path_dotgitescape(prefix))))
+	}
+
+	return nil
+}
+
+// fetchWorker handles fetchq: it fetches objects and puts refs under backup
+// refs namespace.
+func (p *Pull) fetchWorker(ctx context.Context, fetchq <-chan FetchReq) (err error) {
+	// raised err -> return
+	here := my.FuncName()
+	defer exc.Catch(func(e *exc.Error) {
+		err = exc.Addcallingcontext(here, e)
+	})
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case f, ok := <-fetchq:
+			if !ok {
+				return nil
+			}
+			p.fetchRepo(ctx, f)
+		}
+	}
+}
+
+// fetchRepo pulls one repository requested via fetchq.
+func (p *Pull) fetchRepo(ctx context.Context, f FetchReq) {
+	opts, plan := p.opts, p.plan
+	infof("# git  %s\t<- %s", f.prefix, f.repo)
+
+	// detached HEADs are not advertised as refs, but we
+	// need to pull what they point to as well.
+	var headv []Ref
+	if f.remote {
+		// remote repository has no files for the walker to pull.
+		// Save at least HEAD and config, so that restore recognizes
+		// restored directory as Git repository, whatever its name
+		// is, and HEAD points to what it was pointing to on remote side.
+		head, err := lsremote_head(ctx, f.repo)
+		exc.Raiseif(err)
+		if opts.dryRun {
+			plan.Seen(f.repopath + "/HEAD")
+			plan.Seen(f.repopath + "/config")
+		} else {
+			head_sha1 := xgitSha1(ctx, "hash-object", "-w", "--stdin", RunWith{stdin: head})
+			config_sha1 := xgitSha1(ctx, "hash-object", "-w", "--stdin", RunWith{stdin: remote_config(p.objfmt)})
+			p.pulledMu.Lock()
+			p.remotetab[f.repopath] = []string{
+				fmt.Sprintf("%o %s\t%s/HEAD", 0100644, head_sha1, f.repopath),
+				fmt.Sprintf("%o %s\t%s/config", 0100644, config_sha1, f.repopath),
+			}
+			p.pulledMu.Unlock()
+		}
+
+		if sha1, err := Sha1Parse(strings.TrimSpace(head)); err == nil {
+			headv = append(headv, Ref{name: "../HEAD", sha1: sha1})
+		}
+	} else {
+		// pools the repository borrows objects from (see alternates.go)
+		objdirv, err := lsalternates(f.repo)
+		exc.Raiseif(err)
+		objects, err := filepath.Abs(f.repo + "/objects")
+		exc.Raiseif(err)
+		p.pulledMu.Lock()
+		p.pooltab[objects] = f.repopath
+		if len(objdirv) != 0 {
+			p.alternatestab[f.repopath] = objdirv
+		}
+		p.pulledMu.Unlock()
+		if opts.dryRun && len(objdirv) != 0 {
+			plan.Seen(path_dotgitescape(f.repopath) + "/objects/info/alternates")
+		}
+
+		headv, err = lsdetached(f.repo)
+		exc.Raiseif(err)
+		if f.reflog {
+			logv, err := lsreflog(ctx, f.repo)
+			exc.Raiseif(err)
+			headv = append(headv, logv...)
+		}
+	}
+
+	if opts.dryRun {
+		refv, err := lsremote(ctx, f.repo, p.objfmt)
+		exc.Raiseif(err)
+		plan.Repo(f.repo, f.repopath, append(refv, headv...), p.alreadyHave)
+		return
+	}
+
+	var refv, fetchedv []Ref
+	if p.resumed.Contains(f.repopath) {
+		// already pulled before checkpoint of resumed pull
+		refv = repo_refv(p.repotab_prev[f.repopath])
+	} else {
+		refv, fetchedv = p.fetchObjects(ctx, f, headv)
+	}
+
+	// remember all references of fetched repository - backup.refs is
+	// generated directly from them in the end.
+	p.pulledMu.Lock()
+	_, dup := p.pulledtab[f.repopath]
+	if !dup {
+		p.pulledtab[f.repopath] = refv
+		p.pulledv = append(p.pulledv, f.repopath)
+	}
+	p.pulledMu.Unlock()
+	if dup {
+		exc.Raisef("%s: repository pulled twice", f.repopath)
+	}
+
+	// store to git references only references that were actually
+	// fetched - so that next fetch, e.g. from a fork that also has new
+	// data as its upstream, won't have to transfer what we just have
+	// fetched from upstream.
+	//
+	// The references are named by sha1 they point to, which
+	// automatically deduplicates them in between several repositories.
+	// This way there are O(δ) work references - usually only a few -
+	// and we avoid O(n^2) behaviour of every git fetch scanning all
+	// local references at its startup.
+	ref_createv := []string{}
+	p.pulledMu.Lock()
+	for _, ref := range fetchedv {
+		if !p.anchored.Contains(ref.sha1) {
+			p.anchored.Add(ref.sha1)
+			ref_createv = append(ref_createv, fmt.Sprintf("create %s%s\x00%s\x00", p.backup_refs_work, ref.sha1, ref.sha1))
+		}
+	}
+	p.pulledMu.Unlock()
+	// NOTE refs are created via update-ref subprocess, not via gb, because
+	// libgit2 repository should not be used from several threads simultaneously.
+	if len(ref_createv) != 0 {
+		xgit(ctx, "update-ref", "--stdin", "-z", RunWith{stdin: strings.Join(ref_createv, "")})
+	}
+
+	// tell checkpointer there is one more repository pulled
+	select {
+	case p.pulledq <- struct{}{}:
+	default: // it was already told
+	}
+
+	// XXX do we want to do full fsck of source git repo on pull as well ?
+}
+
+// fetchObjects fetches objects of repository f, including what headv point to.
+func (p *Pull) fetchObjects(ctx context.Context, f FetchReq, headv []Ref) (refv, fetchedv []Ref) {
+	var kind RepoKind
+	var err error
+	if !f.remote {
+		kind, err = repo_kind(ctx, f.repo)
+		exc.Raiseif(err)
+	}
+
+	// fetches from shallow and partial repositories, and fetches
+	// deepening shallow backup, change what it means for backup to
+	// have an object. Run them exclusively to other fetches. See
+	// shallow.go for details.
+	unlock := p.fetchMu.Unlock
+	deepen := false
+	for {
+		if kind.shallow || kind.filter != "" || deepen {
+			p.fetchMu.Lock()
+			deepen = p.deepens(ctx, f)
+			break
+		}
+		p.fetchMu.RLock()
+		deepen = p.deepens(ctx, f)
+		if !deepen {
+			unlock = p.fetchMu.RUnlock
+			break
+		}
+		p.fetchMu.RUnlock() // the repository has history backup is missing
+	}
+	defer unlock()
+
+	fopts := FetchOptions{kind: kind, objfmt: p.objfmt, deepen: deepen}
+	refv, fetchedv, err = fetch(ctx, f.repo, fopts, headv, p.alreadyHave)
+	exc.Raiseif(err)
+	if kind.shallow || deepen {
+		err = shallow_prune(ctx, p.gitdir)
+		exc.Raiseif(err)
+		p.loadShallow(ctx)
+	}
+	if kind.filter != "" {
+		// deepening fetches history behind all tips, not only fetched ones
+		partialv := fetchedv
+		if deepen {
+			partialv = refv
+		}
+		p.addPartial(partialv)
+	} else {
+		p.complete(ctx, f, kind, refv)
+	}
+	return refv, fetchedv
+}
+
+// commit makes backup commit of everything pulled.
+func (p *Pull) commit(ctx context.Context) {
+	// add to index files we converted to blobs
+	for _, entryv := range p.remotetab {
+		p.blobbedv = append(p.blobbedv, entryv...)
+	}
+	for repopath, objdirv := range p.alternatestab {
+		if len(p.pulledtab[repopath]) == 0 {
+			continue // empty repository has nothing to borrow
+		}
+		entryv := alternates_entries(objdirv, p.pooltab)
+		alternates_sha1 := xgitSha1(ctx, "hash-object", "-w", "--stdin", RunWith{stdin: strings.Join(entryv, "\n") + "\n"})
+		p.blobbedv = append(p.blobbedv, fmt.Sprintf("%o %s\t%s/objects/info/alternates", 0100644, alternates_sha1, path_dotgitescape(repopath)))
+	}
+	xgit(ctx, "update-index", "--add", "--index-info", RunWith{stdin: strings.Join(p.blobbedv, "\n")})
+
+	// all refs from all found git repositories collected.
+	// now prepare manifest with ref -> sha1 and do a synthetic commit merging all that sha1
+	// (so they become all reachable from HEAD -> survive repack and be transferable on git pull)
+	//
+	// NOTE we handle tag/tree/blob objects specially - because these objects cannot
+	// be in commit parents, we convert them to specially-crafted commits and use them.
+	// The commits prepared contain full info how to restore original objects.
+
+	// preserve refs of repositories from prefixes not pulled this time, so
+	// that different prefixes can be pulled into backup on different schedules.
+	//
+	// Repositories under pulled prefixes are not preserved even if they were
+	// not found this time - they were removed from pulled directory.
+	//
+	// refs of repositories already in checkpoint were added to p.refs before.
+	pulled := map[string][]Ref{}
+	for _, repopath := range p.pulledv[p.checkpoint_repos:] {
+		pulled[repopath] = p.pulledtab[repopath]
+	}
+	p.refs.Add(ctx, pulled)
+	backup_refs, backup_refs_parentv := p.refs.Make(p.repotab_prev, func(repopath string) bool {
+		for _, spec := range p.pullspecv {
+			if path_isunder(spec.prefix, repopath) {
+				return false
+			}
+		}
+		return true
+	})
+
+	// backup_refs -> blob
+	backup_refs_sha1 := xgitSha1(ctx, "hash-object", "-w", "--stdin", RunWith{stdin: backup_refs})
+
+	// add backup_refs blob to index
+	xgit(ctx, "update-index", "--add", "--cacheinfo", fmt.Sprintf("100644,%s,backup.refs", backup_refs_sha1))
+
+	// backup state is complete - it is not a checkpoint
+	xgit(ctx, "rm", "--cached", "-q", "--ignore-unmatch", "--", checkpointFile)
+
+	// index is ready - prepare tree and commit
+	parent := p.HEAD
+	if !p.checkpointed.IsNull() {
+		parent = p.checkpointed
+	}
+	backup_tree_sha1 := xgitSha1(ctx, "write-tree")
+	commit_sha1 := xcommit_tree(p.gb, backup_tree_sha1, append([]Sha1{parent}, backup_refs_parentv...),
+		"Git-backup "+p.backup_time)
+
+	xgit(ctx, "update-ref", "-m", "git-backup pull", "HEAD", commit_sha1, parent)
+}
+
+// finish cleans up after backup commit is made.
+func (p *Pull) finish(ctx context.Context) {
+	// blobs of all files are now reachable from HEAD - save stat cache for next pull
+	dirv := []string{}
+	for _, spec := range p.pullspecv {
+		if spec.dir != "" {
+			dirv = append(dirv, spec.dir)
+		}
+	}
+	err := p.statcache.Save(p.statcache_path, dirv)
+	if err != nil {
+		infof("Warning: %s", err) // backup itself is ok
+	}
+
+	// remove no-longer needed backup refs & verify they don't stay
+	backup_refs_delete := ""
+	for sha1 := range p.anchored {
+		backup_refs_delete += fmt.Sprintf("delete %s%s %s\n", p.backup_refs_work, sha1, sha1)
+	}
+
+	xgit(ctx, "update-ref", "--stdin", RunWith{stdin: backup_refs_delete})
+	__ := xgit(ctx, "for-each-ref", p.backup_refs_work)
+	if __ != "" {
+		exc.Raisef("Backup refs under %s not deleted properly", p.backup_refs_work)
+	}
+
+	// NOTE  `delete` deletes only files, but leaves empty dirs around.
+	//       more important: this affect performance of future `git-backup pull` run a *LOT*
+	//
+	//       reason is: `git pull` first check local refs, and for doing so it
+	//       recourse into all directories, even empty ones.
+	//
+	//       https://lab.nexedi.com/lab.nexedi.com/lab.nexedi.com/issues/4
+	//
+	//       So remove all dirs under backup_refs_work prefix in the end.
+	err = os.RemoveAll(p.gitdir + "/" + p.backup_refs_work)
+	exc.Raiseif(err) // NOTE err is nil if path does not exist
+
+	// pulled completely - nothing to recover
+	err = os.Remove(p.gitdir + "/" + journalFile)
+	exc.Raiseif(err)
+
+	// if we have working copy - update it
+	bare := xgit(ctx, "rev-parse", "--is-bare-repository")
+	if bare != "true" {
+		// `git checkout-index -af`  -- does not delete deleted files
+		// `git read-tree -v -u --reset HEAD~ HEAD`  -- needs index matching
+		// original worktree to properly work, but we already have updated index
+		//
+		// so we get changes we committed as diff and apply to worktree
+		diff := xgit(ctx, "diff", "--binary", p.HEAD, "HEAD", RunWith{raw: true})
+		if diff != "" {
+			diffstat := xgit(ctx, "apply", "--stat", "--apply", "--binary", "--whitespace=nowarn",
+				RunWith{stdin: diff, raw: true})
+			infof("%s", diffstat)
+		}
+	}
+}
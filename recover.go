@@ -0,0 +1,375 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+package main
+// Git-backup | Recovery from interrupted pulls
+//
+// Every pull has unique run id - <YYYYMMDD-HHMMSS>-<pid> - and while it runs
+// it keeps
+//
+//   - refs/backup/<run>/<sha1> work refs to objects fetched so far,
+//   - index of backup repository with pulled prefixes being rebuilt, and
+//   - journal $GIT_DIR/backup.journal:
+//
+//       run <run>
+//       head <HEAD sha1 pull started from>
+//       pull <prefix>
+//       ...
+//
+// Successful pull commits what it pulled, and removes all that. Pull that
+// failed with an error removes all that too, and resets the index back to
+// HEAD. Pull that was interrupted - killed, crashed together with the machine,
+// etc - leaves them behind. Objects such pull already fetched are not lost:
+//
+//   git-backup recover --commit
+//
+// makes them reachable from new backup commit with the same tree as HEAD, so
+// that backup state is not changed, but the next pull does not fetch them
+// again.
+//
+//   git-backup recover --discard
+//
+// instead just throws leftovers away. Both reset index of backup repository
+// back to HEAD. Pull refuses to run until leftovers are recovered one way or
+// another. Pulls by older git-backup used refs/backup/<YYYYMMDD-HHMM>/
+// work refs and no journal; their leftovers are recovered the same way.
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"lab.nexedi.com/kirr/go123/exc"
+	"lab.nexedi.com/kirr/go123/xerr"
+	"lab.nexedi.com/kirr/go123/xstrings"
+
+	"lab.nexedi.com/kirr/git-backup/internal/git"
+)
+
+const (
+	journalFile = "backup.journal"
+	workRefs    = "refs/backup/" // work refs of all pulls
+)
+
+// pull_runid returns unique id for pull run.
+func pull_runid() string {
+	return fmt.Sprintf("%s-%d", time.Now().Format("20060102-150405"), os.Getpid())
+}
+
+// Journal represents journal of running pull.
+type Journal struct {
+	run     string
+	head    Sha1
+	prefixv []string
+}
+
+func (j *Journal) content() string {
+	s := fmt.Sprintf("run %s\nhead %s\n", j.run, j.head)
+	for _, prefix := range j.prefixv {
+		s += fmt.Sprintf("pull %s\n", path_metaescape(prefix))
+	}
+	return s
+}
+
+// parseJournal parses journal content.
+func parseJournal(data string) (j Journal, err error) {
+	defer xerr.Context(&err, "invalid journal")
+
+	for _, line := range xstrings.SplitLines(strings.TrimSuffix(data, "\n"), "\n") {
+		key, value := line, ""
+		if sp := strings.Index(line, " "); sp != -1 {
+			key, value = line[:sp], line[sp+1:]
+		}
+		switch key {
+		case "run":
+			j.run = value
+		case "head":
+			j.head, err = Sha1Parse(value)
+		case "pull":
+			var prefix string
+			prefix, err = path_refunescape(value)
+			j.prefixv = append(j.prefixv, prefix)
+		default:
+			err = fmt.Errorf("unknown entry %q", line)
+		}
+		if err != nil {
+			return j, err
+		}
+	}
+	if j.run == "" {
+		return j, fmt.Errorf("no run id")
+	}
+	return j, nil
+}
+
+// journal_write writes journal of running pull to backup repository at gitdir.
+func journal_write(gitdir string, j *Journal) error {
+	return ioutil.WriteFile(gitdir+"/"+journalFile, []byte(j.content()), 0666)
+}
+
+// writeJournal writes journal of the pull, so that it can be recovered if
+// interrupted.
+func (p *Pull) writeJournal() {
+	journal := &Journal{run: p.run, head: p.HEAD}
+	for _, spec := range p.pullspecv {
+		journal.prefixv = append(journal.prefixv, spec.prefix)
+	}
+	err := journal_write(p.gitdir, journal)
+	exc.Raiseif(err)
+}
+
+// checkLeftovers makes sure previous interrupted pull did not leave anything
+// behind: what it left has to be recovered first.
+func (p *Pull) checkLeftovers(ctx context.Context) {
+	leftovers, err := leftovers_find(ctx, p.gitdir)
+	exc.Raiseif(err)
+	if leftovers == nil {
+		return
+	}
+	if p.opts.dryRun {
+		infof("# found leftovers of %s", leftovers)
+		return
+	}
+	exc.Raisef("backup repository has leftovers of %s;\n"+
+		"run `git-backup recover --commit` to keep objects it fetched, "+
+		"or `git-backup recover --discard` to throw them away", leftovers)
+}
+
+// cleanup removes journal and work refs of the pull, that failed with an
+// error, and resets index of backup repository back to HEAD, so that next pull
+// can run. Checkpoints the pull made, if any, stay.
+//
+// Interrupted pull leaves everything in place for recover.
+func (p *Pull) cleanup(ctx context.Context) {
+	if ctx.Err() != nil {
+		return
+	}
+	err := exc.Runx(func() {
+		l, err := leftovers_find(ctx, p.gitdir)
+		exc.Raiseif(err)
+		if l != nil {
+			leftovers_discard(ctx, p.gitdir, l)
+		}
+	})
+	if err != nil {
+		infof("Warning: cannot clean up after failed pull: %s", err)
+	}
+}
+
+// journal_read reads journal left in backup repository at gitdir.
+//
+// nil is returned if there is no journal.
+func journal_read(gitdir string) (*Journal, error) {
+	data, err := ioutil.ReadFile(gitdir + "/" + journalFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	j, err := parseJournal(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s/%s: %s", gitdir, journalFile, err)
+	}
+	return &j, nil
+}
+
+// Leftovers represents what interrupted pull left in backup repository.
+type Leftovers struct {
+	journal  *Journal // nil for pulls by older git-backup
+	workrefv []Ref    // work refs to fetched objects; names are full
+}
+
+func (l *Leftovers) String() string {
+	what := "interrupted pull"
+	if l.journal != nil {
+		what += " " + l.journal.run
+		if len(l.journal.prefixv) != 0 {
+			what += " of " + strings.Join(l.journal.prefixv, " ")
+		}
+	}
+	return fmt.Sprintf("%s: %d fetched objects", what, len(l.workrefv))
+}
+
+// leftovers_find finds leftovers of interrupted pull in backup repository at gitdir.
+//
+// nil is returned if there is nothing left.
+func leftovers_find(ctx context.Context, gitdir string) (l *Leftovers, err error) {
+	defer xerr.Context(&err, "find leftovers of interrupted pull")
+
+	j, err := journal_read(gitdir)
+	if err != nil {
+		return nil, err
+	}
+
+	workrefv := []Ref{}
+	for _, __ := range xstrings.SplitLines(xgit(ctx, "for-each-ref", "--format=%(objectname) %(refname)", workRefs), "\n") {
+		sp := strings.Index(__, " ")
+		if sp == -1 {
+			return nil, fmt.Errorf("invalid for-each-ref entry %q", __)
+		}
+		sha1, err := Sha1Parse(__[:sp])
+		if err != nil {
+			return nil, err
+		}
+		workrefv = append(workrefv, Ref{name: __[sp+1:], sha1: sha1})
+	}
+
+	if j == nil && len(workrefv) == 0 {
+		return nil, nil
+	}
+	return &Leftovers{journal: j, workrefv: workrefv}, nil
+}
+
+// leftovers_commit makes objects fetched by interrupted pull reachable from
+// new backup commit with tree of HEAD, and removes leftovers.
+//
+// The new HEAD is returned.
+func leftovers_commit(ctx context.Context, gb *git.Repository, gitdir string, l *Leftovers) Sha1 {
+	gerr, __, _ := ggit(ctx, "rev-parse", "--verify", "HEAD")
+	var HEAD Sha1
+	var err error
+	if gerr == nil {
+		HEAD, err = Sha1Parse(__)
+		exc.Raiseif(err)
+	}
+
+	if len(l.workrefv) != 0 {
+		// tag/tree/blob cannot be commit parents - represent them as commits (see pull)
+		sha1v := []Sha1{}
+		for _, ref := range l.workrefv {
+			sha1v = append(sha1v, ref.sha1)
+		}
+		typetab := xgittypes(ctx, sha1v)
+		parents := Sha1Set{}
+		for _, sha1 := range sha1v {
+			if obj_type := typetab[sha1]; obj_type != git.ObjectCommit {
+				sha1 = obj_represent_as_commit(ctx, gb, sha1, obj_type)
+			}
+			parents.Add(sha1)
+		}
+		parentv := parents.Elements()
+		sort.Sort(BySha1(parentv))
+
+		tree := mktree_empty(ctx, gformat(gb))
+		if !HEAD.IsNull() {
+			tree = xgitSha1(ctx, "rev-parse", HEAD.String()+"^{tree}")
+			parentv = append([]Sha1{HEAD}, parentv...)
+		}
+		run := "interrupted pull"
+		if l.journal != nil {
+			run += " " + l.journal.run
+		}
+		commit := xcommit_tree(gb, tree, parentv, "Git-backup: objects fetched by "+run)
+		oldHEAD := HEAD.String()
+		if HEAD.IsNull() {
+			oldHEAD = "" // HEAD must not exist, whatever object format is
+		}
+		xgit(ctx, "update-ref", "-m", "git-backup recover", "HEAD", commit, oldHEAD)
+		HEAD = commit
+	}
+
+	leftovers_discard(ctx, gitdir, l)
+	return HEAD
+}
+
+// leftovers_discard removes leftovers of interrupted pull.
+//
+// Index of backup repository is reset to HEAD. Fetched objects are left to
+// be garbage-collected, unless they were committed.
+func leftovers_discard(ctx context.Context, gitdir string, l *Leftovers) {
+	gerr, _, _ := ggit(ctx, "rev-parse", "-q", "--verify", "HEAD")
+	if gerr == nil {
+		xgit(ctx, "read-tree", "HEAD")
+	} else {
+		xgit(ctx, "read-tree", "--empty")
+	}
+
+	refs_delete := ""
+	for _, ref := range l.workrefv {
+		refs_delete += fmt.Sprintf("delete %s %s\n", ref.name, ref.sha1)
+	}
+	xgit(ctx, "update-ref", "--stdin", RunWith{stdin: refs_delete})
+	// NOTE empty dirs are left by `delete` (see pull)
+	err := os.RemoveAll(gitdir + "/" + workRefs)
+	exc.Raiseif(err)
+
+	err = os.Remove(gitdir + "/" + journalFile)
+	if err != nil && !os.IsNotExist(err) {
+		exc.Raise(err)
+	}
+}
+
+// -------- git-backup recover --------
+
+func cmd_recover_usage() {
+	fmt.Fprint(os.Stderr,
+`git-backup recover [--commit | --discard]
+
+Show what interrupted pull left in backup repository, and deal with it.
+
+options:
+
+    --commit    commit objects the pull already fetched without changing
+                backup state, so that next pull does not fetch them again.
+    --discard   throw leftovers away.
+`)
+}
+
+func cmd_recover(ctx context.Context, gb *git.Repository, argv []string) {
+	flags := flag.FlagSet{Usage: cmd_recover_usage}
+	flags.Init("", flag.ExitOnError)
+	commit := flags.Bool("commit", false, "commit objects fetched by interrupted pull")
+	discard := flags.Bool("discard", false, "throw leftovers of interrupted pull away")
+	flags.Parse(argv)
+
+	if len(flags.Args()) != 0 || (*commit && *discard) {
+		cmd_recover_usage()
+		os.Exit(1)
+	}
+
+	// pull must not be running
+	unlock, err := backup_lock(ctx, 0)
+	exc.Raiseif(err)
+	defer unlock()
+
+	gitdir := xgit(ctx, "rev-parse", "--git-dir")
+	l, err := leftovers_find(ctx, gitdir)
+	exc.Raiseif(err)
+	if l == nil {
+		fmt.Println("nothing to recover")
+		return
+	}
+
+	switch {
+	case *commit:
+		HEAD := leftovers_commit(ctx, gb, gitdir, l)
+		fmt.Printf("recovered %s -> %s\n", l, HEAD)
+	case *discard:
+		leftovers_discard(ctx, gitdir, l)
+		fmt.Printf("discarded %s\n", l)
+	default:
+		fmt.Println(l)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"lab.nexedi.com/kirr/go123/exc"
+)
+
+func TestJournal(t *testing.T) {
+	head, err := Sha1Parse("1eeb0324b4a4f4d7b6a2fa85e2d0f3e16d9c48c4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := Journal{
+		run:     "20150820-210905-1234",
+		head:    head,
+		prefixv: []string{"b", "dir with spaces"},
+	}
+	j2, err := parseJournal(j.content())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(j2, j) {
+		t.Fatalf("journal roundtrip:\nhave: %v\nwant: %v", j2, j)
+	}
+
+	for _, bad := range []string{"", "head 1eeb0324b4a4f4d7b6a2fa85e2d0f3e16d9c48c4\n", "run x\nhello world\n"} {
+		if _, err := parseJournal(bad); err == nil {
+			t.Errorf("parseJournal(%q): no error", bad)
+		}
+	}
+}
+
+// verify recovery from interrupted pulls.
+func TestRecover(t *testing.T) {
+	ctx := context.Background()
+
+	workdir := xworkdir(t)
+
+	src := workdir + "/src"
+	r := src + "/r.git"
+	xgit(ctx, "init", "-q", "--bare", r)
+	// commit makes commit with data on top of master of r.
+	master := ""
+	commit := func(data string) string {
+		master = xcommit(ctx, r, data, master)
+		return master
+	}
+	commit("data1")
+
+	gb := xbackupInit(ctx, t, "backup.git")
+
+	cmd_pull(ctx, gb, []string{src + ":b"})
+
+	// interrupt makes leftovers as pull interrupted after fetching new commit of r.
+	interrupt := func(workref string, journal bool) (fetched string) {
+		fetched = commit("data for " + workref)
+		xgit(ctx, "fetch", "-q", r, "refs/heads/master:"+workref+fetched)
+		xgit(ctx, "rm", "-q", "--cached", "-r", "b")
+		if journal {
+			head := xgitSha1(ctx, "rev-parse", "HEAD")
+			err := journal_write(".", &Journal{run: pull_runid(), head: head, prefixv: []string{"b"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		l, err := leftovers_find(ctx, ".")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l == nil || len(l.workrefv) != 1 || (l.journal != nil) != journal {
+			t.Fatalf("leftovers: %v", l)
+		}
+		return fetched
+	}
+
+	// verify checks backup after recovery.
+	verify := func(tree string) {
+		t.Helper()
+		if l, err := leftovers_find(ctx, "."); l != nil || err != nil {
+			t.Fatalf("leftovers after recovery: %v, %v", l, err)
+		}
+		if _, err := os.Stat(journalFile); !os.IsNotExist(err) {
+			t.Fatalf("journal after recovery: %v", err)
+		}
+		if _, err := os.Stat(workRefs); !os.IsNotExist(err) {
+			t.Fatalf("work refs dir after recovery: %v", err)
+		}
+		if head := xgit(ctx, "rev-parse", "HEAD^{tree}"); head != tree {
+			t.Fatalf("tree after recovery: %s  ; want %s", head, tree)
+		}
+		if gerr, _, _ := ggit(ctx, "diff-index", "--cached", "--quiet", "HEAD"); gerr != nil {
+			t.Fatal("index not reset to HEAD after recovery")
+		}
+	}
+
+	// --commit: fetched objects are kept, backup state is the same
+	tree := xgit(ctx, "rev-parse", "HEAD^{tree}")
+	fetched := interrupt("refs/backup/20150820-2109/", false) // by older git-backup
+	cmd_recover(ctx, gb, []string{"--commit"})
+	verify(tree)
+	if gerr, _, _ := ggit(ctx, "merge-base", "--is-ancestor", fetched, "HEAD"); gerr != nil {
+		t.Fatal("--commit: fetched commit is not in backup")
+	}
+
+	// --discard: leftovers are thrown away
+	head := xgit(ctx, "rev-parse", "HEAD")
+	fetched = interrupt(workRefs+"20150820-210905-1234/", true)
+	cmd_recover(ctx, gb, []string{"--discard"})
+	verify(tree)
+	if head2 := xgit(ctx, "rev-parse", "HEAD"); head2 != head {
+		t.Fatalf("--discard: HEAD changed: %s -> %s", head, head2)
+	}
+	if gerr, _, _ := ggit(ctx, "merge-base", "--is-ancestor", fetched, "HEAD"); gerr == nil {
+		t.Fatal("--discard: fetched commit is in backup")
+	}
+
+	// next pull refuses to run until leftovers are recovered
+	fetched = interrupt(workRefs+"20150820-210905-1234/", true)
+	tip := commit("data3")
+	func() {
+		defer exc.Catch(func(e *exc.Error) {
+			if !strings.Contains(e.Error(), "git-backup recover") {
+				t.Fatalf("pull with leftovers: wrong error: %s", e)
+			}
+		})
+		cmd_pull(ctx, gb, []string{src + ":b"})
+		t.Fatal("pull with leftovers: did not complain")
+	}()
+	if head2 := xgit(ctx, "rev-parse", "HEAD"); head2 != head {
+		t.Fatalf("pull with leftovers: HEAD changed: %s -> %s", head, head2)
+	}
+	cmd_recover(ctx, gb, []string{"--commit"})
+	cmd_pull(ctx, gb, []string{src + ":b"})
+	for _, c := range []string{fetched, tip} {
+		if gerr, _, _ := ggit(ctx, "merge-base", "--is-ancestor", c, "HEAD"); gerr != nil {
+			t.Fatalf("pull after recovered pull: %s is not in backup", c)
+		}
+	}
+	if l, err := leftovers_find(ctx, "."); l != nil || err != nil {
+		t.Fatalf("leftovers after pull: %v, %v", l, err)
+	}
+	cmd_restore(ctx, gb, []string{"HEAD", "b:" + workdir + "/dst"})
+	if head := xgit(ctx, "--git-dir="+workdir+"/dst/r.git", "rev-parse", "HEAD"); head != tip {
+		t.Fatalf("restore after recovered pull: HEAD = %s  ; want %s", head, tip)
+	}
+}
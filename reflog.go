@@ -0,0 +1,212 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+package main
+// Git-backup | Objects referenced from reflogs
+//
+// Reflogs of pulled repositories are saved as just files, together with other
+// files of the repositories. Objects they refer to, however, are usually not
+// reachable from any reference, and so are not fetched. With `pull --reflog`
+// such objects are fetched too and are saved to backup.refs as
+// pseudo-references
+//
+//   <sha1> <prefix>/project.git/../reflog/<sha1>
+//
+// so that they stay reachable in backup and are restored together with the
+// repository. See isPseudoRef.
+//
+// Pseudo-references are made only for reflog tips - commits that are reachable
+// neither from references of the repository, nor from other reflog commits.
+// This way backup.refs does not grow with length of the reflogs.
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"lab.nexedi.com/kirr/go123/mem"
+	"lab.nexedi.com/kirr/go123/xerr"
+	"lab.nexedi.com/kirr/go123/xstrings"
+)
+
+// lsreflog lists objects referenced from reflogs of local repository and its
+// linked worktrees.
+//
+// The objects are returned as pseudo-references. Objects already missing in
+// the repository, e.g. pruned, are not returned.
+func lsreflog(ctx context.Context, repo string) (logv []Ref, err error) {
+	defer xerr.Contextf(&err, "lsreflog %s", repo)
+
+	logdirv, err := filepath.Glob(repo + "/worktrees/*/logs")
+	if err != nil {
+		return nil, err
+	}
+	logdirv = append([]string{repo + "/logs"}, logdirv...)
+
+	// <old> SP <new> SP <ident> TAB <message> LF
+	sha1s := Sha1Set{}
+	for _, logdir := range logdirv {
+		err = filepath.Walk(logdir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil // no reflogs, or removed in parallel to us
+				}
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			for _, entry := range xstrings.SplitLines(mem.String(data), "\n") {
+				fieldv := strings.SplitN(entry, " ", 3)
+				if len(fieldv) < 3 {
+					return fmt.Errorf("%s: invalid entry %q", path, entry)
+				}
+				for _, __ := range fieldv[:2] {
+					sha1, err := Sha1Parse(__)
+					if err != nil {
+						return fmt.Errorf("%s: invalid entry %q", path, entry)
+					}
+					if !sha1.IsNull() {
+						sha1s.Add(sha1)
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(sha1s) == 0 {
+		return nil, nil
+	}
+
+	// skip objects that are no longer there - fetch cannot get them
+	sha1v := sha1s.Elements()
+	sort.Sort(BySha1(sha1v))
+	query := strings.Builder{}
+	for _, sha1 := range sha1v {
+		query.WriteString(sha1.String() + "\n")
+	}
+	gerr, stdout, _ := ggit(ctx, "--git-dir="+repo, "cat-file", "--batch-check=%(objectname) %(objecttype)", RunWith{stdin: query.String()})
+	if gerr != nil {
+		return nil, gerr
+	}
+	commitv := []Sha1{}
+	for _, __ := range xstrings.SplitLines(stdout, "\n") {
+		if strings.HasSuffix(__, " missing") {
+			continue
+		}
+		sha1, type_ := Sha1{}, ""
+		_, err := fmt.Sscanf(__, "%s %s\n", &sha1, &type_)
+		if err != nil {
+			return nil, fmt.Errorf("cat-file: strange output entry: %q", __)
+		}
+		if type_ == "commit" {
+			commitv = append(commitv, sha1)
+		} else {
+			// e.g. tag objects from reflogs of tags
+			logv = append(logv, reflogRef(sha1))
+		}
+	}
+
+	tipv, err := reflog_tips(ctx, repo, commitv)
+	if err != nil {
+		return nil, err
+	}
+	for _, sha1 := range tipv {
+		logv = append(logv, reflogRef(sha1))
+	}
+	return logv, nil
+}
+
+// reflogRef returns pseudo-reference that anchors sha1 from reflog.
+func reflogRef(sha1 Sha1) Ref {
+	return Ref{name: "../reflog/" + sha1.String(), sha1: sha1}
+}
+
+// reflog_tips returns those of commits, that are reachable neither from
+// references of repo, nor from other commits.
+func reflog_tips(ctx context.Context, repo string, commitv []Sha1) (tipv []Sha1, err error) {
+	if len(commitv) == 0 {
+		return nil, nil
+	}
+
+	// revlist returns commits reachable from stdin revisions, but not from refs.
+	revlist := func(stdin *strings.Builder) (Sha1Set, error) {
+		// NOTE --all includes HEADs of linked worktrees as well
+		gerr, stdout, _ := ggit(ctx, "--git-dir="+repo, "rev-list", "--stdin", "--not", "--all", RunWith{stdin: stdin.String()})
+		if gerr != nil {
+			return nil, gerr
+		}
+		sha1s := Sha1Set{}
+		for _, __ := range xstrings.SplitLines(stdout, "\n") {
+			sha1, err := Sha1Parse(__)
+			if err != nil {
+				return nil, fmt.Errorf("rev-list: strange output entry: %q", __)
+			}
+			sha1s.Add(sha1)
+		}
+		return sha1s, nil
+	}
+
+	// commits not reachable from refs
+	stdin := strings.Builder{}
+	for _, sha1 := range commitv {
+		stdin.WriteString(sha1.String() + "\n")
+	}
+	unreachable, err := revlist(&stdin)
+	if err != nil {
+		return nil, err
+	}
+	candidatev := []Sha1{}
+	for _, sha1 := range commitv {
+		if unreachable.Contains(sha1) {
+			candidatev = append(candidatev, sha1)
+		}
+	}
+
+	// of them - commits not reachable from parents of each other
+	stdin.Reset()
+	for _, sha1 := range candidatev {
+		stdin.WriteString(sha1.String() + "^@\n")
+	}
+	covered, err := revlist(&stdin)
+	if err != nil {
+		return nil, err
+	}
+	for _, sha1 := range candidatev {
+		if !covered.Contains(sha1) {
+			tipv = append(tipv, sha1)
+		}
+	}
+	return tipv, nil
+}
@@ -1,4 +1,4 @@
-// Copyright (C) 2015-2016  Nexedi SA and Contributors.
+// Copyright (C) 2015-2026  Nexedi SA and Contributors.
 //                          Kirill Smelkov <kirr@nexedi.com>
 //
 // This program is free software: you can Use, Study, Modify and Redistribute
@@ -21,6 +21,10 @@ package main
 // Git-backup | Set "template" type
 // TODO -> go:generate + template
 
+import (
+	"sync"
+)
+
 // Set<Sha1>
 type Sha1Set map[Sha1]struct{}
 
@@ -44,6 +48,28 @@ func (s Sha1Set) Elements() []Sha1 {
 	return ev
 }
 
+// Set<Sha1> safe to use from multiple goroutines simultaneously
+// NOTE zero value is empty set ready to use
+type Sha1SetSync struct {
+	mu sync.Mutex
+	s  Sha1Set
+}
+
+func (s *Sha1SetSync) Add(v Sha1) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.s == nil {
+		s.s = Sha1Set{}
+	}
+	s.s.Add(v)
+}
+
+func (s *Sha1SetSync) Contains(v Sha1) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.s.Contains(v)
+}
+
 // Set<string>
 type StrSet map[string]struct{}
 
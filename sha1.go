@@ -1,4 +1,4 @@
-// Copyright (C) 2015-2025  Nexedi SA and Contributors.
+// Copyright (C) 2015-2026  Nexedi SA and Contributors.
 //                          Kirill Smelkov <kirr@nexedi.com>
 //
 // This program is free software: you can Use, Study, Modify and Redistribute
@@ -18,7 +18,7 @@
 // See https://www.nexedi.com/licensing for rationale and options.
 
 package main
-// Git-backup | Sha1 type to work with SHA1 oids
+// Git-backup | Sha1 type to work with SHA1 and SHA256 oids
 
 import (
 	"bytes"
@@ -30,28 +30,88 @@ import (
 	"lab.nexedi.com/kirr/git-backup/internal/git"
 )
 
-const SHA1_RAWSIZE = 20
+const (
+	SHA1_RAWSIZE   = 20
+	SHA256_RAWSIZE = 32
+)
+
+// ObjectFormat is hash algorithm a repository names its objects with.
+//
+// NOTE zero value is SHA1 - the format of all repositories before Git 2.29 .
+type ObjectFormat uint8
 
-// SHA1 value in raw form
+const (
+	ObjectFormatSHA1 ObjectFormat = iota
+	ObjectFormatSHA256
+)
+
+func (f ObjectFormat) String() string {
+	switch f {
+	case ObjectFormatSHA1:
+		return "sha1"
+	case ObjectFormatSHA256:
+		return "sha256"
+	}
+	return fmt.Sprintf("ObjectFormat(%d)", f)
+}
+
+// RawSize returns size of object id in raw form.
+func (f ObjectFormat) RawSize() int {
+	if f == ObjectFormatSHA256 {
+		return SHA256_RAWSIZE
+	}
+	return SHA1_RAWSIZE
+}
+
+// ObjectFormatParse parses object format as named by git, e.g. in extensions.objectFormat .
+func ObjectFormatParse(s string) (ObjectFormat, error) {
+	switch s {
+	case "sha1":
+		return ObjectFormatSHA1, nil
+	case "sha256":
+		return ObjectFormatSHA256, nil
+	}
+	return 0, fmt.Errorf("object format %q unknown", s)
+}
+
+// SHA1 or SHA256 object id in raw form
+// NOTE the type is named Sha1 for historical reasons - it was SHA1-only for long.
 // NOTE zero value of Sha1{} is NULL sha1
-// NOTE Sha1 size is 20 bytes. On amd64
+// NOTE Sha1 size is 33 bytes. On amd64
 //      - string size = 16 bytes
 //      - slice  size = 24 bytes
-//      -> so it is reasonable to pass Sha1 not by reference
+//      -> so it is still reasonable to pass Sha1 not by reference
 type Sha1 struct {
-	sha1 [SHA1_RAWSIZE]byte
+	sha1   [SHA256_RAWSIZE]byte // only first format.RawSize() bytes are used
+	format ObjectFormat
 }
 
 // fmt.Stringer
 var _ fmt.Stringer = Sha1{}
 
 func (sha1 Sha1) String() string {
-	return hex.EncodeToString(sha1.sha1[:])
+	return hex.EncodeToString(sha1.Raw())
+}
+
+// Raw returns sha1 in raw form.
+func (sha1 *Sha1) Raw() []byte {
+	return sha1.sha1[:sha1.format.RawSize()]
 }
 
+// Format returns object format sha1 belongs to.
+func (sha1 *Sha1) Format() ObjectFormat {
+	return sha1.format
+}
+
+// Sha1Parse parses hex form of SHA1 or SHA256 object id.
 func Sha1Parse(sha1str string) (Sha1, error) {
 	sha1 := Sha1{}
-	if hex.DecodedLen(len(sha1str)) != SHA1_RAWSIZE {
+	switch hex.DecodedLen(len(sha1str)) {
+	case SHA1_RAWSIZE:
+		sha1.format = ObjectFormatSHA1
+	case SHA256_RAWSIZE:
+		sha1.format = ObjectFormatSHA256
+	default:
 		return Sha1{}, fmt.Errorf("sha1parse: %q invalid", sha1str)
 	}
 	_, err := hex.Decode(sha1.sha1[:], mem.Bytes(sha1str))
@@ -62,6 +122,13 @@ func Sha1Parse(sha1str string) (Sha1, error) {
 	return sha1, nil
 }
 
+// Sha1FromRaw makes Sha1 of object format f from its raw form.
+func Sha1FromRaw(f ObjectFormat, raw []byte) Sha1 {
+	sha1 := Sha1{format: f}
+	copy(sha1.sha1[:f.RawSize()], raw)
+	return sha1
+}
+
 // fmt.Scanner
 var _ fmt.Scanner = (*Sha1)(nil)
 
@@ -83,21 +150,34 @@ func (sha1 *Sha1) Scan(s fmt.ScanState, ch rune) error {
 
 // check whether sha1 is null
 func (sha1 *Sha1) IsNull() bool {
-	return *sha1 == Sha1{}
+	return sha1.sha1 == [SHA256_RAWSIZE]byte{}
 }
 
 // for sorting by Sha1
 type BySha1 []Sha1
 
-func (p BySha1) Len() int           { return len(p) }
-func (p BySha1) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
-func (p BySha1) Less(i, j int) bool { return bytes.Compare(p[i].sha1[:], p[j].sha1[:]) < 0 }
+func (p BySha1) Len() int      { return len(p) }
+func (p BySha1) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p BySha1) Less(i, j int) bool {
+	if p[i].format != p[j].format {
+		return p[i].format < p[j].format
+	}
+	return bytes.Compare(p[i].sha1[:], p[j].sha1[:]) < 0
+}
 
 // interoperability with git package
-func (sha1 *Sha1) AsOid() *git.Oid {
-	return (*git.Oid)(&sha1.sha1)
+//
+// NOTE libgit2 git-backup is built with supports only SHA1 repositories.
+// Objects of repositories with other formats are accessed via git command.
+func (sha1 *Sha1) AsOid() (*git.Oid, error) {
+	if sha1.format != ObjectFormatSHA1 {
+		return nil, fmt.Errorf("%s: %s object id cannot be used with libgit2", sha1, sha1.format)
+	}
+	oid := git.Oid{}
+	copy(oid[:], sha1.sha1[:])
+	return &oid, nil
 }
 
 func Sha1FromOid(oid *git.Oid) Sha1 {
-	return Sha1{*oid}
+	return Sha1FromRaw(ObjectFormatSHA1, oid[:])
 }
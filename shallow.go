@@ -0,0 +1,456 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+
+package main
+// Git-backup | Shallow and partial-clone repositories
+//
+// History of a shallow repository is cut at commits listed in its shallow
+// file, and a partial clone lacks objects omitted by its filter - they are
+// to be lazily fetched from its promisor remote. Pull fetches from such
+// repositories what they have:
+//
+//   - from shallow repositories with --update-shallow, which makes backup
+//     repository shallow as well. Once backup repository is shallow, fetches
+//     from repositories, that have parents of its shallow commits, go with
+//     full depth, so that history behind shallow commits is pulled as soon as
+//     a repository that has it is pulled, and shallow commits whose parents
+//     are present are then dropped from shallow file of backup repository.
+//
+//   - from partial clones with their filter. Objects fetched so are marked
+//     as promisor objects, and backup repository gets promisorRemote
+//     configured, so that Git accepts objects missing behind them. Tips
+//     fetched from partial clones are listed in $GIT_DIR/backup.partial of
+//     backup repository. Objects missing behind them, that other pulled
+//     repositories have, are then fetched from those repositories explicitly,
+//     and tips with nothing missing behind them anymore are dropped from the
+//     list.
+//
+// Fetches from shallow and partial repositories, and fetches deepening
+// history of backup repository, run exclusively to other fetches. Usual
+// fetches run in parallel as before.
+//
+// Shallow and config files of pulled repositories are pulled as regular
+// files. Restored repository is thus shallow, or partial, as it was. Restore
+// packs for shallow repository history only up to its shallow commits, and
+// for partial clone only objects that are present in backup.
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"lab.nexedi.com/kirr/go123/exc"
+	"lab.nexedi.com/kirr/go123/xerr"
+	"lab.nexedi.com/kirr/go123/xstrings"
+)
+
+// promisorRemote is name of remote configured as promisor in backup repository
+// once objects from partial clones were pulled into it.
+//
+// It is never fetched from. It only tells Git that objects missing behind
+// promisor objects are expected to be missing.
+const promisorRemote = "git-backup-promisor"
+
+// partialFile lists tips fetched from partial clones, objects behind which
+// might be missing in backup repository.
+const partialFile = "backup.partial"
+
+// RepoKind describes how complete a repository is.
+type RepoKind struct {
+	shallow bool   // history is cut at commits listed in shallow file
+	filter  string // partial clone with objects omitted by this filter; "" if not partial
+}
+
+// repo_kind determines kind of local repository at gitdir.
+func repo_kind(ctx context.Context, gitdir string) (kind RepoKind, err error) {
+	defer xerr.Contextf(&err, "%s: determine repository kind", gitdir)
+
+	kind.shallow = isshallow(gitdir)
+
+	// partial clones always have promisor packs - check for them first to
+	// avoid running git for every usual repository.
+	if !haspromisor(gitdir) {
+		return kind, nil
+	}
+	filter, partial, err := repo_partial(ctx, gitdir)
+	if err != nil {
+		return kind, err
+	}
+	if partial && filter == "" {
+		return kind, fmt.Errorf("partial clone, but partial clone filter is not configured")
+	}
+	kind.filter = filter
+	return kind, nil
+}
+
+// repo_partial returns whether repository at gitdir is a partial clone, and
+// its partial clone filter, if configured.
+func repo_partial(ctx context.Context, gitdir string) (filter string, partial bool, err error) {
+	gerr, stdout, _ := ggit(ctx, "--git-dir="+gitdir, "config", "-z", "--get-regexp",
+		`^remote\..*\.(promisor|partialclonefilter)$|^extensions\.partialclone$`)
+	if gerr != nil {
+		if gerr.ExitCode() == 1 { // 1 = nothing found
+			return "", false, nil
+		}
+		return "", false, gerr
+	}
+
+	// "key\nvalue\0"
+	filtertab := map[string]string{} // remote -> filter
+	promisorv := []string{}          // promisor remotes
+	for _, entry := range xstrings.SplitLines(stdout, "\x00") {
+		key, value := entry, ""
+		if nl := strings.Index(entry, "\n"); nl != -1 {
+			key, value = entry[:nl], entry[nl+1:]
+		}
+		if key == "extensions.partialclone" {
+			promisorv = append(promisorv, value)
+			continue
+		}
+		dot := strings.LastIndex(key, ".")
+		remote, var_ := strings.TrimPrefix(key[:dot], "remote."), key[dot+1:]
+		switch var_ {
+		case "promisor":
+			if ok, err := parse_bool(value, false); err != nil {
+				return "", false, fmt.Errorf("%s: %s", key, err)
+			} else if ok {
+				promisorv = append(promisorv, remote)
+			}
+		case "partialclonefilter":
+			filtertab[remote] = value
+		}
+	}
+
+	for _, remote := range promisorv {
+		partial = true
+		f := filtertab[remote]
+		if f == "" {
+			continue
+		}
+		if filter != "" && f != filter {
+			return "", false, fmt.Errorf("promisor remotes have different partial clone filters: %q and %q", filter, f)
+		}
+		filter = f
+	}
+	return filter, partial, nil
+}
+
+// isshallow returns whether repository at gitdir is shallow.
+func isshallow(gitdir string) bool {
+	st, err := os.Stat(gitdir + "/shallow")
+	return err == nil && st.Size() != 0
+}
+
+// haspromisor returns whether repository at gitdir has promisor packs.
+func haspromisor(gitdir string) bool {
+	promisorv, _ := filepath.Glob(gitdir + "/objects/pack/*.promisor")
+	return len(promisorv) != 0
+}
+
+// loadShallow loads parents of shallow commits of backup repository, that are
+// missing in it. Must be called under exclusive fetchMu once fetches started.
+func (p *Pull) loadShallow(ctx context.Context) {
+	_, missingtab, err := shallow_missing(ctx, p.gitdir)
+	exc.Raiseif(err)
+	p.deepenv = nil
+	for _, parentv := range missingtab {
+		for _, parent := range parentv {
+			p.deepenv = append(p.deepenv, Ref{sha1: parent})
+		}
+	}
+}
+
+// deepens returns whether fetch from repository f deepens history of shallow
+// backup repository. Must be called under fetchMu.
+//
+// Local repository deepens it if it has any parent missing behind shallow
+// commits of backup. What remote repository has cannot be checked without
+// fetching from it, so, while backup is shallow, remote repositories are
+// fetched with full depth.
+func (p *Pull) deepens(ctx context.Context, f FetchReq) bool {
+	if len(p.deepenv) == 0 {
+		return false
+	}
+	if f.remote {
+		return true
+	}
+	havev, err := lshave(ctx, f.repo, p.deepenv)
+	exc.Raiseif(err)
+	return len(havev) != 0
+}
+
+// loadPartial loads tips fetched from partial clones by previous pulls.
+func (p *Pull) loadPartial(ctx context.Context) {
+	p.partialTips = Sha1Set{}
+	data, err := ioutil.ReadFile(p.gitdir + "/" + partialFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	exc.Raiseif(err)
+	for _, __ := range xstrings.SplitLines(strings.TrimSuffix(string(data), "\n"), "\n") {
+		sha1, err := Sha1Parse(__)
+		if err != nil {
+			exc.Raisef("%s/%s: %s", p.gitdir, partialFile, err)
+		}
+		p.partialTips.Add(sha1)
+	}
+}
+
+// savePartial saves tips fetched from partial clones. Must be called under partialMu.
+func (p *Pull) savePartial() {
+	path := p.gitdir + "/" + partialFile
+	if len(p.partialTips) == 0 {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			exc.Raise(err)
+		}
+		return
+	}
+	tipv := p.partialTips.Elements()
+	sort.Sort(BySha1(tipv))
+	data := strings.Builder{}
+	for _, tip := range tipv {
+		data.WriteString(tip.String() + "\n")
+	}
+	err := ioutil.WriteFile(path+".lock", []byte(data.String()), 0666)
+	exc.Raiseif(err)
+	err = os.Rename(path+".lock", path)
+	exc.Raiseif(err)
+}
+
+// addPartial remembers tips fetched from partial clone.
+func (p *Pull) addPartial(fetchedv []Ref) {
+	if len(fetchedv) == 0 {
+		return
+	}
+	p.partialMu.Lock()
+	defer p.partialMu.Unlock()
+	for _, ref := range fetchedv {
+		p.partialTips.Add(ref.sha1)
+	}
+	p.savePartial()
+}
+
+// complete fetches from repository f, which is not a partial clone, objects
+// missing in backup repository behind tips fetched from partial clones, if
+// the repository has them. refv are references of the repository.
+//
+// Only history behind partial tips the repository has is checked: objects
+// can be missing only behind them.
+func (p *Pull) complete(ctx context.Context, f FetchReq, kind RepoKind, refv []Ref) {
+	p.partialMu.Lock()
+	var tipv []Ref
+	for tip := range p.partialTips {
+		tipv = append(tipv, Ref{sha1: tip})
+	}
+	p.partialMu.Unlock()
+	if len(tipv) == 0 {
+		return
+	}
+
+	// partial tips the repository has. For remote repository only
+	// references it advertises can be checked.
+	var err error
+	if f.remote {
+		reftab := Sha1Set{}
+		for _, ref := range refv {
+			reftab.Add(ref.sha1)
+		}
+		var havev []Ref
+		for _, tip := range tipv {
+			if reftab.Contains(tip.sha1) {
+				havev = append(havev, tip)
+			}
+		}
+		tipv = havev
+	} else {
+		tipv, err = lshave(ctx, f.repo, tipv)
+		exc.Raiseif(err)
+	}
+	if len(tipv) == 0 {
+		return
+	}
+
+	// objects missing behind them.
+	// --ignore-missing: tip might be not in backup, e.g. if pull that fetched it failed.
+	stdin := strings.Builder{}
+	for _, tip := range tipv {
+		stdin.WriteString(tip.sha1.String() + "\n")
+	}
+	stdout := xgit(ctx, "rev-list", "--objects", "--missing=print", "--ignore-missing", "--stdin",
+		RunWith{stdin: stdin.String()})
+	var missingv []Ref
+	for _, __ := range xstrings.SplitLines(stdout, "\n") {
+		if !strings.HasPrefix(__, "?") {
+			continue
+		}
+		sha1, err := Sha1Parse(__[1:])
+		if err != nil {
+			exc.Raisef("rev-list: strange output entry: %q", __)
+		}
+		missingv = append(missingv, Ref{sha1: sha1})
+	}
+
+	// shallow repository does not have objects behind its shallow commits
+	fetchv := missingv
+	if kind.shallow && len(missingv) != 0 {
+		fetchv, err = lshave(ctx, f.repo, missingv)
+		exc.Raiseif(err)
+	}
+
+	// NOTE without negotiation - the objects are reachable from what
+	// we have, so remote would think we have them.
+	err = fetch_pack(ctx, f.repo, FetchOptions{}, fetchv, "-c", "fetch.negotiationAlgorithm=noop")
+	if err != nil {
+		exc.Raisef("fetch %s: %s", f.repo, err)
+	}
+
+	// nothing is missing behind the tips anymore - no need to check them again
+	if len(fetchv) == len(missingv) {
+		p.partialMu.Lock()
+		defer p.partialMu.Unlock()
+		for _, tip := range tipv {
+			delete(p.partialTips, tip.sha1)
+		}
+		p.savePartial()
+	}
+}
+
+// lshave returns objects from objv that local repository at gitdir has.
+func lshave(ctx context.Context, gitdir string, objv []Ref) (havev []Ref, err error) {
+	if len(objv) == 0 {
+		return nil, nil
+	}
+	var stdin []string
+	for _, obj := range objv {
+		stdin = append(stdin, obj.sha1.String())
+	}
+	gerr, stdout, _ := ggit(ctx, "--git-dir="+gitdir, "cat-file", "--batch-check=%(objectname)",
+		RunWith{stdin: strings.Join(stdin, "\n") + "\n"})
+	if gerr != nil {
+		return nil, gerr
+	}
+	for i, line := range xstrings.SplitLines(stdout, "\n") {
+		if i < len(objv) && !strings.HasSuffix(line, " missing") {
+			havev = append(havev, objv[i])
+		}
+	}
+	return havev, nil
+}
+
+// shallow_missing returns shallow commits of repository at gitdir, and which
+// of their parents are missing in the repository: shallow commit -> missing
+// parents. Shallow commits with all parents present are not in missingtab.
+func shallow_missing(ctx context.Context, gitdir string) (shallowv []string, missingtab map[string][]Sha1, err error) {
+	defer xerr.Contextf(&err, "%s: load shallow", gitdir)
+
+	data, err := ioutil.ReadFile(gitdir + "/shallow")
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return nil, nil, err
+	}
+
+	shallowv = xstrings.SplitLines(string(data), "\n")
+	parenttab := map[string][]Sha1{} // shallow commit -> its parents
+	parentv := []string{}
+	// NOTE cat-file shows commit as it is - not with parents cut by shallow file
+	err = catfile_batch(ctx, gitdir, string(data), func(commit, type_, content string) error {
+		if type_ != "commit" {
+			return fmt.Errorf("shallow %s: type is %s  (expected commit)", commit, type_)
+		}
+		pv, _, err := commit_parse(content)
+		if err != nil {
+			return fmt.Errorf("shallow %s: %s", commit, err)
+		}
+		for _, parent := range pv {
+			parenttab[commit] = append(parenttab[commit], parent)
+			parentv = append(parentv, parent.String())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	missing := StrSet{}
+	if len(parentv) != 0 {
+		gerr, stdout, _ := ggit(ctx, "--git-dir="+gitdir, "cat-file", "--batch-check=%(objectname)",
+			RunWith{stdin: strings.Join(parentv, "\n") + "\n"})
+		if gerr != nil {
+			return nil, nil, gerr
+		}
+		for _, line := range xstrings.SplitLines(stdout, "\n") {
+			if strings.HasSuffix(line, " missing") {
+				missing.Add(strings.TrimSuffix(line, " missing"))
+			}
+		}
+	}
+
+	missingtab = map[string][]Sha1{}
+	for _, commit := range shallowv {
+		for _, parent := range parenttab[commit] {
+			if missing.Contains(parent.String()) {
+				missingtab[commit] = append(missingtab[commit], parent)
+			}
+		}
+	}
+	return shallowv, missingtab, nil
+}
+
+// shallow_prune removes from shallow file of repository at gitdir commits
+// whose parents are all present in the repository.
+//
+// Fetching with --update-shallow from a shallow repository marks its shallow
+// commits as shallow even if the history behind them is already there, e.g.
+// pulled from a full clone before. That history would then be hidden from
+// restore.
+func shallow_prune(ctx context.Context, gitdir string) (err error) {
+	shallowv, missingtab, err := shallow_missing(ctx, gitdir)
+	if err != nil {
+		return err
+	}
+	defer xerr.Contextf(&err, "%s: prune shallow", gitdir)
+
+	keepv := []string{}
+	for _, commit := range shallowv {
+		if len(missingtab[commit]) != 0 {
+			keepv = append(keepv, commit)
+		}
+	}
+	if len(keepv) == len(shallowv) {
+		return nil
+	}
+
+	if len(keepv) == 0 {
+		return os.Remove(gitdir + "/shallow")
+	}
+	tmp := gitdir + "/shallow.lock"
+	err = ioutil.WriteFile(tmp, []byte(strings.Join(keepv, "\n")+"\n"), 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, gitdir+"/shallow")
+}
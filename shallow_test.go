@@ -0,0 +1,138 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// verify pull/restore of shallow and partial-clone repositories.
+func TestPullRestoreShallow(t *testing.T) {
+	ctx := context.Background()
+
+	workdir := xworkdir(t)
+
+	// full repository with 4 commits, and its shallow and partial clones
+	full := workdir + "/full/r.git"
+	xgit(ctx, "init", "-q", "--bare", full)
+	rgit := xrgit(ctx, full)
+	var commitv []string
+	for i := 0; i < 4; i++ {
+		blob := rgit("hash-object", "-w", "--stdin", RunWith{stdin: fmt.Sprintf("data %d", i)})
+		tree := rgit("mktree", RunWith{stdin: fmt.Sprintf("100644 blob %s\tf%d\n", blob, i)})
+		argv := []interface{}{"commit-tree", tree, "-m", fmt.Sprintf("c%d", i)}
+		if i > 0 {
+			argv = append(argv, "-p", commitv[i-1])
+		}
+		commitv = append(commitv, rgit(argv...))
+	}
+	rgit("update-ref", "refs/heads/master", commitv[3])
+
+	src := workdir + "/src"
+	xgit(ctx, "clone", "-q", "--bare", "--depth=1", "file://"+full, src+"/s1.git")
+	xgit(ctx, "clone", "-q", "--bare", "--depth=3", "file://"+full, src+"/s3.git")
+	xgit(ctx, "-c", "uploadpack.allowFilter=true", "clone", "-q", "--bare", "--filter=blob:none",
+		"file://"+full, workdir+"/partial/p.git")
+
+	kind, err := repo_kind(ctx, workdir+"/partial/p.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind != (RepoKind{filter: "blob:none"}) {
+		t.Fatalf("partial clone: kind = %+v", kind)
+	}
+
+	gb := xbackupInit(ctx, t, "backup.git")
+
+	// restore checks connectivity of restored repositories itself
+	restore := func(dst string, prefixv ...string) {
+		err := os.Mkdir(dst, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, prefix := range prefixv {
+			cmd_restore(ctx, gb, []string{"HEAD", prefix + ":" + dst + "/" + prefix})
+		}
+		for _, r := range []string{"b/s1.git", "b/s3.git", "p/p.git", "full/r.git"} {
+			if _, err := os.Stat(dst + "/" + r); os.IsNotExist(err) {
+				continue
+			}
+			head := xgit(ctx, "--git-dir="+dst+"/"+r, "rev-parse", "HEAD")
+			if head != commitv[3] {
+				t.Errorf("restore: %s: HEAD = %s  ; want %s", r, head, commitv[3])
+			}
+		}
+		shallow, err := ioutil.ReadFile(dst + "/b/s3.git/shallow")
+		if err != nil || string(shallow) != commitv[1]+"\n" {
+			t.Errorf("restore: s3.git: shallow: %q, %v", shallow, err)
+		}
+		nobj := strings.Count(xgit(ctx, "--git-dir="+dst+"/b/s3.git", "rev-list", "--objects", "HEAD"), "\n") + 1
+		if nobj != 3*3 {
+			t.Errorf("restore: s3.git: %d objects  ; want %d", nobj, 3*3)
+		}
+	}
+
+	// shallow repositories -> backup is shallow
+	cmd_pull(ctx, gb, []string{src + ":b"})
+	if !isshallow(".") {
+		t.Fatalf("pull shallow: backup is not shallow")
+	}
+	restore(workdir+"/dst1", "b")
+
+	// only repositories with history behind shallow commits of backup deepen it
+	p := &Pull{gitdir: "."}
+	p.loadShallow(ctx)
+	for repo, want := range map[string]bool{full: true, src + "/s1.git": false} {
+		if deepen := p.deepens(ctx, FetchReq{repo: repo}); deepen != want {
+			t.Errorf("shallow backup: %s: deepens = %v  ; want %v", repo, deepen, want)
+		}
+	}
+
+	// partial clone has all commits -> backup is no longer shallow, but has promisor objects
+	cmd_pull(ctx, gb, []string{src + ":b", workdir + "/partial:p"})
+	if isshallow(".") || !haspromisor(".") {
+		t.Fatalf("pull partial: backup: shallow=%v promisor=%v", isshallow("."), haspromisor("."))
+	}
+	restore(workdir+"/dst2", "b", "p")
+	if !haspromisor(workdir + "/dst2/p/p.git") {
+		t.Errorf("restore: p.git: no promisor pack")
+	}
+	partial, err := ioutil.ReadFile(partialFile)
+	if err != nil || string(partial) != commitv[3]+"\n" {
+		t.Errorf("pull partial: partial tips: %q, %v", partial, err)
+	}
+
+	// full repository -> blobs, that were missing, are pulled
+	cmd_pull(ctx, gb, []string{src + ":b", workdir + "/partial:p", workdir + "/full:full"})
+	missing := xgit(ctx, "rev-list", "--objects", "--missing=print", "HEAD")
+	if strings.Contains(missing, "?") {
+		t.Errorf("pull full: backup has missing objects:\n%s", missing)
+	}
+	if _, err := os.Stat(partialFile); !os.IsNotExist(err) {
+		t.Errorf("pull full: partial tips not dropped: %v", err)
+	}
+	restore(workdir+"/dst3", "b", "p", "full")
+}
@@ -0,0 +1,225 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+package main
+// Git-backup | Stat cache to avoid re-reading unchanged files on pull
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"lab.nexedi.com/kirr/go123/mem"
+	"lab.nexedi.com/kirr/go123/xerr"
+	"lab.nexedi.com/kirr/go123/xstrings"
+)
+
+// StatCache remembers which blobs files were converted to on pull.
+//
+// For every file it keeps stat information the file had when it was read. If
+// on next pull stat information of the file is the same, the file is
+// considered to be unchanged, and the blob is reused without reading the file.
+//
+// Like Git index, stat cache has "racy" problem: a file could be modified right
+// after it was read, but within the same timestamp granularity. To handle this
+// entries with mtime or ctime not older than the time when pull, that prepared
+// the cache, started, are not trusted.
+//
+// StatCache is not safe to use from several goroutines simultaneously.
+type StatCache struct {
+	reuse bool  // whether to reuse blobs from loaded entries
+	stamp int64 // unix seconds; entries with mtime/ctime ≥ stamp are racy
+
+	entryTab map[string]*StatCacheEntry // loaded entries
+	newTab   map[string]*StatCacheEntry // entries to save
+}
+
+// StatCacheEntry represents one file in StatCache.
+type StatCacheEntry struct {
+	sha1    Sha1   // blob file content was converted to
+	chunked bool   // sha1 is tree of chunks - see file_to_chunks
+	mode    uint32 // native mode
+	ino     uint64
+	size    int64
+	mtime   int64 // ns
+	ctime   int64 // ns
+	stamp   int64 // stamp of the cache this entry was loaded from
+}
+
+const statCacheMagic = "git-backup statcache 1"
+
+// newStatCache creates new empty stat cache.
+//
+// If reuse=false the cache is only refreshed - blobs of loaded entries are never reused.
+func newStatCache(reuse bool) *StatCache {
+	return &StatCache{
+		reuse:    reuse,
+		stamp:    time.Now().Unix(),
+		entryTab: map[string]*StatCacheEntry{},
+		newTab:   map[string]*StatCacheEntry{},
+	}
+}
+
+// loadStatCache loads stat cache from file at path.
+//
+// If the file does not exist, empty stat cache is returned.
+// Reuse has the same meaning as for newStatCache.
+func loadStatCache(path string, reuse bool) (_ *StatCache, err error) {
+	defer xerr.Contextf(&err, "statcache %s: load", path)
+
+	sc := newStatCache(reuse)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return sc, err
+	}
+
+	// <magic> SP <stamp> LF
+	// <sha1> SP <mode> SP <ino> SP <size> SP <mtime> SP <ctime> [SP c] TAB <path> NUL
+	// ...
+	//
+	// "c" marks chunked files.
+	header, body, err := xstrings.HeadTail(mem.String(data), "\n")
+	if err != nil || !strings.HasPrefix(header, statCacheMagic+" ") {
+		return nil, fmt.Errorf("invalid header")
+	}
+	var stamp int64
+	_, err = fmt.Sscanf(header[len(statCacheMagic)+1:], "%d", &stamp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid header")
+	}
+
+	for _, entry := range xstrings.SplitLines(body, "\x00") {
+		__, fpath, err := xstrings.HeadTail(entry, "\t")
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry %q", entry)
+		}
+		e := &StatCacheEntry{stamp: stamp}
+		if strings.HasSuffix(__, " c") {
+			e.chunked = true
+			__ = strings.TrimSuffix(__, " c")
+		}
+		_, err = fmt.Sscanf(__, "%s %o %d %d %d %d\n", &e.sha1, &e.mode, &e.ino, &e.size, &e.mtime, &e.ctime)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry %q", entry)
+		}
+		sc.entryTab[fpath] = e
+	}
+
+	return sc, nil
+}
+
+// Lookup returns blob a file was previously converted to, if the file is
+// known to be unchanged since then.
+//
+// st must be lstat information of the file at path. If chunked=true tree of
+// chunks is looked up instead of blob.
+func (sc *StatCache) Lookup(path string, st *syscall.Stat_t, chunked bool) (sha1 Sha1, ok bool) {
+	if !sc.reuse {
+		return Sha1{}, false
+	}
+	e := sc.entryTab[path]
+	if e == nil {
+		return Sha1{}, false
+	}
+	if e.racy() {
+		return Sha1{}, false
+	}
+	if e.chunked != chunked {
+		return Sha1{}, false
+	}
+	if e.mode != st.Mode || e.ino != st.Ino || e.size != st.Size ||
+	   e.mtime != st.Mtim.Nano() || e.ctime != st.Ctim.Nano() {
+		return Sha1{}, false
+	}
+
+	sc.newTab[path] = e
+	return e.sha1, true
+}
+
+// racy returns whether loaded entry cannot be trusted because file could be
+// changed after it was read in the same timestamp granule.
+func (e *StatCacheEntry) racy() bool {
+	return e.mtime >= e.stamp*1e9 || e.ctime >= e.stamp*1e9
+}
+
+// Update records that file at path, with lstat information st taken before
+// reading it, was converted to blob sha1, or to tree of chunks if chunked=true.
+func (sc *StatCache) Update(path string, st *syscall.Stat_t, sha1 Sha1, chunked bool) {
+	sc.newTab[path] = &StatCacheEntry{
+		sha1:    sha1,
+		chunked: chunked,
+		mode:    st.Mode,
+		ino:     st.Ino,
+		size:    st.Size,
+		mtime:   st.Mtim.Nano(),
+		ctime:   st.Ctim.Nano(),
+	}
+}
+
+// Save saves stat cache to file at path.
+//
+// Saved are entries looked up or updated since the cache was loaded, and
+// loaded entries for files not under any of dirs - the directories that were
+// walked with this cache.
+//
+// Save should be called only after blobs of recorded entries are made
+// reachable from backup repository HEAD.
+func (sc *StatCache) Save(path string, dirs []string) (err error) {
+	defer xerr.Contextf(&err, "statcache %s: save", path)
+
+	for fpath, e := range sc.entryTab {
+		if _, ok := sc.newTab[fpath]; ok || e.racy() {
+			continue
+		}
+		walked := false
+		for _, dir := range dirs {
+			if path_isunder(dir, fpath) {
+				walked = true
+				break
+			}
+		}
+		if !walked {
+			sc.newTab[fpath] = e
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %d\n", statCacheMagic, sc.stamp)
+	for fpath, e := range sc.newTab {
+		chunked := ""
+		if e.chunked {
+			chunked = " c"
+		}
+		fmt.Fprintf(&b, "%s %o %d %d %d %d%s\t%s\x00", e.sha1, e.mode, e.ino, e.size, e.mtime, e.ctime, chunked, fpath)
+	}
+
+	// write atomically, so that the cache is never seen half-written
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, mem.Bytes(b.String()), 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
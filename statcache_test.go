@@ -0,0 +1,137 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestStatCache(t *testing.T) {
+	workdir, err := ioutil.TempDir("", "t-statcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workdir)
+
+	xwrite := func(path, data string) {
+		err := ioutil.WriteFile(path, []byte(data), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	xlstat := func(path string) *syscall.Stat_t {
+		var st syscall.Stat_t
+		err := syscall.Lstat(path, &st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &st
+	}
+	xload := func(reuse bool) *StatCache {
+		sc, err := loadStatCache(workdir+"/statcache", reuse)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sc
+	}
+
+	dir1 := workdir + "/1"
+	dir2 := workdir + "/2"
+	for _, dir := range []string{dir1, dir2} {
+		err := os.Mkdir(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b, c := dir1+"/a", dir1+"/b", dir2+"/c"
+	xwrite(a, "aaa")
+	xwrite(b, "bbb")
+	xwrite(c, "ccc")
+	sha1a := XSha1("0000000000000000000000000000000000000001")
+	sha1b := XSha1("0000000000000000000000000000000000000002")
+	sha1c := XSha1("0000000000000000000000000000000000000003")
+
+	// initially cache is empty
+	sc := xload(true)
+	if _, ok := sc.Lookup(a, xlstat(a), false); ok {
+		t.Fatal("empty cache: lookup succeeded")
+	}
+	sc.Update(a, xlstat(a), sha1a, false)
+	sc.Update(b, xlstat(b), sha1b, false)
+	sc.Update(c, xlstat(c), sha1c, true)
+	err = sc.Save(workdir+"/statcache", []string{dir1, dir2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// files were just written - entries are racy wrt cache stamp and must not be trusted
+	sc = xload(true)
+	if _, ok := sc.Lookup(a, xlstat(a), false); ok {
+		t.Fatal("racy entry trusted")
+	}
+
+	// pretend the cache was prepared by pull that started later
+	sc = xload(true)
+	for _, e := range sc.entryTab {
+		e.stamp += 10
+	}
+	if sha1, ok := sc.Lookup(a, xlstat(a), false); !(ok && sha1 == sha1a) {
+		t.Fatalf("unchanged a: lookup -> %s %v  ; want %s true", sha1, ok, sha1a)
+	}
+	if _, ok := sc.Lookup(a, xlstat(a), true); ok {
+		t.Fatal("a: lookup of chunked succeeded")
+	}
+
+	// changed file must not be trusted even if size is the same
+	xwrite(b, "BBB")
+	if _, ok := sc.Lookup(b, xlstat(b), false); ok {
+		t.Fatal("changed b: lookup succeeded")
+	}
+
+	// reuse=false -> never trusted
+	sc2 := xload(false)
+	for _, e := range sc2.entryTab {
+		e.stamp += 10
+	}
+	if _, ok := sc2.Lookup(a, xlstat(a), false); ok {
+		t.Fatal("reuse=false: lookup succeeded")
+	}
+
+	// save after walking only dir1: entry for a is kept as looked up, entry for
+	// c is preserved as dir2 was not walked, entry for b is gone.
+	sc.stamp += 10
+	err = sc.Save(workdir+"/statcache", []string{dir1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc = xload(true)
+	if _, ok := sc.entryTab[a]; !ok {
+		t.Error("a: entry not saved")
+	}
+	if _, ok := sc.entryTab[b]; ok {
+		t.Error("b: stale entry saved")
+	}
+	if e, ok := sc.entryTab[c]; !(ok && e.chunked) {
+		t.Error("c: chunked entry for not walked dir not preserved")
+	}
+}
@@ -1,4 +1,4 @@
-// Copyright (C) 2015-2016  Nexedi SA and Contributors.
+// Copyright (C) 2015-2026  Nexedi SA and Contributors.
 //                          Kirill Smelkov <kirr@nexedi.com>
 //
 // This program is free software: you can Use, Study, Modify and Redistribute
@@ -23,7 +23,10 @@ package main
 import (
 	"encoding/hex"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"strconv"
 	"strings"
 	"syscall"
 	"unicode"
@@ -52,6 +55,118 @@ func reprefix(prefix_from, prefix_to, path string) string {
 	return fmt.Sprintf("%s/%s", prefix_to, path)
 }
 
+// path_isunder("a/b", "a/b/c") -> true
+// path_isunder("a/b", "a/bc")  -> false
+func path_isunder(prefix, path string) bool {
+	prefix = strings.TrimRight(prefix, "/")
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// escape .git path components, which git refuses to have in trees and index
+// path_dotgitescape("a/.git/HEAD") -> "a/%2Egit/HEAD"
+func path_dotgitescape(path string) string {
+	partv := strings.Split(path, "/")
+	for i, part := range partv {
+		if strings.EqualFold(part, ".git") {
+			partv[i] = "%2E" + part[1:]
+		}
+	}
+	return strings.Join(partv, "/")
+}
+
+// path_dotgitunescape("a/%2Egit/HEAD") -> "a/.git/HEAD"
+func path_dotgitunescape(path string) string {
+	partv := strings.Split(path, "/")
+	for i, part := range partv {
+		if strings.HasPrefix(part, "%2E") && strings.EqualFold(part[3:], "git") {
+			partv[i] = "." + part[3:]
+		}
+	}
+	return strings.Join(partv, "/")
+}
+
+// StrList is flag.Value that collects all values of repeatable option.
+type StrList []string
+
+func (l *StrList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *StrList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// spec_split splits pullspec/restorespec at first, or, if last, at last ":"
+// that is not escaped as "\:", and unescapes both parts.
+//
+// spec_split(`a\:b:c`, false) -> "a:b", "c"
+// spec_split(`a:b:c`, true)    -> "a:b", "c"
+//
+// "\\" stands for "\" - e.g. for paths ending with backslash.
+func spec_split(s string, last bool) (head, tail string, err error) {
+	split := -1
+loop:
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++ // skip escaped character
+		case ':':
+			split = i
+			if !last {
+				break loop
+			}
+		}
+	}
+	if split == -1 {
+		return "", "", fmt.Errorf("no ':'")
+	}
+	return spec_unescape(s[:split]), spec_unescape(s[split+1:]), nil
+}
+
+// spec_unescape unescapes "\:" and "\\" in part of a spec.
+func spec_unescape(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) && (s[i+1] == ':' || s[i+1] == '\\') {
+			i++
+			c = s[i]
+		}
+		out = append(out, c)
+	}
+	return string(out)
+}
+
+// parse_size("10") -> 10; parse_size("4K") -> 4096; also M, G and T suffixes.
+func parse_size(s string) (int64, error) {
+	orig := s
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'k', 'K':
+			mult = 1 << 10
+		case 'm', 'M':
+			mult = 1 << 20
+		case 'g', 'G':
+			mult = 1 << 30
+		case 't', 'T':
+			mult = 1 << 40
+		}
+		if mult != 1 {
+			s = s[:n-1]
+		}
+	}
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || size < 0 || size > math.MaxInt64/mult {
+		return 0, fmt.Errorf("invalid size %q", orig)
+	}
+	return size * mult, nil
+}
+
 // like ioutil.WriteFile() but takes native mode/perm
 func writefile(path string, data []byte, perm uint32) error {
 	fd, err := syscall.Open(path, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_TRUNC, perm)
@@ -67,6 +182,21 @@ func writefile(path string, data []byte, perm uint32) error {
 	return err
 }
 
+// like writefile() but data is copied from r
+func writefile_from(path string, r io.Reader, perm uint32) error {
+	fd, err := syscall.Open(path, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_TRUNC, perm)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	f := os.NewFile(uintptr(fd), path)
+	_, err = io.Copy(f, r)
+	err2 := f.Close()
+	if err == nil {
+		err = err2
+	}
+	return err
+}
+
 // escape path so that git is happy to use it as ref
 // https://git.kernel.org/cgit/git/git.git/tree/refs.c?h=v2.9.0-37-g6d523a3#n34
 // XXX very suboptimal
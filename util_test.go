@@ -1,4 +1,4 @@
-// Copyright (C) 2015-2016  Nexedi SA and Contributors.
+// Copyright (C) 2015-2026  Nexedi SA and Contributors.
 //                          Kirill Smelkov <kirr@nexedi.com>
 //
 // This program is free software: you can Use, Study, Modify and Redistribute
@@ -98,3 +98,45 @@ func TestPathUnescapeErr(t *testing.T) {
 		}
 	}
 }
+
+func TestPathIsUnder(t *testing.T) {
+	var tests = []struct {
+		prefix, path string
+		ok           bool
+	}{
+		{"a", "a/b.git", true},
+		{"a/", "a/b.git", true},
+		{"a/b", "a/b", true},
+		{"a/b", "a/bc", false},
+		{"a/b", "a", false},
+		{"b1", "b10/x.git", false},
+	}
+
+	for _, tt := range tests {
+		ok := path_isunder(tt.prefix, tt.path)
+		if ok != tt.ok {
+			t.Errorf("path_isunder(%q, %q) -> %v  ; want %v", tt.prefix, tt.path, ok, tt.ok)
+		}
+	}
+}
+
+func TestPathDotgitEscape(t *testing.T) {
+	var tests = []struct{ path, escaped string }{
+		{"a/b", "a/b"},
+		{"a/.git/HEAD", "a/%2Egit/HEAD"},
+		{".git", "%2Egit"},
+		{"a/.GIT/x", "a/%2EGIT/x"},
+		{"a/x.git/.gitignore", "a/x.git/.gitignore"},
+	}
+
+	for _, tt := range tests {
+		escaped := path_dotgitescape(tt.path)
+		if escaped != tt.escaped {
+			t.Errorf("path_dotgitescape(%q) -> %q  ; want %q", tt.path, escaped, tt.escaped)
+		}
+		unescaped := path_dotgitunescape(escaped)
+		if unescaped != tt.path {
+			t.Errorf("path_dotgitunescape(%q) -> %q  ; want %q", escaped, unescaped, tt.path)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright (C) 2026  Nexedi SA and Contributors.
+//                     Kirill Smelkov <kirr@nexedi.com>
+//
+// This program is free software: you can Use, Study, Modify and Redistribute
+// it under the terms of the GNU General Public License version 3, or (at your
+// option) any later version, as published by the Free Software Foundation.
+//
+// You can also Link and Combine this program with other software covered by
+// the terms of any of the Free Software licenses or any of the Open Source
+// Initiative approved licenses and Convey the resulting work. Corresponding
+// source of such a combination shall include the source code for all other
+// software used.
+//
+// This program is distributed WITHOUT ANY WARRANTY; without even the implied
+// warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+//
+// See COPYING file for full licensing terms.
+// See https://www.nexedi.com/licensing for rationale and options.
+
+package main
+// Git-backup | Non-bare repositories and linked worktrees
+//
+// A non-bare repository is pulled as its <worktree>/.git repository, fetched
+// the usual way, plus working files, including .git/index, blobbed as just
+// files. A linked worktree has .git file ("gitfile") pointing to
+// <repo>/worktrees/<name>/ admin directory of main repository, which in turn
+// has "gitdir" file pointing back to the worktree.
+//
+// Worktree HEADs are usually symbolic references and are saved as just files.
+// When a HEAD is detached, however, the commit it points to could be not
+// reachable from any reference. Such HEADs are saved to backup.refs as
+// pseudo-references named relative to refs/, e.g.
+//
+//   <sha1> <prefix>/project/%2Egit/../HEAD
+//   <sha1> <prefix>/project/%2Egit/../worktrees/<name>/HEAD
+//
+// so that their objects are pulled and restored. Restore does not create
+// references for them.
+//
+// Absolute paths in gitfiles and worktrees/<name>/gitdir, that point inside
+// pulled directory, are saved as relative, and restore makes them absolute
+// again for the place where the backup is restored.
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"lab.nexedi.com/kirr/go123/exc"
+	"lab.nexedi.com/kirr/go123/mem"
+	"lab.nexedi.com/kirr/go123/xerr"
+
+	"lab.nexedi.com/kirr/git-backup/internal/git"
+)
+
+// isPseudoRef returns whether ref name from backup.refs is not a reference,
+// but e.g. detached HEAD.
+func isPseudoRef(ref string) bool {
+	return strings.HasPrefix(ref, "../")
+}
+
+// lsdetached lists detached HEADs of local repository and its linked worktrees.
+//
+// The HEADs are returned as pseudo-references - see isPseudoRef.
+func lsdetached(repo string) (headv []Ref, err error) {
+	defer xerr.Contextf(&err, "lsdetached %s", repo)
+
+	headfilev, err := filepath.Glob(repo + "/worktrees/*/HEAD")
+	if err != nil {
+		return nil, err
+	}
+	headfilev = append([]string{repo + "/HEAD"}, headfilev...)
+
+	for _, headfile := range headfilev {
+		data, err := ioutil.ReadFile(headfile)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // worktree removed in parallel to us
+			}
+			return nil, err
+		}
+		sha1, err := Sha1Parse(strings.TrimSpace(mem.String(data)))
+		if err != nil {
+			continue // symbolic ref - saved as just file
+		}
+		name := "../" + path_refescape(strip_prefix(repo, headfile))
+		headv = append(headv, Ref{name: name, sha1: sha1})
+	}
+
+	return headv, nil
+}
+
+// isGitlink returns whether path is a file that links worktree and repository:
+// either .git gitfile, or <repo>/worktrees/<name>/gitdir.
+func isGitlink(path string) bool {
+	switch pathpkg.Base(path) {
+	case ".git":
+		return true
+	case "gitdir":
+		wtdir := pathpkg.Dir(path)
+		repo := pathpkg.Dir(pathpkg.Dir(wtdir))
+		return pathpkg.Base(pathpkg.Dir(wtdir)) == "worktrees" &&
+			(strings.HasSuffix(repo, ".git") || isrepo(repo))
+	}
+	return false
+}
+
+// parseGitlink splits content of gitlink file into "gitdir: " prefix, linked path and trailer.
+func parseGitlink(path string, data string) (prefix, link, trailer string) {
+	if pathpkg.Base(path) == ".git" {
+		prefix = "gitdir: "
+	}
+	link = strings.TrimPrefix(data, prefix)
+	link = strings.TrimRight(link, "\n")
+	trailer = data[len(prefix)+len(link):]
+	return prefix, link, trailer
+}
+
+// gitlink_to_blob converts gitlink file at path, found while walking dir, to blob.
+//
+// If the file links to absolute path inside dir, the link is made relative.
+func gitlink_to_blob(g *git.Repository, dir, path string) (Sha1, uint32) {
+	var st syscall.Stat_t
+	err := syscall.Lstat(path, &st)
+	if err != nil {
+		exc.Raise(&os.PathError{Op: "lstat", Path: path, Err: err})
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return file_to_blob(g, path, nil)
+	}
+
+	blob_sha1, err := WriteObject(g, gitlink_content(dir, path), git.ObjectBlob)
+	exc.Raiseif(err)
+	return blob_sha1, st.Mode
+}
+
+// gitlink_content returns content of regular gitlink file at path, found
+// while walking dir, as it should be saved to backup.
+func gitlink_content(dir, path string) []byte {
+	data, err := ioutil.ReadFile(path)
+	exc.Raiseif(err)
+	prefix, link, trailer := parseGitlink(path, mem.String(data))
+
+	if filepath.IsAbs(link) {
+		rel := ""
+		for _, root := range gitlink_roots(dir) {
+			if path_isunder(root, link) {
+				abspath := filepath.Join(root, strip_prefix(dir, path))
+				rel, err = filepath.Rel(filepath.Dir(abspath), link)
+				exc.Raiseif(err)
+				break
+			}
+		}
+		if rel != "" {
+			data = []byte(prefix + rel + trailer)
+		} else if prefix != "" {
+			infof("Warning: %s: linked to repository outside of pulled directory; only working files are pulled", path)
+		}
+	}
+
+	return data
+}
+
+// gitlink_roots returns absolute forms of dir, as given and with symlinks
+// resolved, because git records real paths in gitlinks.
+func gitlink_roots(dir string) []string {
+	absdir, err := filepath.Abs(dir)
+	exc.Raiseif(err)
+	rootv := []string{absdir}
+	realdir, err := filepath.EvalSymlinks(absdir)
+	if err == nil && realdir != absdir {
+		rootv = append(rootv, realdir)
+	}
+	return rootv
+}
+
+// gitlink_restored fixes up just restored gitlink file at path.
+//
+// Relative link in <repo>/worktrees/<name>/gitdir is made absolute, because
+// git requires that. Relative link in gitfile is left as is - git supports it.
+//
+// For linked worktrees the path of restored worktree is returned.
+func gitlink_restored(path string) (worktree string, err error) {
+	defer xerr.Contextf(&err, "%s", path)
+
+	if pathpkg.Base(path) == ".git" {
+		return "", nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	prefix, link, trailer := parseGitlink(path, mem.String(data))
+	if !filepath.IsAbs(link) {
+		abspath, err := filepath.Abs(path)
+		if err != nil {
+			return "", err
+		}
+		link = filepath.Join(filepath.Dir(abspath), link)
+		err = ioutil.WriteFile(path, []byte(prefix+link+trailer), 0666)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return filepath.Dir(link), nil
+}
+
+// worktree_refresh brings index of restored worktree in sync with restored files.
+//
+// Stat information in saved index is of original files, and if index was not
+// saved at all, it is recreated from HEAD.
+func worktree_refresh(ctx context.Context, worktree string) (err error) {
+	defer xerr.Contextf(&err, "worktree %s: refresh", worktree)
+
+	if _, err := os.Stat(worktree); err != nil {
+		return err
+	}
+
+	gerr, _, _ := ggit(ctx, "-C", worktree, "rev-parse", "--verify", "-q", "HEAD")
+	if gerr != nil {
+		return nil // unborn branch - nothing is checked out
+	}
+
+	gerr, index, _ := ggit(ctx, "-C", worktree, "rev-parse", "--git-path", "index")
+	if gerr != nil {
+		return gerr
+	}
+	if !filepath.IsAbs(index) {
+		index = worktree + "/" + index
+	}
+	_, err = os.Stat(index)
+	if os.IsNotExist(err) {
+		gerr, _, _ = ggit(ctx, "-C", worktree, "read-tree", "HEAD")
+		if gerr != nil {
+			return gerr
+		}
+	} else if err != nil {
+		return err
+	}
+
+	// NOTE exit status is 1 if some files are modified compared to index
+	gerr, _, _ = ggit(ctx, "-C", worktree, "update-index", "-q", "--refresh")
+	if gerr != nil && gerr.ExitCode() != 1 {
+		return gerr
+	}
+	if gerr != nil {
+		infof("# worktree %s has uncommitted changes", worktree)
+	}
+	return nil
+}